@@ -25,6 +25,141 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/contacts/{id}": {
+            "get": {
+                "description": "get the consolidated contact of the cluster the given contact belongs to.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "root"
+                ],
+                "summary": "Show the consolidated contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "enum": [
+                            "contacts"
+                        ],
+                        "type": "string",
+                        "description": "Set to contacts to include every contact of the cluster",
+                        "name": "expand",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.ContactResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            },
+            "delete": {
+                "description": "soft delete a contact. When it is the primary contact of its cluster, the oldest remaining contact becomes the primary.",
+                "tags": [
+                    "root"
+                ],
+                "summary": "Delete a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/contacts/{id}/history": {
+            "get": {
+                "description": "get the events of the cluster the given contact belongs to, oldest first.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "root"
+                ],
+                "summary": "Show the history of a contact.",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Contact ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.HistoryResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "liveness probe: succeeds as long as the process serves requests.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Show whether the service is up.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.HealthResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/identify": {
             "post": {
                 "description": "get the contact links of server.",
@@ -47,6 +182,21 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/pkg.ContactRequest"
                         }
+                    },
+                    {
+                        "enum": [
+                            "contacts"
+                        ],
+                        "type": "string",
+                        "description": "Set to contacts to include every contact of the cluster",
+                        "name": "expand",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key answering repeats of the request with the response of the first one, without applying them again",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -59,6 +209,161 @@ const docTemplate = `{
                     "400": {
                         "description": "Bad Request"
                     },
+                    "422": {
+                        "description": "Unprocessable Entity"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/identify/batch": {
+            "post": {
+                "description": "identify every contact in order, each in its own transaction, as if they were sent one by one.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "root"
+                ],
+                "summary": "Show the contacts links of many requests.",
+                "parameters": [
+                    {
+                        "description": "Contact Request Bodies",
+                        "name": "contacts",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/pkg.ContactRequest"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.BatchContactResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    }
+                }
+            }
+        },
+        "/identify/lookup": {
+            "post": {
+                "description": "get the contact links identify would return, and the change it would make, without writing anything.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "root"
+                ],
+                "summary": "Show the contacts links without changing them.",
+                "parameters": [
+                    {
+                        "description": "Contact Request Body",
+                        "name": "contact",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/pkg.ContactRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.LookupResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "readiness probe: fails while the database is unreachable, migrations are pending, or the service is shutting down.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Show whether the service can take requests.",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.HealthResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.HealthResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/unmerge": {
+            "post": {
+                "description": "revert the latest merge of the given contact's cluster, or the latest merge caused by a request with the given email, phone number and identifiers.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "root"
+                ],
+                "summary": "Split a merged contact.",
+                "parameters": [
+                    {
+                        "description": "Unmerge Request Body",
+                        "name": "unmerge",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/pkg.UnmergeRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/pkg.UnmergeResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "409": {
+                        "description": "Conflict"
+                    },
                     "500": {
                         "description": "Internal Server Error"
                     }
@@ -67,9 +372,41 @@ const docTemplate = `{
         }
     },
     "definitions": {
+        "pkg.BatchContactResponse": {
+            "type": "object",
+            "properties": {
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.BatchContactResult"
+                    }
+                }
+            }
+        },
+        "pkg.BatchContactResult": {
+            "type": "object",
+            "properties": {
+                "contact": {
+                    "$ref": "#/definitions/pkg.Contact"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "integer",
+                    "example": 200
+                }
+            }
+        },
         "pkg.Contact": {
             "type": "object",
             "properties": {
+                "contacts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.ContactDetail"
+                    }
+                },
                 "emails": {
                     "type": "array",
                     "items": {
@@ -79,6 +416,16 @@ const docTemplate = `{
                         "contact@example.com"
                     ]
                 },
+                "identifiers": {
+                    "description": "Identifiers holds the values of every other identifier type, primary contact first.",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        }
+                    }
+                },
                 "phoneNumbers": {
                     "type": "array",
                     "items": {
@@ -100,6 +447,90 @@ const docTemplate = `{
                     "example": [
                         456
                     ]
+                },
+                "updatedAt": {
+                    "description": "UpdatedAt and Contacts are only set in expanded responses. UpdatedAt is\nthe latest change to any contact of the cluster.",
+                    "type": "string"
+                }
+            }
+        },
+        "pkg.ContactDetail": {
+            "type": "object",
+            "properties": {
+                "createdAt": {
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string",
+                    "example": "contact@example.com"
+                },
+                "id": {
+                    "type": "integer",
+                    "example": 456
+                },
+                "linkPrecedence": {
+                    "type": "string",
+                    "enum": [
+                        "primary",
+                        "secondary"
+                    ],
+                    "example": "secondary"
+                },
+                "linkedId": {
+                    "type": "integer",
+                    "example": 123
+                },
+                "phoneNumber": {
+                    "type": "string",
+                    "example": "1234567890"
+                },
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "pkg.ContactEvent": {
+            "type": "object",
+            "properties": {
+                "contactId": {
+                    "type": "integer",
+                    "example": 456
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "email": {
+                    "type": "string",
+                    "example": "contact@example.com"
+                },
+                "id": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "identifiers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.Identifier"
+                    }
+                },
+                "phoneNumber": {
+                    "type": "string",
+                    "example": "1234567890"
+                },
+                "primaryContactId": {
+                    "type": "integer",
+                    "example": 123
+                },
+                "type": {
+                    "type": "string",
+                    "enum": [
+                        "created",
+                        "linked",
+                        "merged",
+                        "unmerged",
+                        "deleted"
+                    ],
+                    "example": "linked"
                 }
             }
         },
@@ -110,9 +541,24 @@ const docTemplate = `{
                     "type": "string",
                     "example": "contact@example.com"
                 },
+                "emailVerified": {
+                    "description": "EmailVerified and Source tell whether the caller verified the email, and which system the\ncontact comes from. They are kept on contacts the request creates, for primary policies.",
+                    "type": "boolean",
+                    "example": true
+                },
+                "identifiers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.Identifier"
+                    }
+                },
                 "phoneNumber": {
                     "type": "string",
                     "example": "1234567890"
+                },
+                "source": {
+                    "type": "string",
+                    "example": "pos"
                 }
             }
         },
@@ -123,6 +569,118 @@ const docTemplate = `{
                     "$ref": "#/definitions/pkg.Contact"
                 }
             }
+        },
+        "pkg.HealthCheck": {
+            "type": "object",
+            "properties": {
+                "detail": {
+                    "type": "string",
+                    "example": "1 pending migration: 0008_add_contact_email_verified_and_source"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "ok",
+                        "unavailable"
+                    ],
+                    "example": "ok"
+                }
+            }
+        },
+        "pkg.HealthResponse": {
+            "type": "object",
+            "properties": {
+                "checks": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/pkg.HealthCheck"
+                    }
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "ok",
+                        "unavailable"
+                    ],
+                    "example": "ok"
+                }
+            }
+        },
+        "pkg.HistoryResponse": {
+            "type": "object",
+            "properties": {
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.ContactEvent"
+                    }
+                }
+            }
+        },
+        "pkg.Identifier": {
+            "type": "object",
+            "properties": {
+                "type": {
+                    "type": "string",
+                    "example": "loyaltyId"
+                },
+                "value": {
+                    "type": "string",
+                    "example": "L-1234"
+                }
+            }
+        },
+        "pkg.LookupResponse": {
+            "type": "object",
+            "properties": {
+                "contact": {
+                    "$ref": "#/definitions/pkg.Contact"
+                },
+                "outcome": {
+                    "type": "string",
+                    "enum": [
+                        "newPrimary",
+                        "newSecondary",
+                        "existing",
+                        "merge"
+                    ],
+                    "example": "newSecondary"
+                }
+            }
+        },
+        "pkg.UnmergeRequest": {
+            "type": "object",
+            "properties": {
+                "contactId": {
+                    "type": "integer",
+                    "example": 456
+                },
+                "email": {
+                    "type": "string",
+                    "example": "contact@example.com"
+                },
+                "identifiers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.Identifier"
+                    }
+                },
+                "phoneNumber": {
+                    "type": "string",
+                    "example": "1234567890"
+                }
+            }
+        },
+        "pkg.UnmergeResponse": {
+            "type": "object",
+            "properties": {
+                "contacts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/pkg.Contact"
+                    }
+                }
+            }
         }
     }
 }`
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+const maxBatchSize = 1000
+
+// identifyBatch godoc
+// @Summary Show the contacts links of many requests.
+// @Description identify every contact in order, each in its own transaction, as if they were sent one by one.
+// @Tags root
+// @Param contacts body []pkg.ContactRequest true "Contact Request Bodies"
+// @Accept json
+// @Produce json
+// @Success 200 {object} pkg.BatchContactResponse
+// @Failure 400
+// @Router /identify/batch [post]
+// @Consumes application/json
+func identifyBatch(c echo.Context) error {
+	s := c.Get("service").(*Service)
+
+	var reqs []pkg.ContactRequest
+	if err := c.Bind(&reqs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if len(reqs) > maxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("too many contacts in batch: %d, at most %d are allowed", len(reqs), maxBatchSize))
+	}
+
+	ctx := c.Request().Context()
+	res := pkg.NewBatchContactResponse()
+
+	for _, req := range reqs {
+		contact, err := identifyBatchItem(ctx, s, req)
+		if err != nil {
+			if ctxErr := contextError(ctx); ctxErr != nil {
+				err = ctxErr
+			}
+			res.Results = append(res.Results, batchError(err))
+			continue
+		}
+		res.Results = append(res.Results, pkg.BatchContactResult{
+			Status:  http.StatusOK,
+			Contact: &contact.Contact,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// identifyBatchItem runs a single request of a batch in its own transaction, so that
+// a failing request is rolled back without affecting the others.
+func identifyBatchItem(ctx context.Context, s *Service, req pkg.ContactRequest) (*pkg.ContactResponse, error) {
+	if err := prepareContactRequest(s, &req); err != nil {
+		return nil, err
+	}
+
+	res, _, err := identifyInTransaction(ctx, s, req, false, nil)
+	return res, err
+}
+
+func batchError(err error) pkg.BatchContactResult {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return pkg.BatchContactResult{Status: httpErr.Code, Error: fmt.Sprint(httpErr.Message)}
+	}
+	return pkg.BatchContactResult{Status: http.StatusInternalServerError, Error: err.Error()}
+}
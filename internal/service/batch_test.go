@@ -0,0 +1,61 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_IdentifyBatch(t *testing.T) {
+	assert := asserts.New(t)
+
+	bodies := []string{
+		`{"phoneNumber":"123456","email":"lorraine@hillvalley.edu"}`,
+		`{"phoneNumber":"123456","email":"mcfly@hillvalley.edu"}`,
+		`{"phoneNumber":"abc"}`,
+		`{"phoneNumber":"717171","email":"george@hillvalley.edu"}`,
+		`{"phoneNumber":"717171","email":"mcfly@hillvalley.edu"}`,
+		`{"email":"george@hillvalley.edu"}`,
+	}
+
+	// The same requests sent one by one.
+	single := newTestService()
+	var want []pkg.BatchContactResult
+	for _, body := range bodies {
+		rec := serve(single, http.MethodPost, "/identify", body)
+		if rec.Code != http.StatusOK {
+			var res struct{ Message string }
+			assert.Nil(json.Unmarshal(rec.Body.Bytes(), &res))
+			want = append(want, pkg.BatchContactResult{Status: rec.Code, Error: res.Message})
+			continue
+		}
+
+		var res pkg.ContactResponse
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), &res))
+		want = append(want, pkg.BatchContactResult{Status: http.StatusOK, Contact: &res.Contact})
+	}
+
+	rec := serve(newTestService(), http.MethodPost, "/identify/batch", "["+strings.Join(bodies, ",")+"]")
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var got pkg.BatchContactResponse
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(want, got.Results)
+	assert.Equal(http.StatusBadRequest, got.Results[2].Status)
+	assert.Equal("incorrect phone number: abc", got.Results[2].Error)
+}
+
+func Test_IdentifyBatch_TooLarge(t *testing.T) {
+	assert := asserts.New(t)
+	items := make([]string, maxBatchSize+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"phoneNumber":"%d"}`, i)
+	}
+
+	rec := serve(newTestService(), http.MethodPost, "/identify/batch", "["+strings.Join(items, ",")+"]")
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	asserts "github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_LockAndListContacts(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+
+	mc := &mockContactStorage{}
+	s := &storage.Store{Contact: mc}
+
+	now := time.Now()
+	later := now.Add(time.Second)
+
+	// The first read sees contact 2 as a primary, but by the time its lock is
+	// acquired it has been merged into contact 1, which must be locked as well.
+	before := []storage.Contact{
+		{ID: 2, Email: "a@gmail.com", LinkPrecedence: primaryContact, CreatedAt: &later},
+	}
+	after := []storage.Contact{
+		{ID: 2, Email: "a@gmail.com", LinkedID: 1, LinkPrecedence: secondaryContact, CreatedAt: &later},
+	}
+
+	mc.On("GetPrimaryContact", int64(1)).Return(&storage.Contact{ID: 1, LinkPrecedence: primaryContact, CreatedAt: &now}, nil)
+	mc.On("AcquireLocks", []string{"email:a@gmail.com"}).Return(nil).Once()
+	mc.On("ListContactsByEmailAndPhoneNumber", "a@gmail.com", "").Return(before, nil).Once()
+	mc.On("AcquireLocks", []string{"contact:2"}).Return(nil).Once()
+	mc.On("ListContactsByEmailAndPhoneNumber", "a@gmail.com", "").Return(after, nil).Once()
+	mc.On("AcquireLocks", []string{"contact:1"}).Return(nil).Once()
+	mc.On("ListContactsByEmailAndPhoneNumber", "a@gmail.com", "").Return(after, nil).Once()
+
+	got, err := lockAndListContacts(ctx, s, pkg.ContactRequest{Email: "a@gmail.com"})
+	assert.Nil(err)
+	assert.Equal(after, got)
+
+	mc.AssertExpectations(t)
+}
+
+func Test_Identify_Concurrent(t *testing.T) {
+	const (
+		identifiers = 8
+		requests    = 400
+		workers     = 16
+	)
+
+	s := newInterleavingService()
+
+	rnd := rand.New(rand.NewSource(1))
+	reqs := make([]pkg.ContactRequest, requests)
+	for i := range reqs {
+		switch rnd.Intn(4) {
+		case 0:
+			reqs[i].Email = fmt.Sprintf("user%d@example.com", rnd.Intn(identifiers))
+		case 1:
+			reqs[i].PhoneNumber = fmt.Sprintf("%d", 1000+rnd.Intn(identifiers))
+		default:
+			reqs[i].Email = fmt.Sprintf("user%d@example.com", rnd.Intn(identifiers))
+			reqs[i].PhoneNumber = fmt.Sprintf("%d", 1000+rnd.Intn(identifiers))
+		}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		next  = make(chan pkg.ContactRequest)
+		codes = make(chan int, requests)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rq := range next {
+				codes <- identifyRequest(s, rq)
+			}
+		}()
+	}
+
+	for _, rq := range reqs {
+		next <- rq
+	}
+	close(next)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		asserts.Equal(t, http.StatusOK, code)
+	}
+
+	assertClustersConsistent(t, s.storage, reqs)
+}
+
+func Test_Identify_ConcurrentMerges(t *testing.T) {
+	const rounds = 20
+	assert := asserts.New(t)
+
+	s := newInterleavingService()
+
+	var reqs []pkg.ContactRequest
+	for r := 0; r < rounds; r++ {
+		email := func(i int) string {
+			return fmt.Sprintf("user%d-%d@example.com", r, i)
+		}
+		phoneNumber := func(i int) string {
+			return fmt.Sprintf("%d%d", 1000+r, i)
+		}
+
+		// Four clusters are created one at a time, then merged together at once by requests
+		// sharing no identifier, so that only the cluster locks serialize them.
+		for i := 0; i < 4; i++ {
+			assert.Equal(http.StatusOK, identifyRequest(s, pkg.ContactRequest{Email: email(i), PhoneNumber: phoneNumber(i)}))
+		}
+
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+		)
+		for i := 0; i < 3; i++ {
+			rq := pkg.ContactRequest{Email: email(i), PhoneNumber: phoneNumber(i + 1)}
+			reqs = append(reqs, rq)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				assert.Equal(http.StatusOK, identifyRequest(s, rq))
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// The first and last clusters ended up together.
+		reqs = append(reqs, pkg.ContactRequest{Email: email(0), PhoneNumber: phoneNumber(3)})
+	}
+
+	assertClustersConsistent(t, s.storage, reqs)
+}
+
+// newInterleavingService returns a service on a memory store, whose transactions run
+// concurrently and take the locks of AcquireLocks as Postgres does. Every contact storage call
+// is followed by a pause for the transactions to interleave, so that requests racing for the
+// same identifiers or clusters would create duplicate contacts or split clusters without the
+// locks of lockAndListContacts.
+func newInterleavingService() *Service {
+	s := newTestService()
+	s.storage.SetObserver(func(context.Context, string) func(int, error) {
+		return func(int, error) {
+			time.Sleep(100 * time.Microsecond)
+		}
+	})
+	return s
+}
+
+// identifyRequest sends rq to the identify route, returning the status of its response.
+func identifyRequest(s *Service, rq pkg.ContactRequest) int {
+	body := fmt.Sprintf(`{"email":%q,"phoneNumber":%q}`, rq.Email, rq.PhoneNumber)
+	return serve(s, http.MethodPost, "/identify", body).Code
+}
+
+func Test_Transactions_Isolated(t *testing.T) {
+	const requests = 16
+	assert := asserts.New(t)
+
+	d := &fakeDriver{}
+	db := sql.OpenDB(d)
+	defer func() {
+		_ = db.Close()
+	}()
+	s := &Service{storage: &storage.Store{Sql: db}, normalizer: pkg.NewNormalizer()}
+
+	// Every request locks its own key once all of them have begun their transaction, so that
+	// the transactions are all in progress at the same time.
+	var begun sync.WaitGroup
+	begun.Add(requests)
+	handler := func(c echo.Context) error {
+		begun.Done()
+		begun.Wait()
+		store := c.Get("store").(*storage.Store)
+		return store.Contact.AcquireLocks(c.Request().Context(), c.QueryParam("key"))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/?key=request:%d", i), nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			c.Set("service", s)
+			assert.Nil(transactionMiddleWare(handler)(c))
+		}(i)
+	}
+	wg.Wait()
+
+	// Each request ran its statement in its own transaction, on its own connection.
+	want := make([][]string, 0, requests)
+	for i := 0; i < requests; i++ {
+		want = append(want, []string{
+			"BEGIN",
+			fmt.Sprintf("SELECT pg_advisory_xact_lock(hashtextextended($1, 0)) [request:%d]", i),
+			"COMMIT",
+		})
+	}
+	assert.ElementsMatch(want, d.statements())
+}
+
+// assertClustersConsistent checks that every identifier belongs to exactly one
+// cluster, that every cluster has exactly one primary, that identifiers seen
+// together in a request ended up in the same cluster, and that no request was
+// applied twice: a contact is only created for an email and phone number pair
+// never seen before.
+func assertClustersConsistent(t *testing.T, s *storage.Store, reqs []pkg.ContactRequest) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+
+	tx, err := s.BeginTx(ctx, &sql.TxOptions{})
+	assert.Nil(err)
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	all, err := tx.Contact.ListContacts(ctx)
+	assert.Nil(err)
+	seen := make(map[[2]string]int64)
+	for _, c := range all {
+		pair := [2]string{c.Email, c.PhoneNumber}
+		if id, ok := seen[pair]; ok {
+			assert.Fail("duplicate contacts", "contacts %d and %d both have email %q and phone number %q", id, c.ID, c.Email, c.PhoneNumber)
+		}
+		seen[pair] = c.ID
+	}
+
+	clusterOf := func(email, phoneNumber string) int64 {
+		contacts, err := tx.Contact.ListContactsByEmailAndPhoneNumber(ctx, email, phoneNumber)
+		assert.Nil(err)
+
+		primaries := make(map[int64]bool)
+		for _, c := range contacts {
+			primaries[primaryIDOf(c)] = true
+		}
+		assert.Equal(1, len(primaries), "identifiers %q %q span %d clusters", email, phoneNumber, len(primaries))
+
+		for id := range primaries {
+			return id
+		}
+		return 0
+	}
+
+	for _, rq := range reqs {
+		id := clusterOf(rq.Email, rq.PhoneNumber)
+
+		cluster, err := tx.Contact.ListContactsByID(ctx, id)
+		assert.Nil(err)
+
+		var primaries int
+		for _, c := range cluster {
+			if c.LinkPrecedence == primaryContact {
+				primaries++
+				assert.Equal(id, c.ID)
+			} else {
+				assert.Equal(id, c.LinkedID)
+			}
+		}
+		assert.Equal(1, primaries, "cluster %d has %d primaries", id, primaries)
+	}
+}
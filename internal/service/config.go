@@ -0,0 +1,295 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/internal/util"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultConfigFile is read when it exists and no other file is given.
+const defaultConfigFile = "resources/config.yaml"
+
+type Config struct {
+	UserName   string `yaml:"user"`
+	Password   string `yaml:"password"`
+	Database   string `yaml:"database"`
+	Host       string `yaml:"host"`
+	ListenAddr string `yaml:"listen_addr"`
+	Storage    string `yaml:"storage"`
+
+	Port            int           `yaml:"port"`
+	SSLMode         string        `yaml:"sslmode"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	IdempotencyTTL  time.Duration `yaml:"idempotency_ttl"`
+
+	EmailNormalizationRules []string `yaml:"email_normalization_rules"`
+	PhoneDefaultRegion      string   `yaml:"phone_default_region"`
+
+	PrimaryPolicy        string   `yaml:"primary_policy"`
+	PrimaryPolicySources []string `yaml:"primary_policy_sources"`
+
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+// NewConfig returns the default configuration.
+func NewConfig() *Config {
+	return &Config{
+		ListenAddr:      ":8080",
+		Storage:         storagePostgres,
+		Port:            5432,
+		SSLMode:         "disable",
+		RequestTimeout:  30 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		IdempotencyTTL:  24 * time.Hour,
+	}
+}
+
+// setting is a configuration value that can be set from the environment variable env, or the
+// command line flag of the same name in lowercase with dashes, e.g. DB_HOST and --db-host.
+type setting struct {
+	env   string
+	value interface{}
+	usage string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"DB_USER", &c.UserName, "database user"},
+		{"DB_PASSWORD", &c.Password, "database password"},
+		{"DB_NAME", &c.Database, "database name"},
+		{"DB_HOST", &c.Host, "database host"},
+		{"DB_PORT", &c.Port, "database port"},
+		{"DB_SSLMODE", &c.SSLMode, "database sslmode: disable, allow, prefer, require, verify-ca or verify-full"},
+		{"DB_CONNECT_TIMEOUT", &c.ConnectTimeout, "timeout of establishing a database connection"},
+		{"DB_MAX_OPEN_CONNS", &c.MaxOpenConns, "maximum number of open database connections, 0 for no limit"},
+		{"DB_MAX_IDLE_CONNS", &c.MaxIdleConns, "maximum number of idle database connections"},
+		{"DB_CONN_MAX_LIFETIME", &c.ConnMaxLifetime, "maximum time a database connection is reused, 0 for no limit"},
+		{"LISTEN_ADDR", &c.ListenAddr, "address the HTTP server listens on"},
+		{"READ_TIMEOUT", &c.ReadTimeout, "timeout of reading an HTTP request, 0 for none"},
+		{"WRITE_TIMEOUT", &c.WriteTimeout, "timeout of writing an HTTP response, 0 for none"},
+		{"REQUEST_TIMEOUT", &c.RequestTimeout, "deadline of handling a request, database work included, 0 for none"},
+		{"SHUTDOWN_DELAY", &c.ShutdownDelay, "time readiness probes fail on shutdown before connections are refused"},
+		{"SHUTDOWN_TIMEOUT", &c.ShutdownTimeout, "time given to requests in flight to finish on shutdown, 0 to wait for all of them"},
+		{"IDEMPOTENCY_TTL", &c.IdempotencyTTL, "time identify responses are kept for repeats of their Idempotency-Key, 0 to ignore the header"},
+		{"STORAGE_BACKEND", &c.Storage, "storage backend: postgres or memory"},
+		{"EMAIL_NORMALIZATION_RULES", &c.EmailNormalizationRules, "comma separated email normalization rules"},
+		{"PHONE_DEFAULT_REGION", &c.PhoneDefaultRegion, "region assumed for phone numbers without a country code"},
+		{"PRIMARY_POLICY", &c.PrimaryPolicy, "policy picking the primary contact on merge"},
+		{"PRIMARY_POLICY_SOURCES", &c.PrimaryPolicySources, "comma separated sources trusted by the sourceTrust policy, most trusted first"},
+		{"OTLP_ENDPOINT", &c.OTLPEndpoint, "base URL of the OTLP/HTTP collector spans are exported to, e.g. http://localhost:4318; tracing is disabled when empty"},
+	}
+}
+
+func (s setting) flagName() string {
+	return strings.ToLower(strings.ReplaceAll(s.env, "_", "-"))
+}
+
+// set parses v into the setting's value.
+func (s setting) set(v string) error {
+	switch p := s.value.(type) {
+	case *string:
+		*p = v
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("incorrect integer: %q", v)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("incorrect duration: %q", v)
+		}
+		*p = d
+	case *[]string:
+		*p = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", s.value))
+	}
+	return nil
+}
+
+// LoadConfig builds the configuration from, in increasing order of precedence, the defaults,
+// a YAML file, the environment and the command line flags in args. The file is given by the
+// --config flag or the CONFIG_FILE environment variable, and defaults to resources/config.yaml
+// when it exists. It returns the arguments left after the flags.
+func LoadConfig(args []string) (*Config, []string, error) {
+	cfg := NewConfig()
+
+	flags := flag.NewFlagSet("bitespeed", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, s := range cfg.settings() {
+		s := s
+		flags.Func(s.flagName(), s.usage, func(v string) error {
+			flagValues = append(flagValues, flagValue{s, v})
+			return nil
+		})
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, fmt.Errorf("invalid command line: %w", err)
+	}
+
+	if err := cfg.loadFile(*configFile); err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range cfg.settings() {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(v); err != nil {
+				return nil, nil, fmt.Errorf("invalid configuration: %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, f := range flagValues {
+		if err := f.setting.set(f.value); err != nil {
+			return nil, nil, fmt.Errorf("invalid configuration: --%s: %w", f.setting.flagName(), err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+// loadFile reads the YAML file at path over the configuration. An empty path reads the default
+// file, if there is one.
+func (c *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Storage {
+	case "", storagePostgres:
+		if c.Host == "" {
+			add("database host is required")
+		}
+		if c.UserName == "" {
+			add("database user is required")
+		}
+		if c.Database == "" {
+			add("database name is required")
+		}
+	case storageMemory:
+	default:
+		add("unknown storage backend: %s", c.Storage)
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("incorrect database port: %d", c.Port)
+	}
+	if !util.Contains(sslModes, c.SSLMode) {
+		add("unknown database sslmode: %s", c.SSLMode)
+	}
+	if c.MaxOpenConns < 0 {
+		add("incorrect maximum of open database connections: %d", c.MaxOpenConns)
+	}
+	if c.MaxIdleConns < 0 {
+		add("incorrect maximum of idle database connections: %d", c.MaxIdleConns)
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"database connect timeout", c.ConnectTimeout},
+		{"database connection max lifetime", c.ConnMaxLifetime},
+		{"read timeout", c.ReadTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"request timeout", c.RequestTimeout},
+		{"shutdown delay", c.ShutdownDelay},
+		{"shutdown timeout", c.ShutdownTimeout},
+		{"idempotency ttl", c.IdempotencyTTL},
+	} {
+		if d.value < 0 {
+			add("incorrect %s: %s", d.name, d.value)
+		}
+	}
+
+	if c.ListenAddr == "" {
+		add("listen address is required")
+	}
+	if c.OTLPEndpoint != "" {
+		if _, err := otlpOptions(c.OTLPEndpoint); err != nil {
+			add("%s", err)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+func (c *Config) postgresConfig() storage.PostgresConfig {
+	return storage.PostgresConfig{
+		User:            c.UserName,
+		Password:        c.Password,
+		Host:            c.Host,
+		Port:            c.Port,
+		Database:        c.Database,
+		SSLMode:         c.SSLMode,
+		ConnectTimeout:  c.ConnectTimeout,
+		MaxOpenConns:    c.MaxOpenConns,
+		MaxIdleConns:    c.MaxIdleConns,
+		ConnMaxLifetime: c.ConnMaxLifetime,
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	asserts "github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	writeFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		cfg, args, err := LoadConfig([]string{"--storage-backend", "memory"})
+		assert.Nil(err)
+		assert.Empty(args)
+
+		want := NewConfig()
+		want.Storage = storageMemory
+		assert.Equal(want, cfg)
+	})
+
+	t.Run("flags override the environment, which overrides the file", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		path := writeFile(t, "host: db\nuser: app\ndatabase: contacts\nport: 6432\nlisten_addr: \":3030\"\nconn_max_lifetime: 30m\nprimary_policy_sources: [pos, web]\n")
+		t.Setenv("DB_PORT", "7432")
+		t.Setenv("LISTEN_ADDR", ":4040")
+		t.Setenv("EMAIL_NORMALIZATION_RULES", "gmail, ")
+
+		cfg, args, err := LoadConfig([]string{"--config", path, "--listen-addr", ":5050", "--read-timeout", "5s", "migrate", "up"})
+		assert.Nil(err)
+		assert.Equal([]string{"migrate", "up"}, args)
+
+		assert.Equal("db", cfg.Host)
+		assert.Equal("app", cfg.UserName)
+		assert.Equal("contacts", cfg.Database)
+		assert.Equal(7432, cfg.Port)
+		assert.Equal(":5050", cfg.ListenAddr)
+		assert.Equal(5*time.Second, cfg.ReadTimeout)
+		assert.Equal(30*time.Minute, cfg.ConnMaxLifetime)
+		assert.Equal([]string{"pos", "web"}, cfg.PrimaryPolicySources)
+		assert.Equal([]string{"gmail"}, cfg.EmailNormalizationRules)
+	})
+
+	t.Run("file from the environment", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		t.Setenv("CONFIG_FILE", writeFile(t, "storage: memory\n"))
+		cfg, _, err := LoadConfig(nil)
+		assert.Nil(err)
+		assert.Equal(storageMemory, cfg.Storage)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, _, err := LoadConfig([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")})
+		asserts.ErrorContains(t, err, "reading configuration file")
+	})
+
+	t.Run("unknown file key", func(t *testing.T) {
+		_, _, err := LoadConfig([]string{"--config", writeFile(t, "storage: memory\nUser: root\n")})
+		asserts.ErrorContains(t, err, "field User not found")
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		_, _, err := LoadConfig([]string{"--db-hots", "db"})
+		asserts.EqualError(t, err, "invalid command line: flag provided but not defined: -db-hots")
+	})
+
+	t.Run("invalid environment", func(t *testing.T) {
+		t.Setenv("READ_TIMEOUT", "soon")
+		_, _, err := LoadConfig([]string{"--storage-backend", "memory"})
+		asserts.EqualError(t, err, `invalid configuration: READ_TIMEOUT: incorrect duration: "soon"`)
+	})
+
+	t.Run("every invalid setting is reported", func(t *testing.T) {
+		_, _, err := LoadConfig([]string{"--db-user", "app", "--db-port", "0", "--db-sslmode", "strict", "--write-timeout", "-1s", "--otlp-endpoint", "localhost:4318"})
+		asserts.EqualError(t, err, "invalid configuration: database host is required; database name is required; "+
+			"incorrect database port: 0; unknown database sslmode: strict; incorrect write timeout: -1s; incorrect OTLP endpoint: localhost:4318")
+	})
+}
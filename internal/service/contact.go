@@ -1,11 +1,17 @@
 package service
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/harshabangi/bitespeed/internal/storage"
 	"github.com/harshabangi/bitespeed/internal/util"
 	"github.com/harshabangi/bitespeed/pkg"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"sort"
+	"strconv"
 )
 
 const (
@@ -18,196 +24,821 @@ const (
 // @Description get the contact links of server.
 // @Tags root
 // @Param contact body pkg.ContactRequest true "Contact Request Body"
+// @Param expand query string false "Set to contacts to include every contact of the cluster" Enums(contacts)
+// @Param Idempotency-Key header string false "Key answering repeats of the request with the response of the first one, without applying them again"
 // @Accept json
 // @Produce json
 // @Success 200 {object} pkg.ContactResponse
 // @Failure 400
+// @Failure 422
 // @Failure 500
 // @Router /identify [post]
 // @Consumes application/json
 func identify(c echo.Context) error {
 	s := c.Get("service").(*Service)
+	ctx := c.Request().Context()
 
+	req, err := bindContactRequest(c, s)
+	if err != nil {
+		return err
+	}
+
+	expand := expandRequested(c)
+	idem, err := requestIdempotency(c, s, req, expand)
+	if err != nil {
+		return err
+	}
+
+	res, replayed, err := identifyInTransaction(ctx, s, req, expand, idem)
+	if err != nil {
+		if errors.Is(err, errIdempotencyKeyReused) {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if replayed {
+		c.Response().Header().Set(idempotentReplayedHeader, "true")
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// identifyInTransaction identifies a validated request in a transaction of its own, run again
+// when it fails because of concurrent transactions. With expand, the response lists every contact
+// of the cluster. With an idempotency key, the response is stored along with the changes, and
+// the response stored for a repeated key is returned instead, telling it was replayed.
+func identifyInTransaction(ctx context.Context, s *Service, req pkg.ContactRequest, expand bool, idem *idempotency) (*pkg.ContactResponse, bool, error) {
+	var (
+		res      *pkg.ContactResponse
+		outcome  string
+		replayed bool
+	)
+	err := s.retryTransaction(ctx, writeTxOptions, func(ctx context.Context, store *storage.Store) error {
+		if idem != nil {
+			stored, err := idem.replay(ctx, s, store)
+			if err != nil {
+				return err
+			}
+			if stored != nil {
+				res, replayed = stored, true
+				return nil
+			}
+		}
+
+		var err error
+		res, outcome, err = identifyContact(ctx, store, s.policy, req)
+		if err != nil {
+			return err
+		}
+		if expand {
+			if err := expandContactResponse(ctx, store, res); err != nil {
+				return err
+			}
+		}
+		if idem != nil {
+			return idem.save(ctx, s, store, res)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !replayed {
+		s.metrics.observeIdentify(outcome)
+	}
+	return res, replayed, nil
+}
+
+// identifyContact links a validated request to the stored contacts and returns the consolidated contact,
+// along with the outcome of the request, one of the pkg.Outcome* constants. When clusters are merged,
+// policy picks the one keeping its primary contact. The linkage is recorded on the span of ctx.
+func identifyContact(ctx context.Context, s *storage.Store, policy PrimaryPolicy, req pkg.ContactRequest) (*pkg.ContactResponse, string, error) {
+	contacts, err := lockAndListContacts(ctx, s, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	l, err := planLinkage(ctx, s, policy, req, contacts)
+	if err != nil {
+		return nil, "", err
+	}
+	traceLinkage(ctx, contacts, l)
+
+	res, err := applyLinkage(ctx, s, req, l)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, l.outcome, nil
+}
+
+// lookup godoc
+// @Summary Show the contacts links without changing them.
+// @Description get the contact links identify would return, and the change it would make, without writing anything.
+// @Tags root
+// @Param contact body pkg.ContactRequest true "Contact Request Body"
+// @Accept json
+// @Produce json
+// @Success 200 {object} pkg.LookupResponse
+// @Failure 400
+// @Failure 500
+// @Router /identify/lookup [post]
+// @Consumes application/json
+func lookup(c echo.Context) error {
+	s := c.Get("service").(*Service)
+	store := c.Get("store").(*storage.Store)
+	ctx := c.Request().Context()
+
+	req, err := bindContactRequest(c, s)
+	if err != nil {
+		return err
+	}
+
+	contacts, err := listContacts(ctx, store, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if _, err := resolveChains(ctx, store, contacts); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	l, err := planLinkage(ctx, store, s.policy, req, contacts)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	traceLinkage(ctx, contacts, l)
+
+	res, err := previewLinkage(ctx, store, req, l)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &pkg.LookupResponse{
+		Contact: res.Contact,
+		Outcome: l.outcome,
+	})
+}
+
+func bindContactRequest(c echo.Context, s *Service) (pkg.ContactRequest, error) {
 	var req pkg.ContactRequest
 	if err := c.Bind(&req); err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return req, prepareContactRequest(s, &req)
+}
+
+// prepareContactRequest normalizes and validates a request.
+func prepareContactRequest(s *Service, req *pkg.ContactRequest) error {
+	if err := s.normalizer.Normalize(req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	if err := req.Validate(); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	return nil
+}
+
+// lockAndListContacts returns the contacts matching the request's email or phone number
+// while serializing it against any other request touching the same identifiers or clusters.
+//
+// The identifiers are locked first so that two requests for an unknown identifier cannot
+// both create a primary contact. Then the primary of every matched cluster is locked; since
+// a cluster may have been merged into another one while waiting, the contacts are re-read
+// until every cluster they belong to is locked. Every write to a cluster happens with its
+// primary locked, so the returned contacts stay valid until the transaction ends.
+//
+// Clusters found to contain chains of secondary contacts are flattened once locked.
+func lockAndListContacts(ctx context.Context, s *storage.Store, req pkg.ContactRequest) ([]storage.Contact, error) {
+	if err := s.Contact.AcquireLocks(ctx, identifierLockKeys(req.AllIdentifiers())...); err != nil {
+		return nil, err
+	}
+
+	locked := make(map[int64]bool)
+
+	for {
+		contacts, err := listContacts(ctx, s, req)
+		if err != nil {
+			return nil, err
+		}
+
+		chained, err := resolveChains(ctx, s, contacts)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		for _, c := range contacts {
+			id := primaryIDOf(c)
+			if !locked[id] {
+				locked[id] = true
+				keys = append(keys, contactLockKey(id))
+			}
+		}
+
+		if len(keys) == 0 {
+			if chained {
+				if err := flattenClusters(ctx, s, contacts); err != nil {
+					return nil, err
+				}
+			}
+			return contacts, nil
+		}
+		if err := s.Contact.AcquireLocks(ctx, keys...); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resolveChains points every secondary contact at the primary contact of its cluster. Secondary
+// contacts should be linked directly to their primary, but legacy data or a partial failure may
+// have left chains of them; chained reports whether any was found.
+func resolveChains(ctx context.Context, s *storage.Store, contacts []storage.Contact) (bool, error) {
+	primaries := make(map[int64]int64)
+	for _, c := range contacts {
+		if c.LinkPrecedence == primaryContact {
+			primaries[c.ID] = c.ID
+		}
+	}
+
+	var chained bool
+	for i, c := range contacts {
+		if c.LinkPrecedence == primaryContact {
+			continue
+		}
+
+		primaryID, ok := primaries[c.LinkedID]
+		if !ok {
+			p, err := s.Contact.GetPrimaryContact(ctx, c.LinkedID)
+			if err != nil {
+				return false, fmt.Errorf("resolving primary contact of contact %d: %w", c.ID, err)
+			}
+			primaryID = p.ID
+			primaries[c.LinkedID] = primaryID
+		}
+
+		if primaryID != c.LinkedID {
+			contacts[i].LinkedID = primaryID
+			chained = true
+		}
+	}
+	return chained, nil
+}
+
+// flattenClusters flattens the clusters of the given resolved contacts.
+func flattenClusters(ctx context.Context, s *storage.Store, contacts []storage.Contact) error {
+	flattened := make(map[int64]bool)
+	for _, c := range contacts {
+		id := primaryIDOf(c)
+		if flattened[id] {
+			continue
+		}
+		flattened[id] = true
+
+		if _, err := s.Contact.FlattenCluster(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listContacts returns the contacts sharing any identifier with the request.
+func listContacts(ctx context.Context, s *storage.Store, req pkg.ContactRequest) ([]storage.Contact, error) {
+	var contacts []storage.Contact
+	if req.Email != "" || req.PhoneNumber != "" {
+		var err error
+		contacts, err = s.Contact.ListContactsByEmailAndPhoneNumber(ctx, req.Email, req.PhoneNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(req.Identifiers) == 0 {
+		return contacts, nil
+	}
 
-	contacts, err := s.storage.Contact.ListContactsByEmailAndPhoneNumber(req.Email, req.PhoneNumber)
+	others, err := s.Contact.ListContactsByIdentifiers(ctx, toIdentifiers(req.Identifiers))
 	if err != nil {
+		return nil, err
+	}
+
+	listed := make(map[int64]bool, len(contacts))
+	for _, c := range contacts {
+		listed[c.ID] = true
+	}
+	for _, c := range others {
+		if !listed[c.ID] {
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts, nil
+}
+
+func identifierLockKeys(identifiers []pkg.Identifier) []string {
+	var keys []string
+	for _, id := range identifiers {
+		switch id.Type {
+		case pkg.IdentifierEmail:
+			keys = append(keys, "email:"+id.Value)
+		case pkg.IdentifierPhoneNumber:
+			keys = append(keys, "phone:"+id.Value)
+		default:
+			keys = append(keys, "identifier:"+id.Type+":"+id.Value)
+		}
+	}
+	return keys
+}
+
+func contactLockKey(id int64) string {
+	return fmt.Sprintf("contact:%d", id)
+}
+
+// getContact godoc
+// @Summary Show the consolidated contact.
+// @Description get the consolidated contact of the cluster the given contact belongs to.
+// @Tags root
+// @Param id path int true "Contact ID"
+// @Param expand query string false "Set to contacts to include every contact of the cluster" Enums(contacts)
+// @Produce json
+// @Success 200 {object} pkg.ContactResponse
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /contacts/{id} [get]
+func getContact(c echo.Context) error {
+	store := c.Get("store").(*storage.Store)
+	ctx := c.Request().Context()
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("incorrect contact id: %s", c.Param("id")))
+	}
+
+	primary, err := store.Contact.GetPrimaryContact(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("contact %d not found", id))
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	// If either email or phoneNumber or both are not present in any connected component
-	// create a new contact and add it as a primary contact.
-	if len(contacts) == 0 {
-		return createContactAndReturnResponse(c, s, req)
+	res, err := getContactResponse(ctx, store, primary.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	// If either email or phoneNumber is present in the request body
-	if req.Email == "" || req.PhoneNumber == "" {
-		res, err := getContactResponse(s.storage, getPrimaryContactID(contacts))
-		if err != nil {
+	if expandRequested(c) {
+		if err := expandContactResponse(ctx, store, res); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
-		return c.JSON(http.StatusOK, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func expandRequested(c echo.Context) bool {
+	return c.QueryParam("expand") == "contacts"
+}
+
+// expandContactResponse adds every contact of the cluster to the response, along with the
+// latest time any of them changed, so that clients can pull changes incrementally.
+func expandContactResponse(ctx context.Context, s *storage.Store, res *pkg.ContactResponse) error {
+	contacts, err := s.Contact.ListContactsByID(ctx, res.Contact.PrimaryContactID)
+	if err != nil {
+		return err
+	}
+
+	res.Contact.Contacts = make([]pkg.ContactDetail, 0, len(contacts))
+	for _, c := range contacts {
+		d := pkg.ContactDetail{
+			ID:             c.ID,
+			Email:          c.Email,
+			PhoneNumber:    c.PhoneNumber,
+			LinkedID:       c.LinkedID,
+			LinkPrecedence: c.LinkPrecedence,
+		}
+		if c.CreatedAt != nil {
+			d.CreatedAt = *c.CreatedAt
+		}
+		if c.UpdatedAt != nil {
+			d.UpdatedAt = *c.UpdatedAt
+		}
+		res.Contact.Contacts = append(res.Contact.Contacts, d)
+
+		if res.Contact.UpdatedAt == nil || d.UpdatedAt.After(*res.Contact.UpdatedAt) {
+			updatedAt := d.UpdatedAt
+			res.Contact.UpdatedAt = &updatedAt
+		}
+	}
+	return nil
+}
+
+// deleteContact godoc
+// @Summary Delete a contact.
+// @Description soft delete a contact. When it is the primary contact of its cluster, the oldest remaining contact becomes the primary.
+// @Tags root
+// @Param id path int true "Contact ID"
+// @Success 204
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /contacts/{id} [delete]
+func deleteContact(c echo.Context) error {
+	store := c.Get("store").(*storage.Store)
+	ctx := c.Request().Context()
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("incorrect contact id: %s", c.Param("id")))
+	}
+
+	primaryID, err := lockCluster(ctx, store, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("contact %d not found", id))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	// If both email and phoneNumber is present in the request body
-	resp, err := handleContactLinkage(s.storage, req, contacts)
+	primaryID, err = softDeleteContact(ctx, store, id, primaryID)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, resp)
+	if err := recordEvent(ctx, store, pkg.EventDeleted, id, primaryID, "", "", nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// softDeleteContact deletes a contact of the cluster of primaryID. When the primary itself is
+// deleted, the oldest remaining contact of the cluster takes its place. It returns the primary
+// of the cluster afterwards, or zero if the cluster is now empty.
+//
+// Deleted contacts are hidden from reads, so the primary is touched to move the updatedAt of
+// the cluster forward, as a promotion does when the primary is deleted.
+func softDeleteContact(ctx context.Context, s *storage.Store, id, primaryID int64) (int64, error) {
+	if err := s.Contact.DeleteContact(ctx, id); err != nil {
+		return 0, err
+	}
+
+	if id != primaryID {
+		if err := s.Contact.UpdateContact(ctx, primaryID, storage.Contact{}); err != nil {
+			return 0, err
+		}
+		return primaryID, nil
+	}
+
+	remaining, err := s.Contact.ListContactsByID(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(remaining) == 0 {
+		return 0, nil
+	}
+
+	newPrimary := remaining[0]
+	if err := s.Contact.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx, newPrimary.ID, id); err != nil {
+		return 0, err
+	}
+	if err := s.Contact.PromoteContact(ctx, newPrimary.ID); err != nil {
+		return 0, err
+	}
+	return newPrimary.ID, nil
 }
 
 func toContact(rq pkg.ContactRequest) storage.Contact {
 	return storage.Contact{
-		PhoneNumber: rq.PhoneNumber,
-		Email:       rq.Email,
+		PhoneNumber:    rq.PhoneNumber,
+		Email:          rq.Email,
+		RawPhoneNumber: rq.RawPhoneNumber,
+		RawEmail:       rq.RawEmail,
+		EmailVerified:  rq.EmailVerified,
+		Source:         rq.Source,
+		Identifiers:    toIdentifiers(rq.Identifiers),
 	}
 }
 
-func createContactAndReturnResponse(c echo.Context, s *Service, req pkg.ContactRequest) error {
-	contact := toContact(req)
-	contact.LinkPrecedence = primaryContact
-
-	id, err := s.storage.Contact.CreateContact(contact)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError)
+func toIdentifiers(identifiers []pkg.Identifier) []storage.Identifier {
+	var result []storage.Identifier
+	for _, id := range identifiers {
+		result = append(result, storage.Identifier{Type: id.Type, Value: id.Value})
 	}
+	return result
+}
 
-	res := pkg.NewContactResponse().WithID(id)
+func fromIdentifiers(identifiers []storage.Identifier) []pkg.Identifier {
+	var result []pkg.Identifier
+	for _, id := range identifiers {
+		result = append(result, pkg.Identifier{Type: id.Type, Value: id.Value})
+	}
+	return result
+}
 
-	if contact.Email != "" {
-		res.Contact.Emails = []string{contact.Email}
+// contactIdentifiers returns every identifier of a contact, its email and phone number included.
+func contactIdentifiers(c storage.Contact) []pkg.Identifier {
+	var result []pkg.Identifier
+	if c.Email != "" {
+		result = append(result, pkg.Identifier{Type: pkg.IdentifierEmail, Value: c.Email})
 	}
-	if contact.PhoneNumber != "" {
-		res.Contact.PhoneNumbers = []string{contact.PhoneNumber}
+	if c.PhoneNumber != "" {
+		result = append(result, pkg.Identifier{Type: pkg.IdentifierPhoneNumber, Value: c.PhoneNumber})
+	}
+	for _, id := range c.Identifiers {
+		result = append(result, pkg.Identifier{Type: id.Type, Value: id.Value})
 	}
-	return c.JSON(http.StatusOK, &res)
+	return result
+}
+
+// linkage is the change an identify request makes to the contacts.
+type linkage struct {
+	// outcome is one of the pkg.Outcome* constants.
+	outcome string
+
+	// primaryID is the primary contact of the cluster the request ends up in.
+	// It is unset when a new primary contact is created.
+	primaryID int64
+
+	// primary and merged are the primary contacts of the clusters being merged:
+	// the one staying primary, and the others, as ranked by the primary policy.
+	primary *storage.Contact
+	merged  []*storage.Contact
+
+	// secondary is set when the request is added to the cluster as a new secondary
+	// contact, because some of its identifiers are new to it.
+	secondary bool
 }
 
-func handleContactLinkage(s *storage.Store, req pkg.ContactRequest, contacts []storage.Contact) (*pkg.ContactResponse, error) {
+func planLinkage(ctx context.Context, s *storage.Store, policy PrimaryPolicy, req pkg.ContactRequest, contacts []storage.Contact) (*linkage, error) {
+	// If none of the identifiers is present in any connected component
+	// create a new contact and add it as a primary contact.
+	if len(contacts) == 0 {
+		return &linkage{outcome: pkg.OutcomeNewPrimary}, nil
+	}
+
+	// If a single identifier is present in the request body
+	if len(req.AllIdentifiers()) == 1 {
+		return &linkage{outcome: pkg.OutcomeExisting, primaryID: getPrimaryContactID(contacts)}, nil
+	}
 
-	var contact1, contact2 *storage.Contact
+	// If several identifiers are present in the request body
+	return handleContactLinkage(ctx, s, policy, req, contacts)
+}
 
-	for i := 0; i < len(contacts); i++ {
-		if req.Email == contacts[i].Email {
-			contact1 = &contacts[i]
+func applyLinkage(ctx context.Context, s *storage.Store, req pkg.ContactRequest, l *linkage) (*pkg.ContactResponse, error) {
+	if l.outcome == pkg.OutcomeNewPrimary {
+		return createContactAndReturnResponse(ctx, s, req)
+	}
+
+	for _, merged := range l.merged {
+		if err := recordMerge(ctx, s, req, l.primary, merged); err != nil {
+			return nil, err
 		}
-		if req.PhoneNumber == contacts[i].PhoneNumber {
-			contact2 = &contacts[i]
+		if err := recordEvent(ctx, s, pkg.EventMerged, merged.ID, l.primary.ID, req.Email, req.PhoneNumber, req.Identifiers); err != nil {
+			return nil, err
+		}
+		if err := linkPrimaryContacts(ctx, s, l.primary, merged); err != nil {
+			return nil, err
 		}
 	}
 
-	// If only one of email and phone number is new.
-	// In that case we will have either email and phone number node in only one connected component.
-	// So create a new contact and derive primary contact id to add it as a linked id for new contact
-
-	if contact1 == nil || contact2 == nil {
-		primaryContactID := getPrimaryContactID(contacts)
+	if l.secondary {
 		c := toContact(req)
-		c.LinkedID = primaryContactID
+		c.LinkedID = l.primaryID
 		c.LinkPrecedence = secondaryContact
-		if _, err := s.Contact.CreateContact(c); err != nil {
+		id, err := s.Contact.CreateContact(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := recordEvent(ctx, s, pkg.EventLinked, id, l.primaryID, req.Email, req.PhoneNumber, req.Identifiers); err != nil {
 			return nil, err
 		}
-		return getContactResponse(s, primaryContactID)
 	}
 
-	// If both email and phone number are not new and can be present
-	// in either the same connected component or different connected components
-	switch {
-	case contact1.LinkPrecedence == primaryContact && contact2.LinkPrecedence == primaryContact:
-		if contact1.ID == contact2.ID { // same connected component
-			return getContactResponse(s, contact1.ID)
-		}
-		// different connected component
-		return linkPrimaryContactsAndGenerateResponse(s, contact1, contact2)
+	return getContactResponse(ctx, s, l.primaryID)
+}
 
-	case contact1.LinkPrecedence == primaryContact && contact2.LinkPrecedence == secondaryContact:
-		if contact1.ID == contact2.LinkedID { // same connected component
-			return getContactResponse(s, contact1.ID)
-		}
-		// different connected component
-		c, err := s.Contact.GetContact(contact2.LinkedID)
+// recordMerge remembers the members of the merged cluster right before it is merged,
+// so that unmerge can split it off again exactly.
+func recordMerge(ctx context.Context, s *storage.Store, req pkg.ContactRequest, kept, merged *storage.Contact) error {
+	members, err := s.Contact.ListContactsByID(ctx, merged.ID)
+	if err != nil {
+		return err
+	}
+
+	memberIDs := make([]int64, 0, len(members))
+	for _, c := range members {
+		memberIDs = append(memberIDs, c.ID)
+	}
+
+	_, err = s.Merge.CreateMerge(ctx, storage.Merge{
+		PrimaryID:   kept.ID,
+		MergedID:    merged.ID,
+		MemberIDs:   memberIDs,
+		PhoneNumber: req.PhoneNumber,
+		Email:       req.Email,
+		Identifiers: toIdentifiers(req.Identifiers),
+	})
+	return err
+}
+
+// previewLinkage returns the response applyLinkage would return for l without writing anything.
+// Contacts that would be created have no ID yet, so they are left out of the contact IDs.
+func previewLinkage(ctx context.Context, s *storage.Store, req pkg.ContactRequest, l *linkage) (*pkg.ContactResponse, error) {
+	if l.outcome == pkg.OutcomeNewPrimary {
+		return newContactResponse(0, toContact(req)), nil
+	}
+
+	contacts, err := s.Contact.ListContactsByID(ctx, l.primaryID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, merged := range l.merged {
+		mergedContacts, err := s.Contact.ListContactsByID(ctx, merged.ID)
 		if err != nil {
 			return nil, err
 		}
-		return linkPrimaryContactsAndGenerateResponse(s, contact1, c)
+		for _, c := range mergedContacts {
+			if c.ID == merged.ID {
+				c.LinkedID = l.primaryID
+				c.LinkPrecedence = secondaryContact
+			}
+			contacts = append(contacts, c)
+		}
+	}
+	if len(l.merged) > 0 {
+		sort.SliceStable(contacts, func(i, j int) bool {
+			return contacts[i].CreatedAt.Before(*contacts[j].CreatedAt)
+		})
+	}
 
-	case contact1.LinkPrecedence == secondaryContact && contact2.LinkPrecedence == primaryContact:
-		if contact2.ID == contact1.LinkedID { // same connected component
-			return getContactResponse(s, contact2.ID)
+	res := generateContactResponseFromContacts(contacts)
+	if l.secondary {
+		c := toContact(req)
+		c.LinkPrecedence = secondaryContact
+		if c.Email != "" && !util.Contains(res.Contact.Emails, c.Email) {
+			addEmail(c, res)
 		}
-		// different connected component
-		c, err := s.Contact.GetContact(contact1.LinkedID)
-		if err != nil {
-			return nil, err
+		if c.PhoneNumber != "" && !util.Contains(res.Contact.PhoneNumbers, c.PhoneNumber) {
+			addPhoneNumber(c, res)
 		}
-		return linkPrimaryContactsAndGenerateResponse(s, contact2, c)
+		for _, id := range c.Identifiers {
+			addIdentifier(c, id, res)
+		}
+	}
+	return res, nil
+}
+
+func createContactAndReturnResponse(ctx context.Context, s *storage.Store, req pkg.ContactRequest) (*pkg.ContactResponse, error) {
+	contact := toContact(req)
+	contact.LinkPrecedence = primaryContact
+
+	id, err := s.Contact.CreateContact(ctx, contact)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordEvent(ctx, s, pkg.EventCreated, id, id, req.Email, req.PhoneNumber, req.Identifiers); err != nil {
+		return nil, err
+	}
+	return newContactResponse(id, contact), nil
+}
+
+// recordEvent appends to the history of a contact, in the same transaction as the change itself.
+func recordEvent(ctx context.Context, s *storage.Store, eventType string, contactID, primaryID int64, email, phoneNumber string, identifiers []pkg.Identifier) error {
+	_, err := s.Event.CreateEvent(ctx, storage.Event{
+		ContactID:   contactID,
+		Type:        eventType,
+		PrimaryID:   primaryID,
+		PhoneNumber: phoneNumber,
+		Email:       email,
+		Identifiers: toIdentifiers(identifiers),
+	})
+	return err
+}
+
+func newContactResponse(id int64, contact storage.Contact) *pkg.ContactResponse {
+	res := pkg.NewContactResponse().WithID(id)
 
-	case contact1.LinkPrecedence == secondaryContact && contact2.LinkPrecedence == secondaryContact:
-		if contact1.LinkedID == contact2.LinkedID { // same connected component
-			return getContactResponse(s, contact1.LinkedID)
+	if contact.Email != "" {
+		res.Contact.Emails = []string{contact.Email}
+	}
+	if contact.PhoneNumber != "" {
+		res.Contact.PhoneNumbers = []string{contact.PhoneNumber}
+	}
+	for _, id := range contact.Identifiers {
+		addIdentifier(contact, id, res)
+	}
+	return res
+}
+
+// handleContactLinkage links a request with several identifiers to the contacts sharing any of them.
+// Identifiers present in different connected components merge them into one, and identifiers present
+// in none are added to it with a new secondary contact.
+func handleContactLinkage(ctx context.Context, s *storage.Store, policy PrimaryPolicy, req pkg.ContactRequest, contacts []storage.Contact) (*linkage, error) {
+	var (
+		known      = make(map[pkg.Identifier]bool)
+		primaryIDs []int64
+		seen       = make(map[int64]bool)
+	)
+
+	for _, c := range contacts {
+		for _, id := range contactIdentifiers(c) {
+			known[id] = true
 		}
-		// different connected component
-		c1, err := s.Contact.GetContact(contact1.LinkedID)
-		if err != nil {
-			return nil, err
+
+		if id := primaryIDOf(c); !seen[id] {
+			seen[id] = true
+			primaryIDs = append(primaryIDs, id)
+		}
+	}
+
+	var secondary bool
+	for _, id := range req.AllIdentifiers() {
+		if !known[id] {
+			secondary = true
+		}
+	}
+
+	// If the known identifiers are all in the same connected component, the new ones,
+	// if any, are added to it with a new secondary contact.
+	if len(primaryIDs) == 1 {
+		if secondary {
+			return &linkage{outcome: pkg.OutcomeNewSecondary, primaryID: primaryIDs[0], secondary: true}, nil
 		}
-		c2, err := s.Contact.GetContact(contact2.LinkedID)
+		return &linkage{outcome: pkg.OutcomeExisting, primaryID: primaryIDs[0]}, nil
+	}
+
+	// If they are in different connected components, these are merged into one.
+	clusters := make([]Cluster, 0, len(primaryIDs))
+	for _, id := range primaryIDs {
+		c, err := getCluster(ctx, s, id)
 		if err != nil {
 			return nil, err
 		}
-		return linkPrimaryContactsAndGenerateResponse(s, c1, c2)
-
+		clusters = append(clusters, c)
 	}
 
-	// shouldn't reach here
-	return nil, nil
+	l := mergeLinkage(policy, clusters)
+	l.secondary = secondary
+	return l, nil
 }
 
-func linkPrimaryContactsAndGenerateResponse(s *storage.Store, primaryContact1, primaryContact2 *storage.Contact) (*pkg.ContactResponse, error) {
-	var olderContact, newerContact storage.Contact
-
-	if primaryContact1.CreatedAt.Sub(*primaryContact2.CreatedAt).Seconds() > 0 {
-		newerContact = *primaryContact1
-		olderContact = *primaryContact2
-	} else {
-		newerContact = *primaryContact2
-		olderContact = *primaryContact1
+// getCluster reads the cluster of the primary contact id.
+func getCluster(ctx context.Context, s *storage.Store, id int64) (Cluster, error) {
+	contacts, err := s.Contact.ListContactsByID(ctx, id)
+	if err != nil {
+		return Cluster{}, err
+	}
+	for i, c := range contacts {
+		if c.ID == id {
+			return Cluster{Primary: &contacts[i], Contacts: contacts}, nil
+		}
 	}
+	return Cluster{}, fmt.Errorf("reading cluster of contact %d: %w", id, sql.ErrNoRows)
+}
 
-	if err := s.Contact.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(olderContact.ID, newerContact.ID); err != nil {
-		return nil, err
+// mergeLinkage merges the given clusters into the one policy prefers, the others following in
+// the order policy ranks them.
+func mergeLinkage(policy PrimaryPolicy, clusters []Cluster) *linkage {
+	sorted := append([]Cluster(nil), clusters...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return preferCluster(policy, sorted[i], sorted[j])
+	})
+
+	l := &linkage{outcome: pkg.OutcomeMerge, primaryID: sorted[0].Primary.ID, primary: sorted[0].Primary}
+	for _, c := range sorted[1:] {
+		l.merged = append(l.merged, c.Primary)
 	}
+	return l
+}
 
-	if err := s.Contact.UpdateContact(newerContact.ID, storage.Contact{
-		LinkedID:       olderContact.ID,
-		LinkPrecedence: secondaryContact,
-	}); err != nil {
-		return nil, err
+// linkPrimaryContacts links the merged primary contact and its cluster to the primary contact kept.
+func linkPrimaryContacts(ctx context.Context, s *storage.Store, kept, merged *storage.Contact) error {
+	if err := s.Contact.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx, kept.ID, merged.ID); err != nil {
+		return err
 	}
 
-	return getContactResponse(s, olderContact.ID)
+	return s.Contact.UpdateContact(ctx, merged.ID, storage.Contact{
+		LinkedID:       kept.ID,
+		LinkPrecedence: secondaryContact,
+	})
 }
 
 func getPrimaryContactID(contacts []storage.Contact) int64 {
-	if contacts[0].LinkPrecedence == primaryContact {
-		return contacts[0].ID
+	return primaryIDOf(contacts[0])
+}
+
+func primaryIDOf(c storage.Contact) int64 {
+	if c.LinkPrecedence == primaryContact {
+		return c.ID
 	}
-	return contacts[0].LinkedID
+	return c.LinkedID
 }
 
-func getContactResponse(s *storage.Store, primaryContactID int64) (*pkg.ContactResponse, error) {
-	allContacts, err := s.Contact.ListContactsByID(primaryContactID)
+func getContactResponse(ctx context.Context, s *storage.Store, primaryContactID int64) (*pkg.ContactResponse, error) {
+	allContacts, err := s.Contact.ListContactsByID(ctx, primaryContactID)
 	if err != nil {
 		return nil, err
 	}
@@ -239,6 +870,10 @@ func generateContactResponseFromContacts(contacts []storage.Contact) *pkg.Contac
 			addPhoneNumber(c, response)
 			phoneNumbersMap[c.PhoneNumber] = util.VoidValue
 		}
+
+		for _, id := range c.Identifiers {
+			addIdentifier(c, id, response)
+		}
 	}
 	return response
 }
@@ -258,3 +893,20 @@ func addPhoneNumber(c storage.Contact, response *pkg.ContactResponse) {
 		response.Contact.PhoneNumbers = append(response.Contact.PhoneNumbers, c.PhoneNumber)
 	}
 }
+
+// addIdentifier adds an identifier of the contact to the values of its type, unless already there.
+func addIdentifier(c storage.Contact, id storage.Identifier, response *pkg.ContactResponse) {
+	values := response.Contact.Identifiers[id.Type]
+	if util.Contains(values, id.Value) {
+		return
+	}
+
+	if response.Contact.Identifiers == nil {
+		response.Contact.Identifiers = make(map[string][]string)
+	}
+	if c.LinkPrecedence == primaryContact {
+		response.Contact.Identifiers[id.Type] = append([]string{id.Value}, values...)
+	} else {
+		response.Contact.Identifiers[id.Type] = append(values, id.Value)
+	}
+}
@@ -1,23 +1,27 @@
 package service
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/harshabangi/bitespeed/internal/storage"
 	"github.com/harshabangi/bitespeed/pkg"
 	"github.com/labstack/echo/v4"
 	asserts "github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 	"time"
 )
 
-func testService(ms *mockContactStorage) *Service {
+func testService(ms *mockContactStorage, me *mockEventStorage) *Service {
 	return &Service{
 		storage: &storage.Store{
 			Contact: ms,
+			Event:   me,
 		},
+		normalizer: pkg.NewNormalizer(),
 	}
 }
 
@@ -78,43 +82,41 @@ func Test_Identify(t *testing.T) {
 		assert := asserts.New(t)
 
 		mc := &mockContactStorage{}
-		s := testService(mc)
+		me := &mockEventStorage{}
+		s := testService(mc, me)
 
-		rqBody := `{"phoneNumber":"12345","email":"a@gmail.com"}`
-		req := httptest.NewRequest(http.MethodPost, "/identify", strings.NewReader(rqBody))
-		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-		rec := httptest.NewRecorder()
-
-		c := echo.New().NewContext(req, rec)
-		c.Set("service", s)
+		req := pkg.ContactRequest{PhoneNumber: "12345", Email: "a@gmail.com"}
+		assert.Nil(prepareContactRequest(s, &req))
 
+		mc.On("AcquireLocks", []string{"email:a@gmail.com", "phone:12345"}).Return(nil)
 		mc.On("ListContactsByEmailAndPhoneNumber", "a@gmail.com", "12345").Return(([]storage.Contact)(nil), nil)
-		mc.On("CreateContact", storage.Contact{Email: "a@gmail.com", PhoneNumber: "12345", LinkPrecedence: primaryContact}).Return(int64(2), nil)
+		mc.On("CreateContact", storage.Contact{Email: "a@gmail.com", PhoneNumber: "12345", RawEmail: "a@gmail.com", RawPhoneNumber: "12345", LinkPrecedence: primaryContact}).Return(int64(2), nil)
+		me.On("CreateEvent", storage.Event{ContactID: 2, Type: pkg.EventCreated, PrimaryID: 2, Email: "a@gmail.com", PhoneNumber: "12345"}).Return(int64(1), nil)
 
-		err := identify(c)
+		res, _, err := identifyContact(context.Background(), s.storage, s.policy, req)
 		assert.Nil(err)
-		assert.Equal(`{"contact":{"primaryContactId":2,"emails":["a@gmail.com"],"phoneNumbers":["12345"],"secondaryContactIds":[]}}`, strings.Trim(rec.Body.String(), "\n"))
+		got, _ := json.Marshal(res)
+		assert.Equal(`{"contact":{"primaryContactId":2,"emails":["a@gmail.com"],"phoneNumbers":["12345"],"secondaryContactIds":[]}}`, string(got))
 
 		mc.AssertExpectations(t)
+		me.AssertExpectations(t)
 	})
 
 	t.Run("only email is present in the request body", func(t *testing.T) {
 		assert := asserts.New(t)
 
 		mc := &mockContactStorage{}
-		s := testService(mc)
-
-		rqBody := `{"email":"a@gmail.com"}`
-		req := httptest.NewRequest(http.MethodPost, "/identify", strings.NewReader(rqBody))
-		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-		rec := httptest.NewRecorder()
+		me := &mockEventStorage{}
+		s := testService(mc, me)
 
-		c := echo.New().NewContext(req, rec)
-		c.Set("service", s)
+		req := pkg.ContactRequest{Email: "a@gmail.com"}
+		assert.Nil(prepareContactRequest(s, &req))
 
 		now := time.Now()
 		timestamps := []time.Time{now, now.Add(3 * time.Second), now.Add(5 * time.Second)}
 
+		mc.On("AcquireLocks", []string{"email:a@gmail.com"}).Return(nil)
+		mc.On("AcquireLocks", []string{"contact:1"}).Return(nil)
 		mc.On("ListContactsByEmailAndPhoneNumber", "a@gmail.com", "").Return(
 			[]storage.Contact{
 				{ID: 2, Email: "a@gmail.com", PhoneNumber: "6789", LinkPrecedence: secondaryContact, LinkedID: 1, CreatedAt: &timestamps[1]},
@@ -137,12 +139,345 @@ func Test_Identify(t *testing.T) {
 			},
 		}
 
-		wantBytes, _ := json.Marshal(want)
-		err := identify(c)
+		res, _, err := identifyContact(context.Background(), s.storage, s.policy, req)
 		assert.Nil(err)
-		assert.Equal(string(wantBytes), strings.Trim(rec.Body.String(), "\n"))
+		assert.Equal(want, res)
 
 		mc.AssertExpectations(t)
 	})
 
 }
+
+func Test_Identify_MemoryStorage(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := newTestService()
+
+	call := func(body string) string {
+		rec := serve(s, http.MethodPost, "/identify", body)
+		assert.Equal(http.StatusOK, rec.Code)
+		return responseBody(rec)
+	}
+
+	assert.Equal(`{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu"],"phoneNumbers":["123456"],"secondaryContactIds":[]}}`,
+		call(`{"phoneNumber":"123456","email":"lorraine@hillvalley.edu"}`))
+	assert.Equal(`{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","mcfly@hillvalley.edu"],"phoneNumbers":["123456"],"secondaryContactIds":[2]}}`,
+		call(`{"phoneNumber":"123456","email":"mcfly@hillvalley.edu"}`))
+	assert.Equal(`{"contact":{"primaryContactId":3,"emails":["george@hillvalley.edu"],"phoneNumbers":["717171"],"secondaryContactIds":[]}}`,
+		call(`{"phoneNumber":"717171","email":"george@hillvalley.edu"}`))
+	assert.Equal(`{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","mcfly@hillvalley.edu","george@hillvalley.edu"],"phoneNumbers":["123456","717171"],"secondaryContactIds":[2,3]}}`,
+		call(`{"phoneNumber":"717171","email":"mcfly@hillvalley.edu"}`))
+
+	// A handler failing after writing must not leave anything behind.
+	req := httptest.NewRequest(http.MethodPost, "/identify", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.Set("service", s)
+	err := transactionMiddleWare(func(c echo.Context) error {
+		store := c.Get("store").(*storage.Store)
+		if _, err := store.Contact.CreateContact(ctx, storage.Contact{Email: "george@hillvalley.edu", LinkPrecedence: primaryContact}); err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	})(c)
+	assert.NotNil(err)
+
+	assert.Equal(`{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","mcfly@hillvalley.edu","george@hillvalley.edu"],"phoneNumbers":["123456","717171"],"secondaryContactIds":[2,3]}}`,
+		call(`{"email":"george@hillvalley.edu"}`))
+}
+
+func Test_Identify_Normalization(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := newTestService()
+	s.normalizer = pkg.NewNormalizer().WithEmailRules(pkg.GmailRule{}).WithDefaultRegion("IN")
+
+	call := func(body string) string {
+		rec := serve(s, http.MethodPost, "/identify", body)
+		assert.Equal(http.StatusOK, rec.Code)
+		return responseBody(rec)
+	}
+
+	want := `{"contact":{"primaryContactId":1,"emails":["johndoe@gmail.com"],"phoneNumbers":["+919876543210"],"secondaryContactIds":[]}}`
+	assert.Equal(want, call(`{"phoneNumber":"+91 98765 43210","email":"John.Doe@Gmail.com"}`))
+	assert.Equal(want, call(`{"phoneNumber":"9876543210","email":"johndoe+orders@gmail.com"}`))
+	assert.Equal(want, call(`{"email":" JOHNDOE@gmail.com "}`))
+
+	tx, err := s.storage.BeginTx(ctx, &sql.TxOptions{})
+	assert.Nil(err)
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	c, err := tx.Contact.GetContact(ctx, 1)
+	assert.Nil(err)
+	assert.Equal("John.Doe@Gmail.com", c.RawEmail)
+	assert.Equal("+91 98765 43210", c.RawPhoneNumber)
+}
+
+func Test_GetContact(t *testing.T) {
+	assert := asserts.New(t)
+	s := newTestService()
+
+	for _, body := range []string{
+		`{"phoneNumber":"123456","email":"lorraine@hillvalley.edu"}`,
+		`{"phoneNumber":"123456","email":"mcfly@hillvalley.edu"}`,
+	} {
+		assert.Equal(http.StatusOK, serve(s, http.MethodPost, "/identify", body).Code)
+	}
+
+	want := `{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","mcfly@hillvalley.edu"],"phoneNumbers":["123456"],"secondaryContactIds":[2]}}`
+
+	for _, id := range []string{"1", "2"} {
+		rec := serve(s, http.MethodGet, "/contacts/"+id, "")
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(want, responseBody(rec))
+	}
+
+	assert.Equal(http.StatusNotFound, serve(s, http.MethodGet, "/contacts/3", "").Code)
+	assert.Equal(http.StatusBadRequest, serve(s, http.MethodGet, "/contacts/abc", "").Code)
+}
+
+func Test_GetContact_Expanded(t *testing.T) {
+	assert := asserts.New(t)
+	s := newTestService()
+
+	call := func(method, target, body string) pkg.Contact {
+		rec := serve(s, method, target, body)
+		assert.Equal(http.StatusOK, rec.Code)
+
+		var res pkg.ContactResponse
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), &res))
+		return res.Contact
+	}
+
+	got := call(http.MethodPost, "/identify", `{"phoneNumber":"111","email":"a@example.com"}`)
+	assert.Nil(got.UpdatedAt)
+	assert.Nil(got.Contacts)
+
+	got = call(http.MethodPost, "/identify?expand=contacts", `{"phoneNumber":"222","email":"b@example.com"}`)
+	assert.Equal(1, len(got.Contacts))
+	assert.Equal(got.Contacts[0].CreatedAt, *got.UpdatedAt)
+
+	// Merging the second cluster into the first one updates its primary.
+	call(http.MethodPost, "/identify", `{"phoneNumber":"111","email":"b@example.com"}`)
+
+	got = call(http.MethodGet, "/contacts/1?expand=contacts", "")
+	assert.Equal(2, len(got.Contacts))
+	assert.Equal(pkg.ContactDetail{
+		ID:             2,
+		Email:          "b@example.com",
+		PhoneNumber:    "222",
+		LinkedID:       1,
+		LinkPrecedence: secondaryContact,
+		CreatedAt:      got.Contacts[1].CreatedAt,
+		UpdatedAt:      got.Contacts[1].UpdatedAt,
+	}, got.Contacts[1])
+	assert.True(got.Contacts[1].UpdatedAt.After(got.Contacts[1].CreatedAt))
+	assert.Equal(got.Contacts[1].UpdatedAt, *got.UpdatedAt)
+}
+
+func Test_Lookup(t *testing.T) {
+	s := newTestService()
+
+	call := func(t *testing.T, target, body string) string {
+		rec := serve(s, http.MethodPost, target, body)
+		asserts.Equal(t, http.StatusOK, rec.Code)
+		return responseBody(rec)
+	}
+
+	t.Run("new primary", func(t *testing.T) {
+		assert := asserts.New(t)
+		assert.Equal(
+			`{"contact":{"primaryContactId":0,"emails":["lorraine@hillvalley.edu"],"phoneNumbers":["123456"],"secondaryContactIds":[]},"outcome":"newPrimary"}`,
+			call(t, "/identify/lookup", `{"phoneNumber":"123456","email":"lorraine@hillvalley.edu"}`))
+	})
+
+	call(t, "/identify", `{"phoneNumber":"123456","email":"lorraine@hillvalley.edu"}`)
+	call(t, "/identify", `{"phoneNumber":"717171","email":"george@hillvalley.edu"}`)
+
+	t.Run("new secondary", func(t *testing.T) {
+		assert := asserts.New(t)
+		assert.Equal(
+			`{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","mcfly@hillvalley.edu"],"phoneNumbers":["123456"],"secondaryContactIds":[]},"outcome":"newSecondary"}`,
+			call(t, "/identify/lookup", `{"phoneNumber":"123456","email":"mcfly@hillvalley.edu"}`))
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		assert := asserts.New(t)
+		assert.Equal(
+			`{"contact":{"primaryContactId":2,"emails":["george@hillvalley.edu"],"phoneNumbers":["717171"],"secondaryContactIds":[]},"outcome":"existing"}`,
+			call(t, "/identify/lookup", `{"phoneNumber":"717171"}`))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert := asserts.New(t)
+		want := `{"contact":{"primaryContactId":1,"emails":["lorraine@hillvalley.edu","george@hillvalley.edu"],"phoneNumbers":["123456","717171"],"secondaryContactIds":[2]}`
+		assert.Equal(want+`,"outcome":"merge"}`,
+			call(t, "/identify/lookup", `{"phoneNumber":"717171","email":"lorraine@hillvalley.edu"}`))
+
+		// The lookups above must not have written anything, and the merge
+		// preview must match what identify actually does.
+		assert.Equal(want+`}`,
+			call(t, "/identify", `{"phoneNumber":"717171","email":"lorraine@hillvalley.edu"}`))
+	})
+}
+
+func Test_DeleteContact(t *testing.T) {
+	s := newTestService()
+
+	for _, rq := range []string{
+		`{"phoneNumber":"111","email":"a@example.com"}`, // 1: primary
+		`{"phoneNumber":"111","email":"b@example.com"}`, // 2: secondary
+		`{"phoneNumber":"222","email":"b@example.com"}`, // 3: secondary
+		`{"phoneNumber":"333","email":"b@example.com"}`, // 4: secondary
+	} {
+		asserts.Equal(t, http.StatusOK, serve(s, http.MethodPost, "/identify", rq).Code)
+	}
+
+	t.Run("secondary", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		primary, err := s.storage.Contact.GetContact(context.Background(), 1)
+		assert.Nil(err)
+
+		assert.Equal(http.StatusNoContent, serve(s, http.MethodDelete, "/contacts/4", "").Code)
+
+		// The cluster's updatedAt moves forward along with its primary's.
+		touched, err := s.storage.Contact.GetContact(context.Background(), 1)
+		assert.Nil(err)
+		assert.True(touched.UpdatedAt.After(*primary.UpdatedAt))
+
+		assert.Equal(http.StatusNotFound, serve(s, http.MethodGet, "/contacts/4", "").Code)
+		assert.Equal(http.StatusNotFound, serve(s, http.MethodDelete, "/contacts/4", "").Code)
+	})
+
+	t.Run("primary", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		assert.Equal(http.StatusNoContent, serve(s, http.MethodDelete, "/contacts/1", "").Code)
+
+		// The oldest remaining contact becomes the primary of the others.
+		rec := serve(s, http.MethodGet, "/contacts/3", "")
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(`{"contact":{"primaryContactId":2,"emails":["b@example.com"],"phoneNumbers":["111","222"],"secondaryContactIds":[3]}}`, responseBody(rec))
+
+		// Deleted contacts are no longer matched.
+		rec = serve(s, http.MethodPost, "/identify", `{"email":"a@example.com"}`)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(`{"contact":{"primaryContactId":5,"emails":["a@example.com"],"phoneNumbers":[],"secondaryContactIds":[]}}`, responseBody(rec))
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		asserts.Equal(t, http.StatusBadRequest, serve(s, http.MethodDelete, "/contacts/abc", "").Code)
+	})
+}
+
+func Test_Identify_Chains(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService()
+
+	// 3 -> 2 -> 1, as left by legacy data, and an unrelated primary 4.
+	for _, c := range []storage.Contact{
+		{Email: "a@example.com", PhoneNumber: "111", LinkPrecedence: primaryContact},
+		{Email: "b@example.com", PhoneNumber: "111", LinkedID: 1, LinkPrecedence: secondaryContact},
+		{Email: "c@example.com", PhoneNumber: "333", LinkedID: 2, LinkPrecedence: secondaryContact},
+		{Email: "d@example.com", PhoneNumber: "444", LinkPrecedence: primaryContact},
+	} {
+		_, err := s.storage.Contact.CreateContact(ctx, c)
+		asserts.Nil(t, err)
+	}
+
+	call := func(t *testing.T, method, target, body string) string {
+		rec := serve(s, method, target, body)
+		asserts.Equal(t, http.StatusOK, rec.Code)
+		return responseBody(rec)
+	}
+
+	linkedID := func(t *testing.T, id int64) int64 {
+		tx, err := s.storage.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		asserts.Nil(t, err)
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		c, err := tx.Contact.GetContact(ctx, id)
+		asserts.Nil(t, err)
+		return c.LinkedID
+	}
+
+	t.Run("read", func(t *testing.T) {
+		assert := asserts.New(t)
+		assert.Equal(
+			`{"contact":{"primaryContactId":1,"emails":["a@example.com","b@example.com","c@example.com"],"phoneNumbers":["111","333"],"secondaryContactIds":[2,3]}}`,
+			call(t, http.MethodGet, "/contacts/3", ""))
+
+		// Reads leave the chain in place.
+		assert.Equal(int64(2), linkedID(t, 3))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert := asserts.New(t)
+		assert.Equal(
+			`{"contact":{"primaryContactId":1,"emails":["a@example.com","b@example.com","c@example.com","d@example.com"],"phoneNumbers":["111","333","444"],"secondaryContactIds":[2,3,4]}}`,
+			call(t, http.MethodPost, "/identify", `{"email":"c@example.com","phoneNumber":"444"}`))
+
+		// Writes flatten the cluster.
+		assert.Equal(int64(1), linkedID(t, 3))
+	})
+}
+
+func Test_Identify_Identifiers(t *testing.T) {
+	s := newTestService()
+
+	identifyAll := func(t *testing.T, bodies ...string) string {
+		var res string
+		for _, body := range bodies {
+			rec := serve(s, http.MethodPost, "/identify", body)
+			asserts.Equal(t, http.StatusOK, rec.Code)
+			res = responseBody(rec)
+		}
+		return res
+	}
+
+	t.Run("new primary", func(t *testing.T) {
+		asserts.Equal(t,
+			`{"contact":{"primaryContactId":1,"emails":["a@example.com"],"phoneNumbers":[],"secondaryContactIds":[],"identifiers":{"loyaltyId":["L-1"]}}}`,
+			identifyAll(t, `{"email":"a@example.com","identifiers":[{"type":"loyaltyId","value":" L-1 "}]}`))
+	})
+
+	t.Run("new secondary", func(t *testing.T) {
+		asserts.Equal(t,
+			`{"contact":{"primaryContactId":1,"emails":["a@example.com"],"phoneNumbers":[],"secondaryContactIds":[2],"identifiers":{"deviceId":["D-1"],"loyaltyId":["L-1"]}}}`,
+			identifyAll(t, `{"identifiers":[{"type":"loyaltyId","value":"L-1"},{"type":"deviceId","value":"D-1"}]}`))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		asserts.Equal(t,
+			`{"contact":{"primaryContactId":1,"emails":["a@example.com"],"phoneNumbers":["222"],"secondaryContactIds":[2,3],"identifiers":{"deviceId":["D-1","D-9"],"loyaltyId":["L-1"]}}}`,
+			identifyAll(t,
+				`{"phoneNumber":"222","identifiers":[{"type":"deviceId","value":"D-9"}]}`, // 3
+				`{"identifiers":[{"type":"deviceId","value":"D-1"},{"type":"deviceId","value":"D-9"}]}`,
+			))
+	})
+
+	t.Run("merge several clusters and add a secondary", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		identifyAll(t,
+			`{"identifiers":[{"type":"socialSubject","value":"S-1"}]}`, // 4
+			`{"email":"z@example.com"}`,                                // 5
+		)
+
+		body := `{"email":"z@example.com","identifiers":[{"type":"socialSubject","value":"S-1"},{"type":"loyaltyId","value":"L-1"},{"type":"deviceId","value":"D-2"}]}`
+		contact := `"emails":["a@example.com","z@example.com"],"phoneNumbers":["222"],"secondaryContactIds":[%s],"identifiers":{"deviceId":["D-1","D-9","D-2"],"loyaltyId":["L-1"],"socialSubject":["S-1"]}`
+
+		rec := serve(s, http.MethodPost, "/identify/lookup", body)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(`{"contact":{"primaryContactId":1,`+fmt.Sprintf(contact, "2,3,4,5")+`},"outcome":"merge"}`, responseBody(rec))
+
+		assert.Equal(`{"contact":{"primaryContactId":1,`+fmt.Sprintf(contact, "2,3,4,5,6")+`}}`, identifyAll(t, body))
+	})
+
+	t.Run("reserved type", func(t *testing.T) {
+		asserts.Equal(t, http.StatusBadRequest, serve(s, http.MethodPost, "/identify", `{"identifiers":[{"type":"email","value":"a@example.com"}]}`).Code)
+	})
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// fakeDriver is a database/sql driver logging the statements run on every connection it opens,
+// for tests looking at how statements are spread over connections and transactions. Open a
+// database on it with sql.OpenDB.
+//
+// Queries inserting a row return the next id, and every other query returns no rows.
+type fakeDriver struct {
+	// fail, when set, is called with every statement before running it, BEGIN and COMMIT
+	// included. The statement fails with the error it returns, if any.
+	fail func(statement string) error
+
+	mu     sync.Mutex
+	logs   [][]string
+	lastID int64
+}
+
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logs = append(d.logs, nil)
+	return &fakeConn{d: d, id: len(d.logs) - 1}, nil
+}
+
+func (d *fakeDriver) Driver() driver.Driver {
+	return d
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fake driver: open the database with sql.OpenDB")
+}
+
+// run logs a statement run on conn, and returns the error it fails with.
+func (d *fakeDriver) run(conn int, statement string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logs[conn] = append(d.logs[conn], statement)
+	if d.fail == nil {
+		return nil
+	}
+	return d.fail(statement)
+}
+
+func (d *fakeDriver) nextID() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastID++
+	return d.lastID
+}
+
+// statements returns the statements run on every connection opened, in order.
+func (d *fakeDriver) statements() [][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	logs := make([][]string, len(d.logs))
+	for i, l := range d.logs {
+		logs[i] = append([]string(nil), l...)
+	}
+	return logs
+}
+
+type fakeConn struct {
+	d  *fakeDriver
+	id int
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake driver: prepared statements are not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	if err := c.d.run(c.id, "BEGIN"); err != nil {
+		return nil, err
+	}
+	return &fakeTx{c: c}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.run(c.id, statement(query, args)); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.run(c.id, statement(query, args)); err != nil {
+		return nil, err
+	}
+	if strings.Contains(query, "RETURNING id") {
+		return &fakeRows{columns: []string{"id"}, values: [][]driver.Value{{c.d.nextID()}}}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+func statement(query string, args []driver.NamedValue) string {
+	values := make([]interface{}, 0, len(args))
+	for _, a := range args {
+		values = append(values, a.Value)
+	}
+	return fmt.Sprintf("%s %v", query, values)
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (t *fakeTx) Commit() error {
+	return t.c.d.run(t.c.id, "COMMIT")
+}
+
+func (t *fakeTx) Rollback() error {
+	return t.c.d.run(t.c.id, "ROLLBACK")
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,470 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/internal/util"
+	"github.com/harshabangi/bitespeed/pkg"
+	"io"
+	"sort"
+	"strings"
+)
+
+const fsckUsage = "usage: bitespeed fsck [--fix]"
+
+var errInconsistentContacts = errors.New("contact graph is inconsistent")
+
+// Fsck runs the fsck command, which checks the contact table of the configured Postgres
+// database against the invariants every write maintains and, with --fix, repairs it, keeping
+// the primary contacts the configured primary policy prefers.
+func Fsck(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	fix := flags.Bool("fix", false, "repair the problems found")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf(fsckUsage)
+	}
+
+	if cfg.Storage == storageMemory {
+		return fmt.Errorf("fsck is not supported by the %s storage backend", cfg.Storage)
+	}
+
+	policy, err := newPrimaryPolicy(cfg.PrimaryPolicy, cfg.PrimaryPolicySources)
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Sql.Close()
+	}()
+
+	return fsck(context.Background(), store, policy, *fix, out)
+}
+
+// fsck reports every problem of the contact graph. With fix it repairs them in a single
+// transaction, merging clusters as identify does under policy, otherwise it fails if any
+// problem is found.
+func fsck(ctx context.Context, s *storage.Store, policy PrimaryPolicy, fix bool, out io.Writer) error {
+	opts := readOnlyTxOptions
+	if fix {
+		opts = writeTxOptions
+	}
+
+	tx, err := s.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var g *contactGraph
+	if fix {
+		g, err = lockContactGraph(ctx, tx, policy)
+	} else {
+		g, err = readContactGraph(ctx, tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	problems := g.check()
+	for _, p := range problems {
+		_, _ = fmt.Fprintln(out, p)
+	}
+	if len(problems) == 0 {
+		_, _ = fmt.Fprintln(out, "no problems found")
+		return nil
+	}
+	if !fix {
+		return fmt.Errorf("%w: %d problems found", errInconsistentContacts, len(problems))
+	}
+
+	changes := g.repairs(policy)
+	if err := g.recordRepairs(ctx, tx, changes); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.LinkPrecedence == primaryContact {
+			err = tx.Contact.PromoteContact(ctx, c.ID)
+		} else {
+			err = tx.Contact.UpdateContact(ctx, c.ID, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "repaired %d contacts\n", len(changes))
+	return nil
+}
+
+// readContactGraph reads every contact along with the reverted merges.
+func readContactGraph(ctx context.Context, s *storage.Store) (*contactGraph, error) {
+	contacts, err := s.Contact.ListContacts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reverted, err := s.Merge.ListRevertedMerges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newContactGraph(contacts, reverted), nil
+}
+
+// lockContactGraph reads the contact graph and locks every contact that repairs would change,
+// along with the contacts and identifiers of their clusters, so that no request changes those
+// clusters concurrently. As with lockAndListContacts, the graph is read again until everything
+// that needs locking is locked.
+func lockContactGraph(ctx context.Context, s *storage.Store, policy PrimaryPolicy) (*contactGraph, error) {
+	locked := make(map[string]bool)
+
+	for {
+		g, err := readContactGraph(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		lock := func(key string) {
+			if !locked[key] {
+				locked[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		repaired := make(map[int64]bool)
+		for _, change := range g.repairs(policy) {
+			root := g.groups.find(change.ID)
+			if repaired[root] {
+				continue
+			}
+			repaired[root] = true
+
+			for _, c := range g.members[root] {
+				lock(contactLockKey(c.ID))
+				for _, key := range identifierLockKeys(contactIdentifiers(c)) {
+					lock(key)
+				}
+			}
+		}
+
+		if len(keys) == 0 {
+			return g, nil
+		}
+		if err := s.Contact.AcquireLocks(ctx, keys...); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// contactGraph holds every contact along with two partitions of them: clusters, the contacts
+// connected by linked ids, and groups, the clusters connected by a shared identifier, which
+// identify would have merged into one. Both are named after their lowest contact id.
+//
+// Two clusters split apart by unmerge may still share identifiers, so clusters separated by a
+// reverted merge are only grouped when another cluster connects them.
+type contactGraph struct {
+	contacts []storage.Contact
+	byID     map[int64]storage.Contact
+	clusters unionFind
+	groups   unionFind
+
+	// separated holds the pairs of clusters separated by a reverted merge, lowest name first.
+	separated map[[2]int64]bool
+
+	// members holds the contacts of every group, by group name.
+	members map[int64][]storage.Contact
+}
+
+func newContactGraph(contacts []storage.Contact, reverted []storage.Merge) *contactGraph {
+	g := &contactGraph{
+		contacts:  contacts,
+		byID:      make(map[int64]storage.Contact, len(contacts)),
+		clusters:  make(unionFind),
+		groups:    make(unionFind),
+		separated: make(map[[2]int64]bool),
+		members:   make(map[int64][]storage.Contact),
+	}
+
+	for _, c := range contacts {
+		g.byID[c.ID] = c
+	}
+
+	for _, c := range contacts {
+		if _, ok := g.byID[c.LinkedID]; ok {
+			g.clusters.union(c.ID, c.LinkedID)
+			g.groups.union(c.ID, c.LinkedID)
+		}
+	}
+
+	for _, m := range reverted {
+		if pair, ok := g.clusterPair(m.PrimaryID, m.MergedID); ok {
+			g.separated[pair] = true
+		}
+	}
+
+	// known holds the clusters of every identifier.
+	known := make(map[pkg.Identifier][]int64)
+	for _, c := range contacts {
+		root := g.clusters.find(c.ID)
+		for _, identifier := range contactIdentifiers(c) {
+			if util.Contains(known[identifier], root) {
+				continue
+			}
+			for _, other := range known[identifier] {
+				if !g.isSeparated(root, other) {
+					g.groups.union(root, other)
+				}
+			}
+			known[identifier] = append(known[identifier], root)
+		}
+	}
+
+	for _, c := range contacts {
+		root := g.groups.find(c.ID)
+		g.members[root] = append(g.members[root], c)
+	}
+	return g
+}
+
+// clusterPair returns the clusters of the contacts id1 and id2, lowest name first, unless they
+// are the same.
+func (g *contactGraph) clusterPair(id1, id2 int64) ([2]int64, bool) {
+	root1, root2 := g.clusters.find(id1), g.clusters.find(id2)
+	if root1 > root2 {
+		root1, root2 = root2, root1
+	}
+	return [2]int64{root1, root2}, root1 != root2
+}
+
+// isSeparated reports whether the clusters of the contacts id1 and id2 are separated by a
+// reverted merge.
+func (g *contactGraph) isSeparated(id1, id2 int64) bool {
+	pair, ok := g.clusterPair(id1, id2)
+	return ok && g.separated[pair]
+}
+
+// check describes every violation of the invariants kept by identify: every cluster has exactly
+// one primary contact, every secondary contact is linked directly to it, and no identifier
+// belongs to two clusters, unless those are separated by a reverted merge.
+func (g *contactGraph) check() []string {
+	var (
+		problems  []string
+		clusters  []int64
+		primaries = make(map[int64][]string)
+	)
+
+	for _, c := range g.contacts {
+		root := g.clusters.find(c.ID)
+		if _, ok := primaries[root]; !ok {
+			clusters = append(clusters, root)
+			primaries[root] = nil
+		}
+
+		if c.LinkPrecedence == primaryContact {
+			primaries[root] = append(primaries[root], fmt.Sprint(c.ID))
+			if c.LinkedID != 0 {
+				problems = append(problems, fmt.Sprintf("contact %d: primary contact linked to contact %d", c.ID, c.LinkedID))
+			}
+			continue
+		}
+
+		if c.LinkedID == 0 {
+			problems = append(problems, fmt.Sprintf("contact %d: secondary contact not linked to any contact", c.ID))
+		} else if linked, ok := g.byID[c.LinkedID]; !ok {
+			problems = append(problems, fmt.Sprintf("contact %d: linked to missing contact %d", c.ID, c.LinkedID))
+		} else if linked.LinkPrecedence != primaryContact {
+			problems = append(problems, fmt.Sprintf("contact %d: linked to secondary contact %d", c.ID, c.LinkedID))
+		}
+	}
+
+	for _, root := range clusters {
+		switch ids := primaries[root]; {
+		case len(ids) == 0:
+			problems = append(problems, fmt.Sprintf("cluster %d: no primary contact", root))
+		case len(ids) > 1:
+			problems = append(problems, fmt.Sprintf("cluster %d: %d primary contacts %s", root, len(ids), strings.Join(ids, ", ")))
+		}
+	}
+
+	var identifiers []pkg.Identifier
+	identifierClusters := make(map[pkg.Identifier][]int64)
+	for _, c := range g.contacts {
+		root := g.clusters.find(c.ID)
+		for _, id := range contactIdentifiers(c) {
+			if _, ok := identifierClusters[id]; !ok {
+				identifiers = append(identifiers, id)
+			}
+			if !util.Contains(identifierClusters[id], root) {
+				identifierClusters[id] = append(identifierClusters[id], root)
+			}
+		}
+	}
+
+	for _, id := range identifiers {
+		if roots := identifierClusters[id]; g.grouped(roots) {
+			problems = append(problems, fmt.Sprintf("%s %q: in clusters %s", id.Type, id.Value, joinIDs(roots)))
+		}
+	}
+	return problems
+}
+
+// grouped reports whether any two of the clusters belong to the same group, which repairs merges
+// into one.
+func (g *contactGraph) grouped(clusters []int64) bool {
+	seen := make(map[int64]bool)
+	for _, root := range clusters {
+		group := g.groups.find(root)
+		if seen[group] {
+			return true
+		}
+		seen[group] = true
+	}
+	return false
+}
+
+// recordRepairs records the changes of repairs as identify records its own, before they are
+// made: every primary contact linked to the primary of another cluster is a merge, which unmerge
+// can revert, and every other contact linked to the primary of another cluster is linked to it.
+func (g *contactGraph) recordRepairs(ctx context.Context, s *storage.Store, changes []storage.Contact) error {
+	for _, c := range changes {
+		if c.LinkPrecedence == primaryContact || g.clusters.find(c.ID) == g.clusters.find(c.LinkedID) {
+			continue
+		}
+
+		contact, primary := g.byID[c.ID], g.byID[c.LinkedID]
+		if contact.LinkPrecedence != primaryContact {
+			if err := recordEvent(ctx, s, pkg.EventLinked, c.ID, c.LinkedID, "", "", nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := recordMerge(ctx, s, pkg.ContactRequest{}, &primary, &contact); err != nil {
+			return err
+		}
+		if err := recordEvent(ctx, s, pkg.EventMerged, c.ID, c.LinkedID, "", "", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairs returns the changes that turn every group into a single flat cluster. As when
+// identify merges clusters, the primary contact of the cluster policy prefers stays primary; a
+// group without any primary contact gets its oldest contact promoted. Every other contact of the
+// group becomes a secondary contact linked directly to it. Changes with a primary link
+// precedence are promotions, the others are updates of the contact's linked id and link
+// precedence.
+func (g *contactGraph) repairs(policy PrimaryPolicy) []storage.Contact {
+	var changes []storage.Contact
+
+	for _, c := range g.contacts {
+		root := g.groups.find(c.ID)
+		if root != c.ID {
+			continue
+		}
+		members := g.members[root]
+
+		var primary *Cluster
+		for i, m := range members {
+			if m.LinkPrecedence != primaryContact {
+				continue
+			}
+			if c := g.cluster(&members[i]); primary == nil || preferCluster(policy, c, *primary) {
+				primary = &c
+			}
+		}
+
+		var primaryID int64
+		if primary != nil {
+			primaryID = primary.Primary.ID
+		} else {
+			oldest := members[0]
+			for _, m := range members {
+				if isOlderContact(m, oldest) {
+					oldest = m
+				}
+			}
+			primaryID = oldest.ID
+		}
+
+		for _, m := range members {
+			switch {
+			case m.ID == primaryID:
+				if m.LinkPrecedence != primaryContact || m.LinkedID != 0 {
+					changes = append(changes, storage.Contact{ID: m.ID, LinkPrecedence: primaryContact})
+				}
+			case m.LinkPrecedence != secondaryContact || m.LinkedID != primaryID:
+				changes = append(changes, storage.Contact{ID: m.ID, LinkedID: primaryID, LinkPrecedence: secondaryContact})
+			}
+		}
+	}
+	return changes
+}
+
+// cluster returns the primary contact along with the contacts of its cluster, oldest first, for
+// the primary policy to rank.
+func (g *contactGraph) cluster(primary *storage.Contact) Cluster {
+	root := g.clusters.find(primary.ID)
+
+	var contacts []storage.Contact
+	for _, c := range g.members[g.groups.find(root)] {
+		if g.clusters.find(c.ID) == root {
+			contacts = append(contacts, c)
+		}
+	}
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return isOlderContact(contacts[i], contacts[j])
+	})
+	return Cluster{Primary: primary, Contacts: contacts}
+}
+
+// joinIDs formats ids as a comma separated list.
+func joinIDs(ids []int64) string {
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, fmt.Sprint(id))
+	}
+	return strings.Join(s, ", ")
+}
+
+// isOlderContact reports whether c1 was created before c2, breaking ties by id.
+func isOlderContact(c1, c2 storage.Contact) bool {
+	if c1.CreatedAt != nil && c2.CreatedAt != nil && !c1.CreatedAt.Equal(*c2.CreatedAt) {
+		return c1.CreatedAt.Before(*c2.CreatedAt)
+	}
+	return c1.ID < c2.ID
+}
+
+// unionFind partitions contact ids into disjoint sets, each named after its lowest id.
+type unionFind map[int64]int64
+
+func (u unionFind) find(id int64) int64 {
+	parent, ok := u[id]
+	if !ok || parent == id {
+		return id
+	}
+	root := u.find(parent)
+	u[id] = root
+	return root
+}
+
+func (u unionFind) union(id1, id2 int64) {
+	root1, root2 := u.find(id1), u.find(id2)
+	if root1 > root2 {
+		root1, root2 = root2, root1
+	}
+	u[root2] = root1
+}
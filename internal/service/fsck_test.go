@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_Fsck(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := storage.NewMemory()
+
+	for _, c := range []storage.Contact{
+		{Email: "a@example.com", PhoneNumber: "111", LinkPrecedence: primaryContact},                 // 1
+		{Email: "b@example.com", PhoneNumber: "111", LinkedID: 1, LinkPrecedence: secondaryContact},  // 2
+		{Email: "c@example.com", PhoneNumber: "333", LinkedID: 2, LinkPrecedence: secondaryContact},  // 3: chained
+		{Email: "d@example.com", PhoneNumber: "444", LinkedID: 8, LinkPrecedence: primaryContact},    // 4: linked primary
+		{Email: "e@example.com", PhoneNumber: "555", LinkPrecedence: secondaryContact},               // 5: unlinked secondary
+		{Email: "f@example.com", PhoneNumber: "666", LinkedID: 99, LinkPrecedence: secondaryContact}, // 6: missing link
+		{Email: "a@example.com", PhoneNumber: "777", LinkPrecedence: primaryContact},                 // 7: shares an email with 1
+		{Email: "g@example.com", PhoneNumber: "888", LinkPrecedence: primaryContact},                 // 8
+		{Email: "h@example.com", PhoneNumber: "999", LinkPrecedence: primaryContact},                 // 9: consistent
+	} {
+		_, err := s.Contact.CreateContact(ctx, c)
+		assert.Nil(err)
+	}
+
+	var out bytes.Buffer
+	err := fsck(ctx, s, OldestPolicy{}, false, &out)
+	assert.ErrorIs(err, errInconsistentContacts)
+	assert.Equal(`contact 3: linked to secondary contact 2
+contact 4: primary contact linked to contact 8
+contact 5: secondary contact not linked to any contact
+contact 6: linked to missing contact 99
+cluster 4: 2 primary contacts 4, 8
+cluster 5: no primary contact
+cluster 6: no primary contact
+email "a@example.com": in clusters 1, 7
+`, out.String())
+
+	out.Reset()
+	assert.Nil(fsck(ctx, s, OldestPolicy{}, true, &out))
+	assert.Contains(out.String(), "repaired 6 contacts\n")
+
+	// Linking contact 7 to contact 1 merged their clusters, which unmerge can revert.
+	merge, err := s.Merge.GetLatestMergeByMember(ctx, 7)
+	assert.Nil(err)
+	assert.Equal(int64(1), merge.PrimaryID)
+	assert.Equal(int64(7), merge.MergedID)
+
+	events, err := s.Event.ListEventsByContactIDs(ctx, []int64{7})
+	assert.Nil(err)
+	if assert.Equal(1, len(events)) {
+		assert.Equal(pkg.EventMerged, events[0].Type)
+		assert.Equal(int64(1), events[0].PrimaryID)
+	}
+
+	out.Reset()
+	assert.Nil(fsck(ctx, s, OldestPolicy{}, false, &out))
+	assert.Equal("no problems found\n", out.String())
+
+	tx, err := s.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	assert.Nil(err)
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	contacts, err := tx.Contact.ListContacts(ctx)
+	assert.Nil(err)
+
+	links := make(map[int64]int64)
+	for _, c := range contacts {
+		links[c.ID] = c.LinkedID
+	}
+	assert.Equal(map[int64]int64{1: 0, 2: 1, 3: 1, 4: 0, 5: 0, 6: 0, 7: 1, 8: 4, 9: 0}, links)
+}
+
+func Test_Fsck_AfterUnmerge(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := newTestService()
+
+	for _, rq := range []pkg.ContactRequest{
+		{Email: "a@example.com", PhoneNumber: "111"}, // 1
+		{Email: "c@example.com", PhoneNumber: "222"}, // 2
+		{Email: "a@example.com", PhoneNumber: "222"}, // merges 2 into 1
+		{Email: "c@example.com", PhoneNumber: "444"}, // 3: added to 1 after the merge, because of 2
+	} {
+		assert.Equal(http.StatusOK, identifyRequest(s, rq))
+	}
+
+	assert.Equal(http.StatusOK, serve(s, http.MethodPost, "/unmerge", `{"contactId":2}`).Code)
+
+	var out bytes.Buffer
+	assert.Nil(fsck(ctx, s.storage, OldestPolicy{}, false, &out))
+	assert.Equal("no problems found\n", out.String())
+
+	// Contact 3 left behind in the cluster of contact 1 shares its email with the cluster of
+	// contact 2, which the reverted merge separates from it.
+	assert.Nil(s.storage.Contact.UpdateContact(ctx, 3, storage.Contact{LinkedID: 1, LinkPrecedence: secondaryContact}))
+
+	out.Reset()
+	assert.Nil(fsck(ctx, s.storage, OldestPolicy{}, false, &out))
+	assert.Equal("no problems found\n", out.String())
+
+	// A contact sharing identifiers with both clusters connects them again.
+	_, err := s.storage.Contact.CreateContact(ctx, storage.Contact{Email: "c@example.com", PhoneNumber: "111", LinkPrecedence: primaryContact}) // 4
+	assert.Nil(err)
+
+	out.Reset()
+	assert.ErrorIs(fsck(ctx, s.storage, OldestPolicy{}, false, &out), errInconsistentContacts)
+	assert.Equal(`phoneNumber "111": in clusters 1, 4
+email "c@example.com": in clusters 2, 1, 4
+`, out.String())
+}
+
+func Test_Fsck_Policy(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := storage.NewMemory()
+
+	for _, c := range []storage.Contact{
+		{Email: "a@example.com", PhoneNumber: "111", Source: "web", LinkPrecedence: primaryContact},                // 1
+		{Email: "b@example.com", PhoneNumber: "111", Source: "pos", LinkPrecedence: primaryContact},                // 2: shares a phone number with 1
+		{Email: "c@example.com", PhoneNumber: "222", LinkedID: 1, Source: "web", LinkPrecedence: secondaryContact}, // 3
+	} {
+		_, err := s.Contact.CreateContact(ctx, c)
+		assert.Nil(err)
+	}
+
+	// The policy prefers the newer cluster, whose primary contact is kept.
+	var out bytes.Buffer
+	assert.Nil(fsck(ctx, s, NewSourceTrustPolicy("pos", "web"), true, &out))
+	assert.Contains(out.String(), "repaired 2 contacts\n")
+
+	contacts, err := s.Contact.ListContactsByID(ctx, 2)
+	assert.Nil(err)
+	links := make(map[int64]int64)
+	for _, c := range contacts {
+		links[c.ID] = c.LinkedID
+	}
+	assert.Equal(map[int64]int64{1: 2, 2: 0, 3: 2}, links)
+}
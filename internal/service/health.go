@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessTimeout bounds the database checks of a readiness probe.
+const readinessTimeout = 2 * time.Second
+
+// healthz godoc
+// @Summary Show whether the service is up.
+// @Description liveness probe: succeeds as long as the process serves requests.
+// @Tags health
+// @Produce json
+// @Success 200 {object} pkg.HealthResponse
+// @Router /healthz [get]
+func healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, &pkg.HealthResponse{Status: pkg.HealthOK})
+}
+
+// readyz godoc
+// @Summary Show whether the service can take requests.
+// @Description readiness probe: fails while the database is unreachable, migrations are pending, or the service is shutting down.
+// @Tags health
+// @Produce json
+// @Success 200 {object} pkg.HealthResponse
+// @Failure 503 {object} pkg.HealthResponse
+// @Router /readyz [get]
+func readyz(c echo.Context) error {
+	s := c.Get("service").(*Service)
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	res := s.readiness(ctx)
+	if res.Status != pkg.HealthOK {
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *Service) readiness(ctx context.Context) *pkg.HealthResponse {
+	res := &pkg.HealthResponse{Status: pkg.HealthOK, Checks: make(map[string]pkg.HealthCheck)}
+	check := func(name string, err error) {
+		if err != nil {
+			res.Status = pkg.HealthUnavailable
+			res.Checks[name] = pkg.HealthCheck{Status: pkg.HealthUnavailable, Detail: err.Error()}
+		} else {
+			res.Checks[name] = pkg.HealthCheck{Status: pkg.HealthOK}
+		}
+	}
+
+	if s.shuttingDown.Load() {
+		check("server", fmt.Errorf("shutting down"))
+	} else {
+		check("server", nil)
+	}
+
+	err := s.storage.Ping(ctx)
+	check("database", err)
+
+	if s.storage.Sql != nil {
+		if err != nil {
+			check("migrations", fmt.Errorf("database unreachable"))
+		} else {
+			check("migrations", checkMigrations(ctx, s.storage))
+		}
+	}
+	return res
+}
+
+// checkMigrations fails if any migration embedded in the binary is not applied. Migrations
+// applied by a newer version are fine, so that old instances stay ready during a rollout.
+func checkMigrations(ctx context.Context, s *storage.Store) error {
+	migrator, err := storage.NewMigrator(s.Sql)
+	if err != nil {
+		return err
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return fmt.Errorf("reading applied migrations: %w", err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(pending))
+	for _, m := range pending {
+		names = append(names, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+	}
+	noun := "migrations"
+	if len(pending) == 1 {
+		noun = "migration"
+	}
+	return fmt.Errorf("%d pending %s: %s", len(pending), noun, strings.Join(names, ", "))
+}
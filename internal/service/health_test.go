@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_Health(t *testing.T) {
+	probe := func(s *Service, path string) (int, string) {
+		rec := serve(s, http.MethodGet, path, "")
+		return rec.Code, responseBody(rec)
+	}
+
+	sqlService := func(t *testing.T) (*Service, sqlMock.Sqlmock) {
+		db, mock, err := sqlMock.New(sqlMock.MonitorPingsOption(true))
+		asserts.Nil(t, err)
+		t.Cleanup(func() { _ = db.Close() })
+		return &Service{storage: &storage.Store{Sql: db}}, mock
+	}
+
+	t.Run("liveness", func(t *testing.T) {
+		code, body := probe(newTestService(), "/healthz")
+		asserts.Equal(t, http.StatusOK, code)
+		asserts.Equal(t, `{"status":"ok"}`, body)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		code, body := probe(newTestService(), "/readyz")
+		asserts.Equal(t, http.StatusOK, code)
+		asserts.Equal(t, `{"status":"ok","checks":{"database":{"status":"ok"},"server":{"status":"ok"}}}`, body)
+	})
+
+	t.Run("ready with every migration applied", func(t *testing.T) {
+		assert := asserts.New(t)
+		s, mock := sqlService(t)
+
+		rows := sqlMock.NewRows([]string{"version", "applied_at"})
+		for v := 1; v <= 1000; v++ {
+			rows.AddRow(v, time.Now())
+		}
+		mock.ExpectPing()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).WillReturnRows(rows)
+
+		code, body := probe(s, "/readyz")
+		assert.Equal(http.StatusOK, code)
+		assert.Equal(`{"status":"ok","checks":{"database":{"status":"ok"},"migrations":{"status":"ok"},"server":{"status":"ok"}}}`, body)
+		assert.Nil(mock.ExpectationsWereMet())
+	})
+
+	t.Run("pending migrations", func(t *testing.T) {
+		assert := asserts.New(t)
+		s, mock := sqlService(t)
+
+		mock.ExpectPing()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+			WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}))
+
+		code, body := probe(s, "/readyz")
+		assert.Equal(http.StatusServiceUnavailable, code)
+		assert.Contains(body, `"migrations":{"status":"unavailable","detail":"`)
+		assert.Contains(body, ` pending migrations: 0001_create_contact, 0002_add_contact_indexes, `)
+	})
+
+	t.Run("database unreachable", func(t *testing.T) {
+		assert := asserts.New(t)
+		s, mock := sqlService(t)
+
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+		code, body := probe(s, "/readyz")
+		assert.Equal(http.StatusServiceUnavailable, code)
+		assert.Equal(`{"status":"unavailable","checks":{"database":{"status":"unavailable","detail":"connection refused"},`+
+			`"migrations":{"status":"unavailable","detail":"database unreachable"},"server":{"status":"ok"}}}`, body)
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		s := newTestService()
+		s.shuttingDown.Store(true)
+
+		code, body := probe(s, "/readyz")
+		asserts.Equal(t, http.StatusServiceUnavailable, code)
+		asserts.Equal(t, `{"status":"unavailable","checks":{"database":{"status":"ok"},"server":{"status":"unavailable","detail":"shutting down"}}}`, body)
+	})
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http/httptest"
+	"strings"
+)
+
+// newTestService returns a service on an empty memory store, normalizing identifiers with the
+// default rules.
+func newTestService() *Service {
+	return &Service{storage: storage.NewMemory(), normalizer: pkg.NewNormalizer()}
+}
+
+// serve sends a request through the routes of s and returns its response. A non-empty body is
+// sent as JSON, and headers are given as pairs of name and value.
+func serve(s *Service, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, req)
+	return rec
+}
+
+// responseBody returns the body of rec without its trailing newline.
+func responseBody(rec *httptest.ResponseRecorder) string {
+	return strings.TrimSuffix(rec.Body.String(), "\n")
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+// getContactHistory godoc
+// @Summary Show the history of a contact.
+// @Description get the events of the cluster the given contact belongs to, oldest first.
+// @Tags root
+// @Param id path int true "Contact ID"
+// @Produce json
+// @Success 200 {object} pkg.HistoryResponse
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /contacts/{id}/history [get]
+func getContactHistory(c echo.Context) error {
+	store := c.Get("store").(*storage.Store)
+	ctx := c.Request().Context()
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("incorrect contact id: %s", c.Param("id")))
+	}
+
+	primary, err := store.Contact.GetPrimaryContact(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("contact %d not found", id))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	cluster, err := store.Contact.ListContactsByID(ctx, primary.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	ids := make([]int64, 0, len(cluster))
+	for _, c := range cluster {
+		ids = append(ids, c.ID)
+	}
+
+	events, err := store.Event.ListEventsByContactIDs(ctx, ids)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	res := pkg.NewHistoryResponse()
+	for _, ev := range events {
+		res.Events = append(res.Events, pkg.ContactEvent{
+			ID:               ev.ID,
+			ContactID:        ev.ContactID,
+			Type:             ev.Type,
+			PrimaryContactID: ev.PrimaryID,
+			Email:            ev.Email,
+			PhoneNumber:      ev.PhoneNumber,
+			Identifiers:      fromIdentifiers(ev.Identifiers),
+			CreatedAt:        *ev.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
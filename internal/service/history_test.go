@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_GetContactHistory(t *testing.T) {
+	assert := asserts.New(t)
+	s := newTestService()
+
+	post := func(target, body string) {
+		assert.Equal(http.StatusOK, serve(s, http.MethodPost, target, body).Code)
+	}
+
+	history := func(id string) ([]pkg.ContactEvent, int) {
+		rec := serve(s, http.MethodGet, "/contacts/"+id+"/history", "")
+		if rec.Code != http.StatusOK {
+			return nil, rec.Code
+		}
+
+		var res pkg.HistoryResponse
+		assert.Nil(json.Unmarshal(rec.Body.Bytes(), &res))
+		return res.Events, rec.Code
+	}
+
+	post("/identify", `{"phoneNumber":"111","email":"a@example.com"}`)
+	post("/identify", `{"phoneNumber":"111","email":"b@example.com"}`)
+	post("/identify", `{"phoneNumber":"222","email":"c@example.com"}`)
+	post("/identify", `{"phoneNumber":"222","email":"a@example.com"}`)
+	post("/unmerge", `{"contactId":3}`)
+
+	type event struct {
+		ContactID, PrimaryID int64
+		Type                 string
+		Email, PhoneNumber   string
+	}
+	simplify := func(events []pkg.ContactEvent) []event {
+		var result []event
+		for _, ev := range events {
+			assert.False(ev.CreatedAt.IsZero())
+			result = append(result, event{ev.ContactID, ev.PrimaryContactID, ev.Type, ev.Email, ev.PhoneNumber})
+		}
+		return result
+	}
+
+	got, code := history("2")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]event{
+		{1, 1, pkg.EventCreated, "a@example.com", "111"},
+		{2, 1, pkg.EventLinked, "b@example.com", "111"},
+		{3, 1, pkg.EventMerged, "a@example.com", "222"},
+		{3, 1, pkg.EventUnmerged, "", ""},
+	}, simplify(got))
+
+	got, code = history("3")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]event{
+		{3, 3, pkg.EventCreated, "c@example.com", "222"},
+		{3, 1, pkg.EventMerged, "a@example.com", "222"},
+		{3, 1, pkg.EventUnmerged, "", ""},
+	}, simplify(got))
+
+	// Other identifiers of the request are kept on its events.
+	post("/identify", `{"email":"d@example.com","identifiers":[{"type":"loyaltyId","value":"L1"}]}`)
+	got, code = history("4")
+	assert.Equal(http.StatusOK, code)
+	if assert.Equal(1, len(got)) {
+		assert.Equal([]pkg.Identifier{{Type: "loyaltyId", Value: "L1"}}, got[0].Identifiers)
+	}
+
+	_, code = history("9")
+	assert.Equal(http.StatusNotFound, code)
+}
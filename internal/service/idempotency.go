@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+const (
+	// idempotencyKeyHeader carries the key an identify request is sent with. Repeats of the
+	// request with the same key are answered the response of the first one, which is not
+	// applied again.
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader is set on the responses answering a repeated request.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var errIdempotencyKeyReused = echo.NewHTTPError(http.StatusUnprocessableEntity, "idempotency key already used for a different request")
+
+// idempotency is the idempotency key of an identify request, along with the hash of the request.
+type idempotency struct {
+	key  string
+	hash string
+}
+
+// requestIdempotency returns the idempotency of an identify request, or nil when it was sent
+// without a key or keys are disabled. req is the prepared request, answered expanded with expand.
+func requestIdempotency(c echo.Context, s *Service, req pkg.ContactRequest, expand bool) (*idempotency, error) {
+	key := strings.TrimSpace(c.Request().Header.Get(idempotencyKeyHeader))
+	if key == "" || s.config == nil || s.config.IdempotencyTTL <= 0 {
+		return nil, nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("idempotency key longer than %d bytes", maxIdempotencyKeyLength))
+	}
+
+	// The request is hashed once normalized, so that it does not depend on the formatting of
+	// the body, along with the values as received, so that it does depend on every one of them.
+	data, err := json.Marshal(struct {
+		Request        pkg.ContactRequest `json:"request"`
+		RawEmail       string             `json:"rawEmail"`
+		RawPhoneNumber string             `json:"rawPhoneNumber"`
+		Expand         bool               `json:"expand"`
+	}{req, req.RawEmail, req.RawPhoneNumber, expand})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return &idempotency{key: key, hash: hex.EncodeToString(hash[:])}, nil
+}
+
+// replay returns the response stored for the key, or nil when the key is new or expired. The key
+// is locked until the transaction ends, so that a repeat sent while the first request is still in
+// progress waits for its response.
+func (i *idempotency) replay(ctx context.Context, s *Service, store *storage.Store) (*pkg.ContactResponse, error) {
+	if err := store.Contact.AcquireLocks(ctx, storage.IdempotencyLockKey(i.key)); err != nil {
+		return nil, err
+	}
+
+	stored, err := store.Idempotency.GetIdempotencyKey(ctx, i.key, s.config.IdempotencyTTL)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if stored.RequestHash != i.hash {
+		return nil, errIdempotencyKeyReused
+	}
+
+	var res pkg.ContactResponse
+	if err := json.Unmarshal(stored.Response, &res); err != nil {
+		return nil, fmt.Errorf("decoding the response stored for idempotency key %q: %w", i.key, err)
+	}
+	return &res, nil
+}
+
+// save stores the response given to the request, in the transaction of the request. Some of the
+// keys expired are deleted along the way.
+func (i *idempotency) save(ctx context.Context, s *Service, store *storage.Store, res *pkg.ContactResponse) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	key := storage.IdempotencyKey{Key: i.key, RequestHash: i.hash, Response: data}
+	return store.Idempotency.SaveIdempotencyKey(ctx, key, s.config.IdempotencyTTL)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Identify_IdempotencyKey(t *testing.T) {
+	newService := func(ttl time.Duration) *Service {
+		s := newTestService()
+		s.config = &Config{IdempotencyTTL: ttl}
+		return s
+	}
+
+	post := func(s *Service, key, body string) *httptest.ResponseRecorder {
+		return serve(s, http.MethodPost, "/identify", body, idempotencyKeyHeader, key)
+	}
+
+	contacts := func(t *testing.T, s *Service) int {
+		all, err := s.storage.Contact.ListContacts(context.Background())
+		asserts.Nil(t, err)
+		return len(all)
+	}
+
+	t.Run("repeats are replayed", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := newService(time.Hour)
+
+		post(s, "", `{"email":"a@example.com","phoneNumber":"111"}`)
+
+		first := post(s, "k-1", `{"email":"b@example.com","phoneNumber":"111"}`)
+		assert.Equal(http.StatusOK, first.Code)
+		assert.Empty(first.Header().Get(idempotentReplayedHeader))
+
+		// A merge in between changes the cluster, but not the replayed response.
+		post(s, "", `{"email":"c@example.com","phoneNumber":"222"}`)
+		post(s, "", `{"email":"c@example.com","phoneNumber":"111"}`)
+
+		repeat := post(s, "k-1", ` { "phoneNumber": "111", "email": "b@example.com" } `)
+		assert.Equal(http.StatusOK, repeat.Code)
+		assert.Equal("true", repeat.Header().Get(idempotentReplayedHeader))
+		assert.Equal(first.Body.String(), repeat.Body.String())
+		assert.Equal(3, contacts(t, s))
+	})
+
+	t.Run("keys are not reused for another request", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := newService(time.Hour)
+
+		post(s, "k-1", `{"email":"a@example.com"}`)
+		for _, body := range []string{
+			`{"email":"b@example.com"}`,
+			`{"email":"A@example.com"}`,
+		} {
+			rec := post(s, "k-1", body)
+			assert.Equal(http.StatusUnprocessableEntity, rec.Code)
+			assert.Equal(`{"message":"idempotency key already used for a different request"}`, responseBody(rec))
+		}
+
+		// Nor for the same request with another expansion, whose response differs.
+		rec := serve(s, http.MethodPost, "/identify?expand=contacts", `{"email":"a@example.com"}`, idempotencyKeyHeader, "k-1")
+		assert.Equal(http.StatusUnprocessableEntity, rec.Code)
+
+		assert.Equal(1, contacts(t, s))
+	})
+
+	t.Run("expired keys are applied again", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := newService(time.Nanosecond)
+
+		post(s, "k-1", `{"email":"a@example.com"}`)
+		rec := post(s, "k-1", `{"email":"a@example.com","phoneNumber":"111"}`)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Empty(rec.Header().Get(idempotentReplayedHeader))
+		assert.Equal(2, contacts(t, s))
+	})
+
+	t.Run("keys are ignored without a ttl", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := newService(0)
+
+		post(s, "k-1", `{"email":"a@example.com"}`)
+		rec := post(s, "k-1", `{"email":"a@example.com","phoneNumber":"111"}`)
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(2, contacts(t, s))
+	})
+
+	t.Run("long keys are rejected", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := newService(time.Hour)
+
+		rec := post(s, strings.Repeat("k", maxIdempotencyKeyLength+1), `{"email":"a@example.com"}`)
+		assert.Equal(http.StatusBadRequest, rec.Code)
+		assert.Equal(0, contacts(t, s))
+	})
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"time"
+)
+
+const metricsNamespace = "bitespeed"
+
+// Values of the operation label of transactions.
+const (
+	txCommit   = "commit"
+	txRollback = "rollback"
+)
+
+// Values of the result label.
+const (
+	resultOK       = "ok"
+	resultError    = "error"
+	resultNotFound = "not_found"
+)
+
+// metrics are the Prometheus metrics of a service, served on /metrics. A nil *metrics records
+// nothing, so that services built without one, as in tests, need no special casing.
+type metrics struct {
+	registry *prometheus.Registry
+
+	identifyOutcomes *prometheus.CounterVec
+	storageCalls     *prometheus.HistogramVec
+	transactions     *prometheus.CounterVec
+	retries          *prometheus.CounterVec
+	retriesExhausted prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		identifyOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "identify_outcomes_total",
+			Help:      "Identify requests by what they did to the contacts: newPrimary, newSecondary, existing or merge.",
+		}, []string{"outcome"}),
+		storageCalls: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_call_duration_seconds",
+			Help:      "Duration of contact storage calls by method and result: ok, not_found or error.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "result"}),
+		transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transactions_total",
+			Help:      "Transactions ended by operation, commit or rollback, and result: ok or error.",
+		}, []string{"operation", "result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transaction_retries_total",
+			Help:      "Transactions run again after failing because of concurrent ones, by reason: serialization_failure or deadlock.",
+		}, []string{"reason"}),
+		retriesExhausted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transaction_retries_exhausted_total",
+			Help:      "Transactions given up after failing because of concurrent ones at every attempt.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.identifyOutcomes,
+		m.storageCalls,
+		m.transactions,
+		m.retries,
+		m.retriesExhausted,
+	)
+
+	// Export every outcome from the start, so that rates over them are defined before the first request.
+	for _, outcome := range []string{pkg.OutcomeNewPrimary, pkg.OutcomeNewSecondary, pkg.OutcomeExisting, pkg.OutcomeMerge} {
+		m.identifyOutcomes.WithLabelValues(outcome)
+	}
+	for _, reason := range []string{storage.RetrySerializationFailure, storage.RetryDeadlock} {
+		m.retries.WithLabelValues(reason)
+	}
+	return m
+}
+
+func (m *metrics) handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+func (m *metrics) observeIdentify(outcome string) {
+	if m == nil {
+		return
+	}
+	m.identifyOutcomes.WithLabelValues(outcome).Inc()
+}
+
+// observeStorage times a storage call of method, ended by calling the returned function.
+func (m *metrics) observeStorage(method string) func(err error) {
+	if m == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	return func(err error) {
+		m.storageCalls.WithLabelValues(method, storageResult(err)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeTransaction counts a transaction ended by operation, commit or rollback.
+func (m *metrics) observeTransaction(operation string, err error) {
+	if m == nil {
+		return
+	}
+	m.transactions.WithLabelValues(operation, result(err)).Inc()
+}
+
+// observeRetry counts a transaction run again after failing for reason, one of the storage.Retry* constants.
+func (m *metrics) observeRetry(reason string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) observeRetriesExhausted() {
+	if m == nil {
+		return
+	}
+	m.retriesExhausted.Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultOK
+}
+
+// storageResult is the result of a storage call. Finding no row is how lookups of missing
+// contacts and merges answer, so it is told apart from failures.
+func storageResult(err error) string {
+	if errors.Is(err, sql.ErrNoRows) {
+		return resultNotFound
+	}
+	return result(err)
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_Metrics(t *testing.T) {
+	assert := asserts.New(t)
+
+	cfg := NewConfig()
+	cfg.Storage = storageMemory
+	s, err := NewService(cfg)
+	assert.Nil(err)
+
+	for _, body := range []string{
+		`{"email":"a@example.com","phoneNumber":"111"}`, // newPrimary
+		`{"email":"b@example.com","phoneNumber":"111"}`, // newSecondary
+		`{"email":"a@example.com"}`,                     // existing
+		`{"email":"c@example.com","phoneNumber":"222"}`, // newPrimary
+		`{"email":"b@example.com","phoneNumber":"222"}`, // merge
+		`{"email":"abc"}`,                               // rejected before beginning a transaction
+	} {
+		serve(s, http.MethodPost, "/identify", body)
+	}
+
+	assert.Equal(2.0, testutil.ToFloat64(s.metrics.identifyOutcomes.WithLabelValues("newPrimary")))
+	assert.Equal(1.0, testutil.ToFloat64(s.metrics.identifyOutcomes.WithLabelValues("newSecondary")))
+	assert.Equal(1.0, testutil.ToFloat64(s.metrics.identifyOutcomes.WithLabelValues("existing")))
+	assert.Equal(1.0, testutil.ToFloat64(s.metrics.identifyOutcomes.WithLabelValues("merge")))
+	assert.Equal(5.0, testutil.ToFloat64(s.metrics.transactions.WithLabelValues("commit", "ok")))
+	assert.Equal(0.0, testutil.ToFloat64(s.metrics.transactions.WithLabelValues("rollback", "ok")))
+
+	// Looking up a missing contact is not a storage failure.
+	assert.Equal(http.StatusNotFound, serve(s, http.MethodGet, "/contacts/99", "").Code)
+
+	rec := serve(s, http.MethodGet, "/metrics", "")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `bitespeed_identify_outcomes_total{outcome="merge"} 1`)
+	assert.Contains(rec.Body.String(), `bitespeed_storage_call_duration_seconds_count{method="CreateContact",result="ok"} 3`)
+	assert.Contains(rec.Body.String(), `bitespeed_storage_call_duration_seconds_count{method="GetPrimaryContact",result="not_found"} 1`)
+	assert.NotContains(rec.Body.String(), `result="error"`)
+	assert.Contains(rec.Body.String(), `bitespeed_transactions_total{operation="commit",result="ok"} 5`)
+	assert.Contains(rec.Body.String(), "go_goroutines ")
+}
+
+func Test_Metrics_Nil(t *testing.T) {
+	var m *metrics
+	m.observeIdentify("merge")
+	m.observeStorage("GetContact")(nil)
+	m.observeTransaction(txCommit, nil)
+	m.observeRetry(storage.RetryDeadlock)
+	m.observeRetriesExhausted()
+
+	asserts.Equal(t, http.StatusNotFound, serve(&Service{}, http.MethodGet, "/metrics", "").Code)
+}
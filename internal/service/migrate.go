@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"io"
+)
+
+const migrateUsage = "usage: bitespeed migrate up|down|status"
+
+// Migrate runs the migrate command against the configured Postgres database.
+func Migrate(cfg *Config, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf(migrateUsage)
+	}
+
+	if cfg.Storage == storageMemory {
+		return fmt.Errorf("migrations are not supported by the %s storage backend", cfg.Storage)
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Sql.Close()
+	}()
+
+	migrator, err := storage.NewMigrator(store.Sql)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			_, _ = fmt.Fprintf(out, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			_, _ = fmt.Fprintln(out, "no pending migrations")
+		}
+	case "down":
+		reverted, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			_, _ = fmt.Fprintln(out, "no applied migrations")
+			return nil
+		}
+		_, _ = fmt.Fprintf(out, "reverted %04d_%s\n", reverted.Version, reverted.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			_, _ = fmt.Fprintf(out, "%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"github.com/harshabangi/bitespeed/internal/storage"
 	"github.com/stretchr/testify/mock"
 	"io"
@@ -11,32 +12,86 @@ type mockContactStorage struct {
 	mock.Mock
 }
 
-func (ms *mockContactStorage) ListContactsByEmailAndPhoneNumber(email string, phoneNumber string) ([]storage.Contact, error) {
+func (ms *mockContactStorage) ListContacts(ctx context.Context) ([]storage.Contact, error) {
+	args := ms.Called()
+	return args.Get(0).([]storage.Contact), args.Error(1)
+}
+
+func (ms *mockContactStorage) ListContactsByEmailAndPhoneNumber(ctx context.Context, email string, phoneNumber string) ([]storage.Contact, error) {
 	args := ms.Called(email, phoneNumber)
 	return args.Get(0).([]storage.Contact), args.Error(1)
 }
 
-func (ms *mockContactStorage) ListContactsByID(id int64) ([]storage.Contact, error) {
+func (ms *mockContactStorage) ListContactsByIdentifiers(ctx context.Context, identifiers []storage.Identifier) ([]storage.Contact, error) {
+	args := ms.Called(identifiers)
+	return args.Get(0).([]storage.Contact), args.Error(1)
+}
+
+func (ms *mockContactStorage) ListContactsByID(ctx context.Context, id int64) ([]storage.Contact, error) {
 	args := ms.Called(id)
 	return args.Get(0).([]storage.Contact), args.Error(1)
 }
 
-func (ms *mockContactStorage) GetContact(id int64) (*storage.Contact, error) {
+func (ms *mockContactStorage) GetContact(ctx context.Context, id int64) (*storage.Contact, error) {
+	args := ms.Called(id)
+	return args.Get(0).(*storage.Contact), args.Error(1)
+}
+
+func (ms *mockContactStorage) GetPrimaryContact(ctx context.Context, id int64) (*storage.Contact, error) {
 	args := ms.Called(id)
 	return args.Get(0).(*storage.Contact), args.Error(1)
 }
 
-func (ms *mockContactStorage) CreateContact(contact storage.Contact) (int64, error) {
+func (ms *mockContactStorage) FlattenCluster(ctx context.Context, primaryID int64) (int64, error) {
+	args := ms.Called(primaryID)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (ms *mockContactStorage) CreateContact(ctx context.Context, contact storage.Contact) (int64, error) {
 	args := ms.Called(contact)
 	return args.Get(0).(int64), args.Error(1)
 }
 
-func (ms *mockContactStorage) UpdateContact(id int64, contact storage.Contact) error {
+func (ms *mockContactStorage) UpdateContact(ctx context.Context, id int64, contact storage.Contact) error {
 	args := ms.Called(id, contact)
 	return args.Error(0)
 }
 
-func (ms *mockContactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(olderContactLinkedID, newerContactLinkedID int64) error {
+func (ms *mockContactStorage) UpdateEmailAndPhoneNumber(ctx context.Context, id int64, email string, phoneNumber string) error {
+	args := ms.Called(id, email, phoneNumber)
+	return args.Error(0)
+}
+
+func (ms *mockContactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx context.Context, olderContactLinkedID, newerContactLinkedID int64) error {
 	args := ms.Called(olderContactLinkedID, newerContactLinkedID)
 	return args.Error(0)
 }
+
+func (ms *mockContactStorage) PromoteContact(ctx context.Context, id int64) error {
+	args := ms.Called(id)
+	return args.Error(0)
+}
+
+func (ms *mockContactStorage) DeleteContact(ctx context.Context, id int64) error {
+	args := ms.Called(id)
+	return args.Error(0)
+}
+
+func (ms *mockContactStorage) AcquireLocks(ctx context.Context, keys ...string) error {
+	args := ms.Called(keys)
+	return args.Error(0)
+}
+
+type mockEventStorage struct {
+	mock.Mock
+}
+
+func (ms *mockEventStorage) CreateEvent(ctx context.Context, event storage.Event) (int64, error) {
+	args := ms.Called(event)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (ms *mockEventStorage) ListEventsByContactIDs(ctx context.Context, ids []int64) ([]storage.Event, error) {
+	args := ms.Called(ids)
+	return args.Get(0).([]storage.Event), args.Error(1)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"strings"
+	"time"
+)
+
+// PrimaryPolicy decides which cluster keeps its primary contact when identify merges clusters.
+// The primary contacts of the other clusters become secondary contacts of the winning one.
+type PrimaryPolicy interface {
+	// Prefer reports whether cluster a should win over cluster b. When neither is preferred
+	// over the other, the cluster with the oldest primary contact wins.
+	Prefer(a, b Cluster) bool
+}
+
+// Cluster is a primary contact along with every contact of its cluster, itself included,
+// oldest first.
+type Cluster struct {
+	Primary  *storage.Contact
+	Contacts []storage.Contact
+}
+
+// Names of the primary policies accepted in configuration.
+const (
+	policyOldest         = "oldest"
+	policyRecentActivity = "recentActivity"
+	policyVerifiedEmail  = "verifiedEmail"
+	policySourceTrust    = "sourceTrust"
+)
+
+// newPrimaryPolicy builds the policy of the given name. sources are the sources, most trusted
+// first, used by the sourceTrust policy.
+func newPrimaryPolicy(name string, sources []string) (PrimaryPolicy, error) {
+	switch strings.TrimSpace(name) {
+	case "", policyOldest:
+		return OldestPolicy{}, nil
+	case policyRecentActivity:
+		return RecentActivityPolicy{}, nil
+	case policyVerifiedEmail:
+		return VerifiedEmailPolicy{}, nil
+	case policySourceTrust:
+		if len(sources) == 0 {
+			return nil, fmt.Errorf("the %s primary policy requires a list of sources", policySourceTrust)
+		}
+		return NewSourceTrustPolicy(sources...), nil
+	default:
+		return nil, fmt.Errorf("unknown primary policy: %s", name)
+	}
+}
+
+// OldestPolicy keeps the oldest primary contact, so that the primary of a customer never changes
+// once created unless it is deleted.
+type OldestPolicy struct{}
+
+func (OldestPolicy) Prefer(a, b Cluster) bool {
+	return isOlderContact(*a.Primary, *b.Primary)
+}
+
+// RecentActivityPolicy keeps the cluster the customer was seen in last, that is the one whose
+// newest contact was created most recently.
+type RecentActivityPolicy struct{}
+
+func (RecentActivityPolicy) Prefer(a, b Cluster) bool {
+	seenA, seenB := lastSeen(a), lastSeen(b)
+	return seenA != nil && (seenB == nil || seenA.After(*seenB))
+}
+
+// VerifiedEmailPolicy keeps a cluster with a verified email over one without any.
+type VerifiedEmailPolicy struct{}
+
+func (VerifiedEmailPolicy) Prefer(a, b Cluster) bool {
+	return hasVerifiedEmail(a) && !hasVerifiedEmail(b)
+}
+
+// SourceTrustPolicy keeps the cluster with a contact from the most trusted source. Sources
+// missing from the list are trusted least.
+type SourceTrustPolicy struct {
+	trust map[string]int
+}
+
+// NewSourceTrustPolicy returns the policy trusting the given sources, most trusted first.
+func NewSourceTrustPolicy(sources ...string) *SourceTrustPolicy {
+	trust := make(map[string]int, len(sources))
+	for i, source := range sources {
+		if _, ok := trust[source]; !ok {
+			trust[source] = len(sources) - i
+		}
+	}
+	return &SourceTrustPolicy{trust: trust}
+}
+
+func (p *SourceTrustPolicy) Prefer(a, b Cluster) bool {
+	return p.clusterTrust(a) > p.clusterTrust(b)
+}
+
+func (p *SourceTrustPolicy) clusterTrust(c Cluster) int {
+	var trust int
+	for _, contact := range c.Contacts {
+		if t := p.trust[contact.Source]; t > trust {
+			trust = t
+		}
+	}
+	return trust
+}
+
+// lastSeen returns when the newest contact of a cluster was created.
+func lastSeen(c Cluster) *time.Time {
+	var latest *time.Time
+	for _, contact := range c.Contacts {
+		if contact.CreatedAt != nil && (latest == nil || contact.CreatedAt.After(*latest)) {
+			latest = contact.CreatedAt
+		}
+	}
+	return latest
+}
+
+func hasVerifiedEmail(c Cluster) bool {
+	for _, contact := range c.Contacts {
+		if contact.EmailVerified && contact.Email != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// preferCluster reports whether cluster a wins over cluster b under policy, falling back to the
+// oldest primary contact when the policy prefers neither. A nil policy prefers neither.
+func preferCluster(policy PrimaryPolicy, a, b Cluster) bool {
+	if policy != nil {
+		if policy.Prefer(a, b) {
+			return true
+		}
+		if policy.Prefer(b, a) {
+			return false
+		}
+	}
+	return isOlderContact(*a.Primary, *b.Primary)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_MergeLinkage_PrimaryPolicies(t *testing.T) {
+	t0 := time.Now()
+	t1, t2, t3 := t0.Add(time.Second), t0.Add(2*time.Second), t0.Add(3*time.Second)
+
+	newCluster := func(contacts ...storage.Contact) Cluster {
+		contacts[0].LinkPrecedence = primaryContact
+		for i := range contacts[1:] {
+			contacts[i+1].LinkedID = contacts[0].ID
+			contacts[i+1].LinkPrecedence = secondaryContact
+		}
+		return Cluster{Primary: &contacts[0], Contacts: contacts}
+	}
+
+	// Cluster 1 is the oldest, cluster 2 was seen last and came from the web shop with a verified
+	// email, cluster 3 came from the point of sale.
+	clusters := func() []Cluster {
+		return []Cluster{
+			newCluster(storage.Contact{ID: 3, CreatedAt: &t2, Source: "pos"}),
+			newCluster(storage.Contact{ID: 2, CreatedAt: &t1}, storage.Contact{ID: 4, Email: "b@example.com", EmailVerified: true, Source: "web", CreatedAt: &t3}),
+			newCluster(storage.Contact{ID: 1, CreatedAt: &t0}),
+		}
+	}
+
+	tcc := []struct {
+		name       string
+		policy     PrimaryPolicy
+		wantMerged []int64
+		wantID     int64
+	}{
+		{"default", nil, []int64{2, 3}, 1},
+		{"oldest", OldestPolicy{}, []int64{2, 3}, 1},
+		{"recent activity", RecentActivityPolicy{}, []int64{3, 1}, 2},
+		{"verified email", VerifiedEmailPolicy{}, []int64{1, 3}, 2},
+		{"source trust", NewSourceTrustPolicy("pos", "web"), []int64{2, 1}, 3},
+		{"unknown sources trusted least", NewSourceTrustPolicy("web"), []int64{1, 3}, 2},
+	}
+	for _, tc := range tcc {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := asserts.New(t)
+
+			l := mergeLinkage(tc.policy, clusters())
+			assert.Equal(pkg.OutcomeMerge, l.outcome)
+			assert.Equal(tc.wantID, l.primaryID)
+			assert.Equal(tc.wantID, l.primary.ID)
+
+			var merged []int64
+			for _, c := range l.merged {
+				merged = append(merged, c.ID)
+			}
+			assert.Equal(tc.wantMerged, merged)
+		})
+	}
+}
+
+func Test_NewPrimaryPolicy(t *testing.T) {
+	assert := asserts.New(t)
+
+	p, err := newPrimaryPolicy("", nil)
+	assert.Nil(err)
+	assert.Equal(OldestPolicy{}, p)
+
+	p, err = newPrimaryPolicy("verifiedEmail", nil)
+	assert.Nil(err)
+	assert.Equal(VerifiedEmailPolicy{}, p)
+
+	p, err = newPrimaryPolicy("sourceTrust", []string{"pos", "web"})
+	assert.Nil(err)
+	assert.Equal(NewSourceTrustPolicy("pos", "web"), p)
+
+	_, err = newPrimaryPolicy("sourceTrust", nil)
+	assert.EqualError(err, "the sourceTrust primary policy requires a list of sources")
+
+	_, err = newPrimaryPolicy("newest", nil)
+	assert.EqualError(err, "unknown primary policy: newest")
+}
+
+func Test_Identify_PrimaryPolicy(t *testing.T) {
+	assert := asserts.New(t)
+	s := newTestService()
+	s.policy = VerifiedEmailPolicy{}
+
+	var res string
+	for _, body := range []string{
+		`{"phoneNumber":"111"}`,
+		`{"email":"b@example.com","emailVerified":true}`,
+		`{"email":"b@example.com","phoneNumber":"111"}`,
+	} {
+		rec := serve(s, http.MethodPost, "/identify", body)
+		assert.Equal(http.StatusOK, rec.Code)
+		res = responseBody(rec)
+	}
+
+	// The newer cluster wins since only it has a verified email.
+	assert.Equal(`{"contact":{"primaryContactId":2,"emails":["b@example.com"],"phoneNumbers":["111"],"secondaryContactIds":[1]}}`, res)
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"io"
+)
+
+const renormalizeUsage = "usage: bitespeed renormalize [--dry-run]"
+
+var errNotNormalized = errors.New("contacts could not be normalized")
+
+// Renormalize runs the renormalize command, which normalizes the email and phone number of every
+// contact of the configured Postgres database again from the values as received, with the
+// normalization settings of cfg. It is meant to be run after changing them, so that existing
+// contacts match the requests normalized with the new settings.
+func Renormalize(cfg *Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("renormalize", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	dryRun := flags.Bool("dry-run", false, "list the changes without making them")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return fmt.Errorf(renormalizeUsage)
+	}
+
+	if cfg.Storage == storageMemory {
+		return fmt.Errorf("renormalize is not supported by the %s storage backend", cfg.Storage)
+	}
+
+	normalizer, err := newNormalizer(cfg.EmailNormalizationRules, cfg.PhoneDefaultRegion)
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Sql.Close()
+	}()
+
+	return renormalize(context.Background(), store, normalizer, *dryRun, out)
+}
+
+// normalization is the new email and phone number of a contact.
+type normalization struct {
+	contact     storage.Contact
+	email       string
+	phoneNumber string
+}
+
+// renormalize lists the contacts whose email or phone number changes once normalized again by n
+// and, unless dryRun, updates them in a single transaction. Contacts whose values as received
+// are rejected by n are reported and left unchanged.
+func renormalize(ctx context.Context, s *storage.Store, n *pkg.Normalizer, dryRun bool, out io.Writer) error {
+	opts := writeTxOptions
+	if dryRun {
+		opts = readOnlyTxOptions
+	}
+
+	tx, err := s.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var (
+		changes  []normalization
+		failures []error
+	)
+	if dryRun {
+		var contacts []storage.Contact
+		if contacts, err = tx.Contact.ListContacts(ctx); err == nil {
+			changes, failures = normalizations(n, contacts)
+		}
+	} else {
+		changes, failures, err = lockNormalizations(ctx, tx, n)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range failures {
+		_, _ = fmt.Fprintln(out, f)
+	}
+	for _, c := range changes {
+		_, _ = fmt.Fprintf(out, "contact %d: email %q -> %q, phone number %q -> %q\n",
+			c.contact.ID, c.contact.Email, c.email, c.contact.PhoneNumber, c.phoneNumber)
+	}
+
+	if !dryRun {
+		for _, c := range changes {
+			if err := tx.Contact.UpdateEmailAndPhoneNumber(ctx, c.contact.ID, c.email, c.phoneNumber); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case dryRun:
+		_, _ = fmt.Fprintf(out, "%d contacts to normalize\n", len(changes))
+	case len(changes) > 0:
+		_, _ = fmt.Fprintf(out, "normalized %d contacts; run bitespeed fsck --fix to merge the clusters now sharing an identifier\n", len(changes))
+	default:
+		_, _ = fmt.Fprintln(out, "no contacts to normalize")
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%w: %d contacts", errNotNormalized, len(failures))
+	}
+	return nil
+}
+
+// normalizations returns the contacts whose email or phone number changes once normalized again
+// from the values as received, and the errors of those whose values are rejected by n. Contacts
+// created before the values as received were kept have them set to their stored values.
+func normalizations(n *pkg.Normalizer, contacts []storage.Contact) ([]normalization, []error) {
+	var (
+		changes  []normalization
+		failures []error
+	)
+
+	for _, c := range contacts {
+		rawEmail, rawPhoneNumber := c.RawEmail, c.RawPhoneNumber
+		if rawEmail == "" {
+			rawEmail = c.Email
+		}
+		if rawPhoneNumber == "" {
+			rawPhoneNumber = c.PhoneNumber
+		}
+
+		phoneNumber, err := n.NormalizePhoneNumber(rawPhoneNumber)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("contact %d: %w", c.ID, err))
+			continue
+		}
+		email := n.NormalizeEmail(rawEmail)
+
+		if email != c.Email || phoneNumber != c.PhoneNumber {
+			changes = append(changes, normalization{contact: c, email: email, phoneNumber: phoneNumber})
+		}
+	}
+	return changes, failures
+}
+
+// lockNormalizations returns the normalizations of the contacts once the clusters of the
+// contacts changing are locked, along with their identifiers before and after the change, so
+// that no request reads or writes them concurrently. As with lockAndListContacts, the contacts
+// are read again until everything that needs locking is locked.
+func lockNormalizations(ctx context.Context, s *storage.Store, n *pkg.Normalizer) ([]normalization, []error, error) {
+	locked := make(map[string]bool)
+
+	for {
+		contacts, err := s.Contact.ListContacts(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes, failures := normalizations(n, contacts)
+
+		var keys []string
+		lock := func(key string) {
+			if !locked[key] {
+				locked[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		for _, c := range changes {
+			lock(contactLockKey(primaryIDOf(c.contact)))
+			changed := c.contact
+			changed.Email, changed.PhoneNumber = c.email, c.phoneNumber
+			for _, key := range identifierLockKeys(append(contactIdentifiers(c.contact), contactIdentifiers(changed)...)) {
+				lock(key)
+			}
+		}
+
+		if len(keys) == 0 {
+			return changes, failures, nil
+		}
+		if err := s.Contact.AcquireLocks(ctx, keys...); err != nil {
+			return nil, nil, err
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_Renormalize(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := storage.NewMemory()
+
+	for _, c := range []storage.Contact{
+		// 1: normalized before the default region and the gmail rule were set.
+		{Email: "john.doe@gmail.com", PhoneNumber: "9876543210", RawEmail: "John.Doe@Gmail.com", RawPhoneNumber: "98765 43210", LinkPrecedence: primaryContact},
+		// 2: created before the values as received were kept.
+		{PhoneNumber: "9876543211", LinkedID: 1, LinkPrecedence: secondaryContact},
+		// 3: already normalized.
+		{Email: "a@example.com", PhoneNumber: "+919876543212", RawEmail: "a@example.com", RawPhoneNumber: "+91 98765 43212", LinkPrecedence: primaryContact},
+		// 4: rejected by the default region.
+		{PhoneNumber: "12", RawPhoneNumber: "12", LinkPrecedence: primaryContact},
+	} {
+		_, err := s.Contact.CreateContact(ctx, c)
+		assert.Nil(err)
+	}
+
+	n := pkg.NewNormalizer().WithDefaultRegion("IN").WithEmailRules(pkg.GmailRule{})
+
+	var out bytes.Buffer
+	err := renormalize(ctx, s, n, true, &out)
+	assert.ErrorIs(err, errNotNormalized)
+	assert.Equal(`contact 4: incorrect phone number: 12
+contact 1: email "john.doe@gmail.com" -> "johndoe@gmail.com", phone number "9876543210" -> "+919876543210"
+contact 2: email "" -> "", phone number "9876543211" -> "+919876543211"
+2 contacts to normalize
+`, out.String())
+
+	c, err := s.Contact.GetContact(ctx, 1)
+	assert.Nil(err)
+	assert.Equal("9876543210", c.PhoneNumber)
+
+	out.Reset()
+	err = renormalize(ctx, s, n, false, &out)
+	assert.ErrorIs(err, errNotNormalized)
+	assert.Contains(out.String(), "normalized 2 contacts")
+
+	// Requests normalized with the new settings match the existing contacts.
+	contacts, err := s.Contact.ListContactsByEmailAndPhoneNumber(ctx, "johndoe@gmail.com", "+919876543211")
+	assert.Nil(err)
+	if assert.Equal(2, len(contacts)) {
+		assert.Equal(int64(1), contacts[0].ID)
+		assert.Equal("John.Doe@Gmail.com", contacts[0].RawEmail)
+		assert.Equal(int64(2), contacts[1].ID)
+	}
+
+	out.Reset()
+	err = renormalize(ctx, s, n, false, &out)
+	assert.ErrorIs(err, errNotNormalized)
+	assert.Equal("contact 4: incorrect phone number: 12\nno contacts to normalize\n", out.String())
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// A transaction failing because of concurrent ones is run up to maxTxAttempts times in all. Before
+// running it again, a random delay of up to retryBackoff is waited, doubled after every attempt and
+// capped at maxRetryBackoff.
+const (
+	maxTxAttempts   = 5
+	retryBackoff    = 10 * time.Millisecond
+	maxRetryBackoff = 200 * time.Millisecond
+)
+
+// inTransaction runs fn with the store of a transaction begun with opts, and the context of the
+// transaction. The transaction is committed once fn succeeds, and rolled back otherwise.
+func (s *Service) inTransaction(ctx context.Context, opts *sql.TxOptions, fn func(ctx context.Context, store *storage.Store) error) error {
+	tx, err := s.beginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx.ctx, tx.store); err != nil {
+		if rollBackErr := tx.Rollback(); rollBackErr != nil {
+			log.Printf("WARNING: error rolling back transaction: %+v", rollBackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryTransaction runs fn as inTransaction does. When fn or the commit fails because of
+// concurrent transactions, as told by storage.Retryable, fn is run again from the start in a new
+// transaction, until maxTxAttempts attempts failed or ctx is done. fn must have no effect besides
+// its statements.
+func (s *Service) retryTransaction(ctx context.Context, opts *sql.TxOptions, fn func(ctx context.Context, store *storage.Store) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.inTransaction(ctx, opts, fn)
+		reason, ok := storage.Retryable(err)
+		if !ok {
+			return err
+		}
+		if attempt == maxTxAttempts {
+			s.metrics.observeRetriesExhausted()
+			return err
+		}
+
+		s.metrics.observeRetry(reason)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("bitespeed.retry.reason", reason),
+			attribute.Int("bitespeed.retry.attempt", attempt+1),
+		))
+
+		timer := time.NewTimer(retryDelay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// retryDelay returns the delay to wait after the given failed attempt. It is drawn at random so
+// that the transactions which conflicted are not run again in lockstep.
+func retryDelay(attempt int) time.Duration {
+	d := retryBackoff << (attempt - 1)
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
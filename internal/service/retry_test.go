@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	asserts "github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func Test_IdentifyInTransaction_Retry(t *testing.T) {
+	ctx := context.Background()
+	req := pkg.ContactRequest{Email: "a@example.com", PhoneNumber: "111"}
+
+	// newService returns a service on a database failing the statements fail is called with,
+	// counting how many times each kind of statement is run.
+	newService := func(t *testing.T, fail func(statement string, runs int) error) *Service {
+		runs := make(map[string]int)
+		d := &fakeDriver{fail: func(statement string) error {
+			kind := strings.Fields(statement)[0]
+			runs[kind]++
+			return fail(statement, runs[kind])
+		}}
+		db := sql.OpenDB(d)
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+		return &Service{storage: &storage.Store{Sql: db}, normalizer: pkg.NewNormalizer(), metrics: newMetrics()}
+	}
+
+	t.Run("conflicts are retried", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		// The first attempt deadlocks, and the second one fails to commit.
+		s := newService(t, func(statement string, runs int) error {
+			switch {
+			case strings.HasPrefix(statement, "SELECT pg_advisory_xact_lock") && runs == 1:
+				return &pq.Error{Code: "40P01"}
+			case statement == "COMMIT" && runs == 1:
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		})
+
+		res, _, err := identifyInTransaction(ctx, s, req, false, nil)
+		assert.Nil(err)
+		if assert.NotNil(res) {
+			// Ids 1 and 2 went to the contact and event of the attempt failing to commit.
+			assert.Equal(int64(3), res.Contact.PrimaryContactID)
+		}
+
+		m := s.metrics
+		assert.Equal(1.0, testutil.ToFloat64(m.retries.WithLabelValues(storage.RetryDeadlock)))
+		assert.Equal(1.0, testutil.ToFloat64(m.retries.WithLabelValues(storage.RetrySerializationFailure)))
+		assert.Equal(0.0, testutil.ToFloat64(m.retriesExhausted))
+		assert.Equal(1.0, testutil.ToFloat64(m.transactions.WithLabelValues(txRollback, resultOK)))
+		assert.Equal(1.0, testutil.ToFloat64(m.transactions.WithLabelValues(txCommit, resultError)))
+		assert.Equal(1.0, testutil.ToFloat64(m.transactions.WithLabelValues(txCommit, resultOK)))
+		assert.Equal(1.0, testutil.ToFloat64(m.identifyOutcomes.WithLabelValues(pkg.OutcomeNewPrimary)))
+	})
+
+	t.Run("conflicts are given up after the last attempt", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		s := newService(t, func(statement string, _ int) error {
+			if statement == "COMMIT" {
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		})
+
+		_, _, err := identifyInTransaction(ctx, s, req, false, nil)
+		reason, ok := storage.Retryable(err)
+		assert.True(ok)
+		assert.Equal(storage.RetrySerializationFailure, reason)
+
+		m := s.metrics
+		assert.Equal(float64(maxTxAttempts-1), testutil.ToFloat64(m.retries.WithLabelValues(storage.RetrySerializationFailure)))
+		assert.Equal(1.0, testutil.ToFloat64(m.retriesExhausted))
+		assert.Equal(float64(maxTxAttempts), testutil.ToFloat64(m.transactions.WithLabelValues(txCommit, resultError)))
+		assert.Equal(0.0, testutil.ToFloat64(m.identifyOutcomes.WithLabelValues(pkg.OutcomeNewPrimary)))
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		failure := errors.New("disk full")
+		s := newService(t, func(statement string, _ int) error {
+			if strings.HasPrefix(statement, "INSERT") {
+				return failure
+			}
+			return nil
+		})
+
+		_, _, err := identifyInTransaction(ctx, s, req, false, nil)
+		assert.Equal(failure, err)
+
+		m := s.metrics
+		assert.Equal(0.0, testutil.ToFloat64(m.retries.WithLabelValues(storage.RetrySerializationFailure)))
+		assert.Equal(0.0, testutil.ToFloat64(m.retries.WithLabelValues(storage.RetryDeadlock)))
+		assert.Equal(1.0, testutil.ToFloat64(m.transactions.WithLabelValues(txRollback, resultOK)))
+	})
+
+	t.Run("waiting for a retry stops with the context", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		ctx, cancel := context.WithCancel(ctx)
+		s := newService(t, func(statement string, _ int) error {
+			if statement == "COMMIT" {
+				cancel()
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		})
+
+		_, _, err := identifyInTransaction(ctx, s, req, false, nil)
+		assert.Equal(context.Canceled, err)
+		assert.Equal(1.0, testutil.ToFloat64(s.metrics.transactions.WithLabelValues(txCommit, resultError)))
+	})
+}
+
+func Test_RetryDelay(t *testing.T) {
+	assert := asserts.New(t)
+
+	for attempt := 1; attempt < 10; attempt++ {
+		limit := retryBackoff << (attempt - 1)
+		if limit > maxRetryBackoff {
+			limit = maxRetryBackoff
+		}
+		for i := 0; i < 100; i++ {
+			d := retryDelay(attempt)
+			assert.True(d > 0 && d <= limit, "delay %s after attempt %d is not in (0, %s]", d, attempt, limit)
+		}
+	}
+}
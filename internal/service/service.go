@@ -1,51 +1,196 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/harshabangi/bitespeed/docs"
 	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
 	"github.com/labstack/echo/v4"
 	echoSwagger "github.com/swaggo/echo-swagger"
-	"golang.org/x/net/context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-type Config struct {
-	UserName   string `json:"user"`
-	Password   string `json:"password"`
-	Database   string `json:"database"`
-	Host       string `json:"host"`
-	ListenAddr string `json:"listen_addr"`
+type Service struct {
+	config     *Config
+	storage    *storage.Store
+	normalizer *pkg.Normalizer
+	policy     PrimaryPolicy
+	metrics    *metrics
+	tracing    *tracing
+
+	// shuttingDown is set once shutdown starts, failing readiness probes.
+	shuttingDown atomic.Bool
 }
 
-func NewConfig() *Config {
-	return &Config{}
+const (
+	storagePostgres = "postgres"
+	storageMemory   = "memory"
+)
+
+func NewService(cfg *Config) (*Service, error) {
+	normalizer, err := newNormalizer(cfg.EmailNormalizationRules, cfg.PhoneDefaultRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := newPrimaryPolicy(cfg.PrimaryPolicy, cfg.PrimaryPolicySources)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newTracing(cfg.OTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		config:     cfg,
+		storage:    store,
+		normalizer: normalizer,
+		policy:     policy,
+		metrics:    newMetrics(),
+		tracing:    t,
+	}
+	store.SetObserver(s.observeStorage)
+	return s, nil
 }
 
-type Service struct {
-	storage *storage.Store
+// newNormalizer builds the normalizer from a list of email rule names (see pkg.EmailRules)
+// and the region assumed for phone numbers without a country code.
+func newNormalizer(emailRules []string, phoneDefaultRegion string) (*pkg.Normalizer, error) {
+	normalizer := pkg.NewNormalizer()
+
+	for _, name := range emailRules {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rule, ok := pkg.EmailRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown email normalization rule: %s", name)
+		}
+		normalizer.WithEmailRules(rule)
+	}
+
+	if phoneDefaultRegion != "" {
+		if !pkg.SupportedRegion(phoneDefaultRegion) {
+			return nil, fmt.Errorf("unknown phone default region: %s", phoneDefaultRegion)
+		}
+		normalizer.WithDefaultRegion(phoneDefaultRegion)
+	}
+	return normalizer, nil
 }
 
-func NewService() (*Service, error) {
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	host := os.Getenv("DB_HOST")
-	database := os.Getenv("DB_NAME")
+func newStore(cfg *Config) (*storage.Store, error) {
+	switch cfg.Storage {
+	case "", storagePostgres:
+		store, err := storage.New(cfg.postgresConfig())
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to database: %w", err)
+		}
+		return store, nil
+	case storageMemory:
+		return storage.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Storage)
+	}
+}
+
+// Run serves the API until the process receives SIGINT or SIGTERM, then shuts down gracefully.
+func (s *Service) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	store, err := storage.New(user, password, host, database)
+	l, err := net.Listen("tcp", s.config.ListenAddr)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to database: %w", err)
+		_ = s.close()
+		return err
+	}
+
+	e := s.Router()
+	e.Server.ReadTimeout = s.config.ReadTimeout
+	e.Server.WriteTimeout = s.config.WriteTimeout
+	return s.serve(ctx, e, l)
+}
+
+// serve serves e on l until ctx is done. It then fails readiness probes for the shutdown delay,
+// giving the orchestrator time to stop routing requests here, before it stops accepting
+// connections and waits for the requests in flight, along with their transactions, to finish.
+// Requests still running after the shutdown timeout have their connections closed. The store
+// and the tracing are closed last.
+func (s *Service) serve(ctx context.Context, e *echo.Echo, l net.Listener) error {
+	e.Listener = l
+
+	served := make(chan error, 1)
+	go func() {
+		served <- e.Start("")
+	}()
+
+	select {
+	case err := <-served:
+		_ = s.close()
+		return err
+	case <-ctx.Done():
+	}
+
+	s.shuttingDown.Store(true)
+	if s.config.ShutdownDelay > 0 {
+		log.Printf("shutting down in %s", s.config.ShutdownDelay)
+		time.Sleep(s.config.ShutdownDelay)
+	}
+
+	shutdownCtx := context.Background()
+	if s.config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, s.config.ShutdownTimeout)
+		defer cancel()
+	}
+
+	log.Printf("shutting down, waiting for requests in flight")
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("WARNING: closing connections of requests still in flight: %+v", err)
+		_ = e.Close()
 	}
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("WARNING: error serving requests: %+v", err)
+	}
+
+	return s.close()
+}
 
-	return &Service{
-		storage: store,
-	}, nil
+// tracingShutdownTimeout bounds the time spent exporting the last spans on shutdown.
+const tracingShutdownTimeout = 5 * time.Second
+
+// close closes the store and exports the spans not exported yet.
+func (s *Service) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := s.tracing.shutdown(ctx); err != nil {
+		log.Printf("WARNING: error exporting spans: %+v", err)
+	}
+	return s.storage.Close()
 }
 
-func (s *Service) Run() {
+// Router returns the HTTP handler serving every route of the service.
+func (s *Service) Router() *echo.Echo {
 	e := echo.New()
 
 	// Register app (*App) to be injected into all HTTP handlers.
@@ -55,22 +200,91 @@ func (s *Service) Run() {
 			return next(c)
 		}
 	})
+	e.Use(traceRequests)
+	e.Use(s.limitRequestTime)
 
 	e.GET("/swagger/*", echoSwagger.WrapHandler)
-	e.POST("/identify", transactionMiddleWare(identify))
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", readyz)
+	if s.metrics != nil {
+		e.GET("/metrics", s.metrics.handler())
+	}
+	e.POST("/identify", identify)
+	e.POST("/identify/lookup", readOnlyTransactionMiddleWare(lookup))
+	e.POST("/identify/batch", identifyBatch)
+	e.GET("/contacts/:id", readOnlyTransactionMiddleWare(getContact))
+	e.GET("/contacts/:id/history", readOnlyTransactionMiddleWare(getContactHistory))
+	e.DELETE("/contacts/:id", transactionMiddleWare(deleteContact))
+	e.POST("/unmerge", transactionMiddleWare(unmerge))
+	return e
+}
+
+// limitRequestTime gives every request the configured deadline. The database work of a request
+// still running at its deadline, or once its client goes away, is canceled.
+func (s *Service) limitRequestTime(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.config == nil || s.config.RequestTimeout <= 0 {
+			return next(c)
+		}
 
-	e.Logger.Fatal(e.Start(os.Getenv("LISTEN_ADDR")))
+		ctx, cancel := context.WithTimeout(c.Request().Context(), s.config.RequestTimeout)
+		defer cancel()
+		c.SetRequest(c.Request().WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			if ctxErr := contextError(ctx); ctxErr != nil {
+				return ctxErr
+			}
+		}
+		return err
+	}
 }
 
+// contextError returns the error answering a request whose ctx is done: 503 once its deadline
+// passed, or the cancellation error once its client went away. It returns nil while ctx is not done.
+func contextError(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "request timed out")
+	default:
+		return err
+	}
+}
+
+// Read committed gives every statement a fresh snapshot, so the rows read after
+// acquiring a lock in lockAndListContacts reflect all commits made under that lock.
+var writeTxOptions = &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+
 func transactionMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+	return withTransaction(writeTxOptions, next)
+}
+
+// Repeatable read gives every statement of a read only transaction the same snapshot,
+// so that it never observes a cluster halfway through a merge.
+var readOnlyTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// readOnlyTransactionMiddleWare runs handlers that only read contacts.
+func readOnlyTransactionMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+	return withTransaction(readOnlyTxOptions, next)
+}
+
+func withTransaction(opts *sql.TxOptions, next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		s := c.Get("service").(*Service)
 
-		tx, err := s.storage.BeginTx(context.Background(), &sql.TxOptions{})
+		tx, err := s.beginTx(c.Request().Context(), opts)
 		if err != nil {
+			if err := contextError(c.Request().Context()); err != nil {
+				return err
+			}
 			return c.String(http.StatusInternalServerError, "Failed to start transaction")
 		}
 
+		// The handler runs in the span of the transaction, with the store of the transaction. The
+		// store of the service is never used by handlers, so that concurrent requests stay isolated.
+		c.SetRequest(c.Request().WithContext(tx.ctx))
+		c.Set("store", tx.store)
 		err = next(c)
 
 		if err != nil {
@@ -81,8 +295,58 @@ func transactionMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		if err = tx.Commit(); err != nil {
+			if err := contextError(tx.ctx); err != nil {
+				return err
+			}
 			return c.String(http.StatusInternalServerError, "Failed to commit transaction")
 		}
 		return nil
 	}
 }
+
+// transaction is a transaction of the store, traced by a span and counted in the metrics.
+type transaction struct {
+	s     *Service
+	store *storage.Store
+	span  trace.Span
+
+	// ctx is the context the transaction was begun with, carrying its span. The statements of
+	// the transaction are run with it.
+	ctx context.Context
+}
+
+// beginTx begins a transaction in a span, child of the span of ctx. The transaction is rolled
+// back, and its statements canceled, once ctx is done.
+func (s *Service) beginTx(ctx context.Context, opts *sql.TxOptions) (*transaction, error) {
+	ctx, span := s.tracing.start(ctx, "transaction", trace.WithAttributes(
+		attribute.String("db.transaction.isolation", opts.Isolation.String()),
+		attribute.Bool("db.transaction.read_only", opts.ReadOnly),
+	))
+
+	store, err := s.storage.BeginTx(ctx, opts)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &transaction{s: s, store: store, span: span, ctx: ctx}, nil
+}
+
+func (t *transaction) Commit() error {
+	return t.end(txCommit, t.store.Commit())
+}
+
+func (t *transaction) Rollback() error {
+	err := t.store.Rollback()
+	// database/sql rolls back transactions by itself once their context is done.
+	if errors.Is(err, sql.ErrTxDone) && t.ctx.Err() != nil {
+		err = nil
+	}
+	return t.end(txRollback, err)
+}
+
+func (t *transaction) end(operation string, err error) error {
+	t.s.metrics.observeTransaction(operation, err)
+	t.span.SetAttributes(attribute.String("db.transaction.end", operation))
+	endSpan(t.span, err)
+	return err
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	asserts "github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowServer serves a service with a /slow route that identifies a contact once released.
+type slowServer struct {
+	s       *Service
+	addr    string
+	started chan struct{}
+	release chan struct{}
+	stop    context.CancelFunc
+	done    chan error
+}
+
+func serveSlow(t *testing.T, cfg *Config) *slowServer {
+	srv := &slowServer{
+		s:       newTestService(),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		done:    make(chan error, 1),
+	}
+
+	srv.s.config = cfg
+
+	e := srv.s.Router()
+	e.HideBanner, e.HidePort = true, true
+	e.POST("/slow", func(c echo.Context) error {
+		close(srv.started)
+		<-srv.release
+		return identify(c)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.addr = l.Addr().String()
+
+	var ctx context.Context
+	ctx, srv.stop = context.WithCancel(context.Background())
+	go func() {
+		srv.done <- srv.s.serve(ctx, e, l)
+	}()
+	return srv
+}
+
+// post sends a request to /slow, returning its response or nil if it failed.
+func (srv *slowServer) post() <-chan *http.Response {
+	res := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post("http://"+srv.addr+"/slow", echo.MIMEApplicationJSON, strings.NewReader(`{"email":"a@example.com"}`))
+		if err != nil {
+			res <- nil
+			return
+		}
+		_ = resp.Body.Close()
+		res <- resp
+	}()
+	return res
+}
+
+func Test_Serve_GracefulShutdown(t *testing.T) {
+	ctx := context.Background()
+	t.Run("requests in flight finish", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv := serveSlow(t, &Config{ShutdownTimeout: time.Minute})
+
+		res := srv.post()
+		<-srv.started
+		srv.stop()
+
+		// New connections are refused while the request in flight is still running.
+		assert.Eventually(func() bool {
+			conn, err := net.Dial("tcp", srv.addr)
+			if err == nil {
+				_ = conn.Close()
+			}
+			return err != nil
+		}, time.Second, 10*time.Millisecond)
+
+		select {
+		case <-srv.done:
+			t.Fatal("serve returned before the request in flight finished")
+		default:
+		}
+
+		close(srv.release)
+		resp := <-res
+		if assert.NotNil(resp) {
+			assert.Equal(http.StatusOK, resp.StatusCode)
+		}
+		assert.Nil(<-srv.done)
+
+		// The request's transaction was committed.
+		tx, err := srv.s.storage.BeginTx(context.Background(), &sql.TxOptions{})
+		assert.Nil(err)
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		c, err := tx.Contact.GetContact(ctx, 1)
+		assert.Nil(err)
+		assert.Equal("a@example.com", c.Email)
+	})
+
+	t.Run("readiness fails during the shutdown delay", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv := serveSlow(t, &Config{ShutdownDelay: time.Minute, ShutdownTimeout: time.Minute})
+
+		res := srv.post()
+		<-srv.started
+		srv.stop()
+
+		assert.Eventually(func() bool {
+			resp, err := http.Get("http://" + srv.addr + "/readyz")
+			if err != nil {
+				return false
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode == http.StatusServiceUnavailable
+		}, time.Second, 10*time.Millisecond)
+
+		close(srv.release)
+		resp := <-res
+		if assert.NotNil(resp) {
+			assert.Equal(http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("requests still running after the shutdown timeout are cut off", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv := serveSlow(t, &Config{ShutdownTimeout: 50 * time.Millisecond})
+		defer close(srv.release)
+
+		res := srv.post()
+		<-srv.started
+		srv.stop()
+
+		assert.Nil(<-srv.done)
+		assert.Nil(<-res)
+	})
+}
+
+func Test_RequestTimeout(t *testing.T) {
+	assert := asserts.New(t)
+
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+	defer func() { _ = db.Close() }()
+
+	// Locking the identifiers outlasts the deadline, and is canceled by it.
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock")).WillDelayFor(time.Minute).WillReturnResult(sqlMock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	s := &Service{
+		config:     &Config{RequestTimeout: 20 * time.Millisecond},
+		storage:    &storage.Store{Sql: db},
+		normalizer: pkg.NewNormalizer(),
+	}
+
+	start := time.Now()
+	rec := serve(s, http.MethodPost, "/identify", `{"email":"a@example.com"}`)
+	assert.Less(time.Since(start), time.Minute/2)
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(`{"message":"request timed out"}`, responseBody(rec))
+	// database/sql rolls back a transaction whose context is done in the background.
+	assert.Eventually(func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tracerName is the instrumentation scope of the spans of the service.
+const tracerName = "github.com/harshabangi/bitespeed"
+
+// propagator reads the W3C trace context of incoming requests, so that their spans continue
+// the trace of the caller.
+var propagator = propagation.TraceContext{}
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// untracedRoutes are polled by orchestrators and scrapers, and would only add noise.
+var untracedRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// tracing exports the spans of the service to an OTLP collector. A nil *tracing exports nothing,
+// though the trace context of requests is still propagated.
+type tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracing exports spans to the OTLP/HTTP collector at endpoint, a base URL such as
+// http://localhost:4318. Tracing is disabled when endpoint is empty.
+func newTracing(endpoint string) (*tracing, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	opts, err := otlpOptions(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("bitespeed"))),
+	)
+	return &tracing{provider: provider, tracer: provider.Tracer(tracerName)}, nil
+}
+
+// otlpOptions sends spans to the /v1/traces path of the endpoint, as the OTLP specification
+// does for base URLs.
+func otlpOptions(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("incorrect OTLP endpoint: %s", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return opts, nil
+}
+
+func (t *tracing) start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return noopTracer.Start(ctx, name, opts...)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// shutdown exports the spans not exported yet.
+func (t *tracing) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceRequests runs every request in a server span, continuing the trace of the caller.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		route := c.Path()
+		if untracedRoutes[route] {
+			return next(c)
+		}
+
+		s := c.Get("service").(*Service)
+		req := c.Request()
+
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := s.tracing.start(ctx, strings.TrimSpace(req.Method+" "+route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethod(req.Method), semconv.HTTPRoute(route)))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		// The response of an error is only written once the error reaches the echo error handler.
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				status = httpErr.Code
+			}
+			span.RecordError(err)
+		}
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// observeStorage is the storage.Observer of the store of the service: it traces and times
+// every contact storage call.
+func (s *Service) observeStorage(ctx context.Context, method string) func(int, error) {
+	_, span := s.tracing.start(ctx, "ContactStorage."+method, trace.WithSpanKind(trace.SpanKindClient))
+	observed := s.metrics.observeStorage(method)
+
+	return func(contacts int, err error) {
+		observed(err)
+		span.SetAttributes(attribute.Int("bitespeed.contacts", contacts))
+		endSpan(span, err)
+	}
+}
+
+// traceLinkage records on the span of ctx the contacts matched by a request and the change
+// made to them.
+func traceLinkage(ctx context.Context, contacts []storage.Contact, l *linkage) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.Int("bitespeed.contacts.matched", len(contacts)),
+		attribute.String("bitespeed.outcome", l.outcome),
+	)
+	if l.primaryID != 0 {
+		span.SetAttributes(attribute.Int64("bitespeed.primary_id", l.primaryID))
+	}
+	if len(l.merged) > 0 {
+		merged := make([]int64, 0, len(l.merged))
+		for _, c := range l.merged {
+			merged = append(merged, c.ID)
+		}
+		span.SetAttributes(attribute.Int64Slice("bitespeed.merged_ids", merged))
+	}
+}
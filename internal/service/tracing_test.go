@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	asserts "github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collector stands in for an OTLP/HTTP collector, keeping the spans it receives.
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.URL.Path != "/v1/traces" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mu.Unlock()
+
+	res, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(res)
+}
+
+// span returns the first span named name of trace traceID.
+func (c *collector) span(traceID, name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if hex.EncodeToString(s.TraceId) == traceID && s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func spanAttributes(s *tracepb.Span) map[string]*commonpb.AnyValue {
+	attrs := make(map[string]*commonpb.AnyValue)
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func Test_Tracing(t *testing.T) {
+	assert := asserts.New(t)
+
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	cfg := NewConfig()
+	cfg.Storage = storageMemory
+	cfg.OTLPEndpoint = srv.URL
+	s, err := NewService(cfg)
+	if !assert.Nil(err) {
+		return
+	}
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	serve(s, http.MethodPost, "/identify", `{"email":"a@example.com","phoneNumber":"111"}`)
+	serve(s, http.MethodPost, "/identify", `{"email":"b@example.com","phoneNumber":"222"}`)
+
+	// The caller's trace is continued by the request merging both clusters.
+	serve(s, http.MethodPost, "/identify", `{"email":"a@example.com","phoneNumber":"222"}`, "Traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+
+	serve(s, http.MethodGet, "/healthz", "")
+
+	assert.Nil(s.tracing.shutdown(context.Background()))
+
+	request := c.span(traceID, "POST /identify")
+	if !assert.NotNil(request) {
+		return
+	}
+	assert.Equal(parentSpanID, hex.EncodeToString(request.ParentSpanId))
+	assert.Equal(tracepb.Span_SPAN_KIND_SERVER, request.Kind)
+	assert.Equal(int64(http.StatusOK), spanAttributes(request)["http.status_code"].GetIntValue())
+
+	tx := c.span(traceID, "transaction")
+	if !assert.NotNil(tx) {
+		return
+	}
+	assert.Equal(request.SpanId, tx.ParentSpanId)
+	attrs := spanAttributes(tx)
+	assert.Equal("commit", attrs["db.transaction.end"].GetStringValue())
+	assert.Equal(int64(2), attrs["bitespeed.contacts.matched"].GetIntValue())
+	assert.Equal("merge", attrs["bitespeed.outcome"].GetStringValue())
+	assert.Equal(int64(1), attrs["bitespeed.primary_id"].GetIntValue())
+	assert.Equal(int64(2), attrs["bitespeed.merged_ids"].GetArrayValue().GetValues()[0].GetIntValue())
+
+	list := c.span(traceID, "ContactStorage.ListContactsByID")
+	if !assert.NotNil(list) {
+		return
+	}
+	assert.Equal(tx.SpanId, list.ParentSpanId)
+	assert.Equal(int64(1), spanAttributes(list)["bitespeed.contacts"].GetIntValue())
+
+	// Health checks are not traced.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		assert.NotEqual("GET /healthz", span.Name)
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/storage"
+	"github.com/harshabangi/bitespeed/pkg"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+var (
+	errMergedContactMoved = errors.New("merged contact is no longer part of the cluster it was merged into")
+	errMergeOutgrown      = errors.New("contacts added since the merge link both clusters")
+)
+
+// unmerge godoc
+// @Summary Split a merged contact.
+// @Description revert the latest merge of the given contact's cluster, or the latest merge caused by a request with the given email, phone number and identifiers.
+// @Tags root
+// @Param unmerge body pkg.UnmergeRequest true "Unmerge Request Body"
+// @Accept json
+// @Produce json
+// @Success 200 {object} pkg.UnmergeResponse
+// @Failure 400
+// @Failure 404
+// @Failure 409
+// @Failure 500
+// @Router /unmerge [post]
+// @Consumes application/json
+func unmerge(c echo.Context) error {
+	s := c.Get("service").(*Service)
+	store := c.Get("store").(*storage.Store)
+	ctx := c.Request().Context()
+
+	var req pkg.UnmergeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := req.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	phoneNumber, err := s.normalizer.NormalizePhoneNumber(req.PhoneNumber)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	req.PhoneNumber = phoneNumber
+	req.Email = s.normalizer.NormalizeEmail(req.Email)
+	req.Identifiers = s.normalizer.NormalizeIdentifiers(req.Identifiers)
+
+	merge, err := findMerge(ctx, store, req)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "no merge found to revert")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	res, err := revertMerge(ctx, store, merge, req)
+	if err != nil {
+		if errors.Is(err, errMergedContactMoved) || errors.Is(err, errMergeOutgrown) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func findMerge(ctx context.Context, s *storage.Store, req pkg.UnmergeRequest) (*storage.Merge, error) {
+	if req.ContactID != 0 {
+		return s.Merge.GetLatestMergeByMember(ctx, req.ContactID)
+	}
+	return s.Merge.GetLatestMergeByIdentifiers(ctx, req.Email, req.PhoneNumber, toIdentifiers(req.Identifiers))
+}
+
+// revertMerge restores the merged contact as a primary and links back to it every member
+// it had before the merge that is still part of the cluster, along with the contacts added
+// to the cluster since the merge because of them; see splitContacts.
+func revertMerge(ctx context.Context, s *storage.Store, merge *storage.Merge, req pkg.UnmergeRequest) (*pkg.UnmergeResponse, error) {
+	primaryID, err := lockCluster(ctx, s, merge.PrimaryID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once restored, the merged contact is a primary that other requests may link to.
+	if err := s.Contact.AcquireLocks(ctx, contactLockKey(merge.MergedID)); err != nil {
+		return nil, err
+	}
+
+	cluster, err := s.Contact.ListContactsByID(ctx, primaryID)
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := splitContacts(merge, primaryID, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range moved {
+		if id == merge.MergedID {
+			err = s.Contact.PromoteContact(ctx, id)
+		} else {
+			err = s.Contact.UpdateContact(ctx, id, storage.Contact{
+				LinkedID:       merge.MergedID,
+				LinkPrecedence: secondaryContact,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.Merge.RevertMerge(ctx, merge.ID); err != nil {
+		return nil, err
+	}
+
+	if err := recordEvent(ctx, s, pkg.EventUnmerged, merge.MergedID, primaryID, req.Email, req.PhoneNumber, req.Identifiers); err != nil {
+		return nil, err
+	}
+
+	res := &pkg.UnmergeResponse{}
+	for _, id := range []int64{primaryID, merge.MergedID} {
+		r, err := getContactResponse(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		res.Contacts = append(res.Contacts, r.Contact)
+	}
+	return res, nil
+}
+
+// splitContacts returns the contacts of the cluster of primaryID that go back to the cluster of
+// the merged contact: the members it had before the merge that are still part of the cluster,
+// and the contacts added since the merge whose identifiers are only found on the merged side.
+// Those would otherwise leave their identifiers in both clusters. The other contacts added
+// since the merge stay where they are, unless they share identifiers with both sides, in which
+// case the clusters are linked by more than the merge and errMergeOutgrown is returned.
+func splitContacts(merge *storage.Merge, primaryID int64, cluster []storage.Contact) ([]int64, error) {
+	inCluster := make(map[int64]bool, len(cluster))
+	for _, c := range cluster {
+		inCluster[c.ID] = c.ID != primaryID
+	}
+
+	if !inCluster[merge.MergedID] {
+		return nil, fmt.Errorf("%w: contact %d", errMergedContactMoved, merge.MergedID)
+	}
+
+	member := make(map[int64]bool, len(merge.MemberIDs))
+	for _, id := range merge.MemberIDs {
+		member[id] = inCluster[id]
+	}
+
+	var (
+		moved  []int64
+		added  []storage.Contact
+		sides  = make(map[pkg.Identifier]map[bool]bool)
+		assign = func(c storage.Contact, merged bool) {
+			for _, id := range contactIdentifiers(c) {
+				if sides[id] == nil {
+					sides[id] = make(map[bool]bool)
+				}
+				sides[id][merged] = true
+			}
+			if merged {
+				moved = append(moved, c.ID)
+			}
+		}
+	)
+
+	for _, c := range cluster {
+		switch {
+		case member[c.ID]:
+			assign(c, true)
+		case c.CreatedAt != nil && merge.CreatedAt != nil && !c.CreatedAt.Before(*merge.CreatedAt):
+			added = append(added, c)
+		default:
+			assign(c, false)
+		}
+	}
+
+	// Contacts added since the merge join the side they share identifiers with, which may
+	// only be known once other added contacts joined it.
+	for len(added) > 0 {
+		var pending []storage.Contact
+		for _, c := range added {
+			var merged, kept bool
+			for _, id := range contactIdentifiers(c) {
+				merged = merged || sides[id][true]
+				kept = kept || sides[id][false]
+			}
+			switch {
+			case merged && kept:
+				return nil, fmt.Errorf("%w: contact %d shares identifiers with both clusters", errMergeOutgrown, c.ID)
+			case merged || kept:
+				assign(c, merged)
+			default:
+				pending = append(pending, c)
+			}
+		}
+
+		if len(pending) == len(added) {
+			// Linked to the cluster through none of its identifiers: it stays where it is.
+			break
+		}
+		added = pending
+	}
+	return moved, nil
+}
+
+// lockCluster locks the cluster contactID currently belongs to, flattens it, and returns its
+// primary contact ID. As with lockAndListContacts, the contact is read again after locking in
+// case its cluster was merged into another one in the meantime.
+func lockCluster(ctx context.Context, s *storage.Store, contactID int64) (int64, error) {
+	locked := make(map[int64]bool)
+
+	for {
+		c, err := s.Contact.GetPrimaryContact(ctx, contactID)
+		if err != nil {
+			return 0, err
+		}
+
+		id := c.ID
+		if locked[id] {
+			if _, err := s.Contact.FlattenCluster(ctx, id); err != nil {
+				return 0, err
+			}
+			return id, nil
+		}
+		if err := s.Contact.AcquireLocks(ctx, contactLockKey(id)); err != nil {
+			return 0, err
+		}
+		locked[id] = true
+	}
+}
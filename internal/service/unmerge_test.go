@@ -0,0 +1,116 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func Test_Unmerge(t *testing.T) {
+	s := newTestService()
+
+	identifyAll := func(t *testing.T, bodies ...string) {
+		for _, body := range bodies {
+			asserts.Equal(t, http.StatusOK, serve(s, http.MethodPost, "/identify", body).Code)
+		}
+	}
+
+	unmergeContacts := func(t *testing.T, body string) []pkg.Contact {
+		rec := serve(s, http.MethodPost, "/unmerge", body)
+		asserts.Equal(t, http.StatusOK, rec.Code)
+
+		var res pkg.UnmergeResponse
+		asserts.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res.Contacts
+	}
+
+	identifyAll(t,
+		`{"phoneNumber":"111","email":"a@example.com"}`, // 1: primary of cluster A
+		`{"phoneNumber":"111","email":"b@example.com"}`, // 2: secondary of A
+		`{"phoneNumber":"222","email":"c@example.com"}`, // 3: primary of cluster B
+		`{"phoneNumber":"333","email":"c@example.com"}`, // 4: secondary of B
+		`{"phoneNumber":"222","email":"a@example.com"}`, // merges B into A
+		`{"phoneNumber":"444","email":"c@example.com"}`, // 5: added to A after the merge, because of B
+		`{"phoneNumber":"111","email":"e@example.com"}`, // 6: added to A after the merge, because of A
+	)
+
+	t.Run("no merge", func(t *testing.T) {
+		asserts.Equal(t, http.StatusNotFound, serve(s, http.MethodPost, "/unmerge", `{"contactId":1}`).Code)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		asserts.Equal(t, http.StatusBadRequest, serve(s, http.MethodPost, "/unmerge", `{"email":"a@example.com"}`).Code)
+	})
+
+	t.Run("by contact id", func(t *testing.T) {
+		assert := asserts.New(t)
+		got := unmergeContacts(t, `{"contactId":4}`)
+		assert.Equal([]pkg.Contact{
+			{PrimaryContactID: 1, Emails: []string{"a@example.com", "b@example.com", "e@example.com"}, PhoneNumbers: []string{"111"}, SecondaryContactIDs: []int64{2, 6}},
+			{PrimaryContactID: 3, Emails: []string{"c@example.com"}, PhoneNumbers: []string{"222", "333", "444"}, SecondaryContactIDs: []int64{4, 5}},
+		}, got)
+
+		assert.Equal(http.StatusNotFound, serve(s, http.MethodPost, "/unmerge", `{"contactId":4}`).Code)
+	})
+
+	t.Run("by identifiers after nested merges", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		identifyAll(t,
+			`{"phoneNumber":"222","email":"b@example.com"}`, // merges B into A again
+			`{"phoneNumber":"555","email":"d@example.com"}`, // 7: primary of cluster D
+			`{"phoneNumber":"555","email":"A@example.com"}`, // merges D into A
+			`{"phoneNumber":"666","email":"c@example.com"}`, // 8: added to A after the merge, because of B
+			`{"phoneNumber":"666","email":"f@example.com"}`, // 9: added to A after the merge, because of 8
+		)
+
+		// Reverting the older merge leaves the newer one in place.
+		got := unmergeContacts(t, `{"phoneNumber":"222","email":"B@example.com"}`)
+		assert.Equal(int64(1), got[0].PrimaryContactID)
+		assert.Equal([]int64{2, 6, 7}, got[0].SecondaryContactIDs)
+		assert.Equal(int64(3), got[1].PrimaryContactID)
+		assert.Equal([]int64{4, 5, 8, 9}, got[1].SecondaryContactIDs)
+
+		got = unmergeContacts(t, `{"contactId":7}`)
+		assert.Equal(int64(1), got[0].PrimaryContactID)
+		assert.Equal([]int64{2, 6}, got[0].SecondaryContactIDs)
+		assert.Equal(pkg.Contact{PrimaryContactID: 7, Emails: []string{"d@example.com"}, PhoneNumbers: []string{"555"}, SecondaryContactIDs: []int64{}}, got[1])
+	})
+
+	t.Run("contacts added since the merge linking both clusters", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		identifyAll(t,
+			`{"phoneNumber":"777","email":"g@example.com"}`, // 10: primary of cluster G
+			`{"phoneNumber":"777","email":"a@example.com"}`, // merges G into A
+			`{"phoneNumber":"111","email":"h@example.com"}`, // 11: added to A after the merge, because of A
+			`{"phoneNumber":"999","email":"g@example.com"}`, // 12: added to A after the merge, because of G
+			// 13: added to A after the merge, because of both 11 and 12
+			`{"phoneNumber":"999","email":"h@example.com","identifiers":[{"type":"loyalty","value":"L1"}]}`,
+		)
+
+		rec := serve(s, http.MethodPost, "/unmerge", `{"contactId":10}`)
+		assert.Equal(http.StatusConflict, rec.Code)
+		assert.Contains(rec.Body.String(), "contact 13 shares identifiers with both clusters")
+	})
+
+	t.Run("by other identifiers", func(t *testing.T) {
+		assert := asserts.New(t)
+
+		identifyAll(t,
+			`{"email":"p@example.com","identifiers":[{"type":"loyaltyId","value":"P1"}]}`, // 14: primary of cluster P
+			`{"phoneNumber":"888","email":"q@example.com"}`,                               // 15: primary of cluster Q
+			`{"phoneNumber":"888","identifiers":[{"type":"loyaltyId","value":"P1"}]}`,     // merges Q into P
+		)
+
+		assert.Equal(http.StatusNotFound, serve(s, http.MethodPost, "/unmerge", `{"phoneNumber":"888","email":"p@example.com"}`).Code)
+
+		got := unmergeContacts(t, `{"phoneNumber":"888","identifiers":[{"type":"loyaltyId","value":" P1 "}]}`)
+		if assert.Equal(2, len(got)) {
+			assert.Equal(int64(14), got[0].PrimaryContactID)
+			assert.Equal(int64(15), got[1].PrimaryContactID)
+		}
+	})
+}
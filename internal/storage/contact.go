@@ -1,55 +1,160 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/harshabangi/bitespeed/internal/util"
+	"sort"
 	"strings"
 	"time"
 )
 
 type ContactStorage interface {
-	ListContactsByEmailAndPhoneNumber(email string, phoneNumber string) ([]Contact, error)
-	ListContactsByID(id int64) ([]Contact, error)
-	GetContact(id int64) (*Contact, error)
-	CreateContact(contact Contact) (int64, error)
-	UpdateContact(id int64, contact Contact) error
-	UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(olderContactLinkedID, newerContactLinkedID int64) error
+	ListContacts(ctx context.Context) ([]Contact, error)
+	ListContactsByEmailAndPhoneNumber(ctx context.Context, email string, phoneNumber string) ([]Contact, error)
+	ListContactsByIdentifiers(ctx context.Context, identifiers []Identifier) ([]Contact, error)
+	ListContactsByID(ctx context.Context, id int64) ([]Contact, error)
+	GetContact(ctx context.Context, id int64) (*Contact, error)
+	GetPrimaryContact(ctx context.Context, id int64) (*Contact, error)
+	FlattenCluster(ctx context.Context, primaryID int64) (int64, error)
+	CreateContact(ctx context.Context, contact Contact) (int64, error)
+	UpdateContact(ctx context.Context, id int64, contact Contact) error
+	UpdateEmailAndPhoneNumber(ctx context.Context, id int64, email string, phoneNumber string) error
+	UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx context.Context, olderContactLinkedID, newerContactLinkedID int64) error
+	PromoteContact(ctx context.Context, id int64) error
+	DeleteContact(ctx context.Context, id int64) error
+
+	// AcquireLocks blocks until it holds an exclusive lock on every key. The
+	// locks are released when the surrounding transaction ends.
+	AcquireLocks(ctx context.Context, keys ...string) error
 }
 
 type contactStorage struct {
 	db database
 }
 
+// Contact is a row of the contact table. UpdatedAt is moved forward by every
+// write to the row, so that it can be used to pull changes incrementally.
 type Contact struct {
 	ID             int64
 	PhoneNumber    string
 	Email          string
+	RawPhoneNumber string
+	RawEmail       string
 	LinkedID       int64
 	LinkPrecedence string
 	CreatedAt      *time.Time
 	UpdatedAt      *time.Time
 	DeletedAt      *time.Time
+
+	// EmailVerified and Source are what the request creating the contact said about it: whether
+	// its email was verified, and the system it came from.
+	EmailVerified bool
+	Source        string
+
+	// Identifiers are the identifiers of the contact other than its email and phone number.
+	Identifiers []Identifier
+}
+
+// Identifier is a value of some Type, such as a loyalty id, by which a contact is known.
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// sortedIdentifiers returns a sorted copy of identifiers, in the order the contact table returns them.
+func sortedIdentifiers(identifiers []Identifier) []Identifier {
+	if len(identifiers) == 0 {
+		return nil
+	}
+	result := append([]Identifier(nil), identifiers...)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// identifiersJSON encodes identifiers sorted, as the identifiers columns of contact_merge and
+// contact_event hold them, so that the same identifiers in any order are stored alike.
+func identifiersJSON(identifiers []Identifier) (string, error) {
+	b, err := json.Marshal(sortedIdentifiers(identifiers))
+	return string(b), err
 }
 
+// scanIdentifiers decodes an identifiers column into identifiers, unless it is null.
+func scanIdentifiers(column sql.NullString, identifiers *[]Identifier) error {
+	if !column.Valid {
+		return nil
+	}
+	return json.Unmarshal([]byte(column.String), identifiers)
+}
+
+const contactColumns = "id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, " +
+	"(SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id)"
+
 func NewContactStorage(conn database) ContactStorage {
 	return &contactStorage{db: conn}
 }
 
-func (c *contactStorage) ListContactsByEmailAndPhoneNumber(email string, phoneNumber string) ([]Contact, error) {
-	query := "SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE email = $1 OR phone_number = $2"
+// ListContacts returns every contact, ordered by id.
+func (c *contactStorage) ListContacts(ctx context.Context) ([]Contact, error) {
+	rows, err := c.db.QueryContext(ctx, "SELECT "+contactColumns+" FROM contact WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return readContacts(rows)
+}
+
+func (c *contactStorage) ListContactsByEmailAndPhoneNumber(ctx context.Context, email string, phoneNumber string) ([]Contact, error) {
+	query := "SELECT " + contactColumns + " FROM contact WHERE (email = $1 OR phone_number = $2) AND deleted_at IS NULL"
+
+	rows, err := c.db.QueryContext(ctx, query, email, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	return readContacts(rows)
+}
+
+// clusterQuery selects the ids of the contacts whose chain of linked_id leads to $1, and $1 itself.
+// Deleted contacts are followed so that a chain broken by a deletion is still found.
+const clusterQuery = "WITH RECURSIVE cluster(id) AS (" +
+	"SELECT id FROM contact WHERE id = $1 " +
+	"UNION SELECT contact.id FROM contact JOIN cluster ON contact.linked_id = cluster.id) "
+
+// ListContactsByIdentifiers returns the contacts known by any of the given identifiers.
+func (c *contactStorage) ListContactsByIdentifiers(ctx context.Context, identifiers []Identifier) ([]Contact, error) {
+	if len(identifiers) == 0 {
+		return nil, nil
+	}
+
+	conditions := make([]string, len(identifiers))
+	params := make([]interface{}, 0, 2*len(identifiers))
+	for i, id := range identifiers {
+		conditions[i] = fmt.Sprintf("(type = $%d AND value = $%d)", 2*i+1, 2*i+2)
+		params = append(params, id.Type, id.Value)
+	}
+
+	query := "SELECT " + contactColumns + " FROM contact WHERE id IN " +
+		"(SELECT contact_id FROM contact_identifier WHERE " + strings.Join(conditions, " OR ") + ") AND deleted_at IS NULL"
 
-	rows, err := c.db.Query(query, email, phoneNumber)
+	rows, err := c.db.QueryContext(ctx, query, params...)
 	if err != nil {
 		return nil, err
 	}
 	return readContacts(rows)
 }
 
-func (c *contactStorage) ListContactsByID(id int64) ([]Contact, error) {
-	query := "SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE linked_id = $1 OR id = $2 ORDER BY created_at"
+// ListContactsByID returns the cluster of the primary contact id, oldest first. Secondary
+// contacts linked to another secondary rather than directly to the primary are included.
+func (c *contactStorage) ListContactsByID(ctx context.Context, id int64) ([]Contact, error) {
+	query := clusterQuery + "SELECT " + contactColumns + " FROM contact WHERE id IN (SELECT id FROM cluster) AND deleted_at IS NULL ORDER BY created_at"
 
-	rows, err := c.db.Query(query, id, id)
+	rows, err := c.db.QueryContext(ctx, query, id)
 	if err != nil {
 		return nil, err
 	}
@@ -64,62 +169,89 @@ func readContacts(rows *sql.Rows) ([]Contact, error) {
 	var result []Contact
 
 	for rows.Next() {
-		var (
-			c           Contact
-			phoneNumber sql.NullString
-			email       sql.NullString
-			linkedID    sql.NullInt64
-		)
-
-		if err := rows.Scan(&c.ID, &phoneNumber, &email, &linkedID, &c.LinkPrecedence, &c.CreatedAt); err != nil {
+		c, err := scanContact(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		if phoneNumber.Valid {
-			c.PhoneNumber = phoneNumber.String
-		}
-		if email.Valid {
-			c.Email = email.String
-		}
-		if linkedID.Valid {
-			c.LinkedID = linkedID.Int64
-		}
-		result = append(result, c)
+		result = append(result, *c)
 	}
 	return result, rows.Err()
 }
 
-func (c *contactStorage) GetContact(id int64) (*Contact, error) {
-	var (
-		query       = "SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE id = $1"
-		phoneNumber sql.NullString
-		email       sql.NullString
-		linkedID    sql.NullInt64
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-		result Contact
+// scanContact reads a row selected with contactColumns.
+func scanContact(row rowScanner) (*Contact, error) {
+	var (
+		c              Contact
+		phoneNumber    sql.NullString
+		email          sql.NullString
+		rawPhoneNumber sql.NullString
+		rawEmail       sql.NullString
+		linkedID       sql.NullInt64
+		source         sql.NullString
+		identifiers    sql.NullString
 	)
 
-	row := c.db.QueryRow(query, id)
-
-	err := row.Scan(&result.ID, &phoneNumber, &email, &linkedID, &result.LinkPrecedence, &result.CreatedAt)
-	if err != nil {
+	if err := row.Scan(&c.ID, &phoneNumber, &email, &rawPhoneNumber, &rawEmail, &linkedID, &c.LinkPrecedence, &c.CreatedAt, &c.UpdatedAt, &c.EmailVerified, &source, &identifiers); err != nil {
 		return nil, err
 	}
 
 	if phoneNumber.Valid {
-		result.PhoneNumber = phoneNumber.String
+		c.PhoneNumber = phoneNumber.String
 	}
 	if email.Valid {
-		result.Email = email.String
+		c.Email = email.String
+	}
+	if rawPhoneNumber.Valid {
+		c.RawPhoneNumber = rawPhoneNumber.String
+	}
+	if rawEmail.Valid {
+		c.RawEmail = rawEmail.String
 	}
 	if linkedID.Valid {
-		result.LinkedID = linkedID.Int64
+		c.LinkedID = linkedID.Int64
+	}
+	if source.Valid {
+		c.Source = source.String
 	}
+	if err := scanIdentifiers(identifiers, &c.Identifiers); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *contactStorage) GetContact(ctx context.Context, id int64) (*Contact, error) {
+	query := "SELECT " + contactColumns + " FROM contact WHERE id = $1 AND deleted_at IS NULL"
+	return scanContact(c.db.QueryRowContext(ctx, query, id))
+}
 
-	return &result, nil
+// GetPrimaryContact follows the chain of linked_id from contact id to the primary contact of its
+// cluster. It returns sql.ErrNoRows if the chain does not end at a primary contact.
+func (c *contactStorage) GetPrimaryContact(ctx context.Context, id int64) (*Contact, error) {
+	query := "WITH RECURSIVE chain(id, linked_id) AS (" +
+		"SELECT id, linked_id FROM contact WHERE id = $1 AND deleted_at IS NULL " +
+		"UNION SELECT contact.id, contact.linked_id FROM contact JOIN chain ON contact.id = chain.linked_id) " +
+		"SELECT " + contactColumns + " FROM contact WHERE id IN (SELECT id FROM chain WHERE linked_id IS NULL) AND deleted_at IS NULL"
+	return scanContact(c.db.QueryRowContext(ctx, query, id))
 }
 
-func (c *contactStorage) CreateContact(contact Contact) (int64, error) {
+// FlattenCluster links every contact of the cluster of primaryID directly to it, repairing
+// chains of secondary contacts. It returns the number of contacts relinked.
+func (c *contactStorage) FlattenCluster(ctx context.Context, primaryID int64) (int64, error) {
+	query := clusterQuery + "UPDATE contact SET linked_id = $1, link_precedence = 'secondary', updated_at = clock_timestamp() " +
+		"WHERE id IN (SELECT id FROM cluster) AND id <> $1 AND (linked_id <> $1 OR link_precedence <> 'secondary')"
+
+	res, err := c.db.ExecContext(ctx, query, primaryID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (c *contactStorage) CreateContact(ctx context.Context, contact Contact) (int64, error) {
 	qp := util.NewQueryParams()
 
 	if contact.PhoneNumber != "" {
@@ -134,20 +266,41 @@ func (c *contactStorage) CreateContact(contact Contact) (int64, error) {
 	if contact.LinkPrecedence != "" {
 		qp.AddParam("link_precedence", contact.LinkPrecedence)
 	}
+	if contact.RawPhoneNumber != "" {
+		qp.AddParam("raw_phone_number", contact.RawPhoneNumber)
+	}
+	if contact.RawEmail != "" {
+		qp.AddParam("raw_email", contact.RawEmail)
+	}
+	if contact.EmailVerified {
+		qp.AddParam("email_verified", contact.EmailVerified)
+	}
+	if contact.Source != "" {
+		qp.AddParam("source", contact.Source)
+	}
 
 	query := fmt.Sprintf("INSERT INTO contact(%s) VALUES(%s) RETURNING id",
 		strings.Join(qp.Columns, ", "), strings.Join(qp.PlaceHolders, ", "))
 
-	row := c.db.QueryRow(query, qp.Params...)
+	row := c.db.QueryRowContext(ctx, query, qp.Params...)
 	var lastInsertID int64
 	err := row.Scan(&lastInsertID)
 	if err != nil {
 		return 0, err
 	}
+
+	for _, id := range contact.Identifiers {
+		if _, err := c.db.ExecContext(ctx, "INSERT INTO contact_identifier(contact_id, type, value) VALUES($1, $2, $3)", lastInsertID, id.Type, id.Value); err != nil {
+			return 0, err
+		}
+	}
 	return lastInsertID, nil
 }
 
-func (c *contactStorage) UpdateContact(id int64, contact Contact) error {
+// UpdateContact sets the non-zero linked id and link precedence of a contact. Like every write
+// to a contact, it stamps updated_at with clock_timestamp(), the time of the statement, rather
+// than CURRENT_TIMESTAMP, the start of its transaction, which may be long before it commits.
+func (c *contactStorage) UpdateContact(ctx context.Context, id int64, contact Contact) error {
 	var (
 		q  []string
 		qp []interface{}
@@ -166,14 +319,52 @@ func (c *contactStorage) UpdateContact(id int64, contact Contact) error {
 		i++
 	}
 
+	q = append(q, "updated_at = clock_timestamp()")
+
 	query := fmt.Sprintf("UPDATE contact SET %s WHERE id = $%d", strings.Join(q, ", "), i)
 	qp = append(qp, id)
 
-	_, err := c.db.Exec(query, qp...)
+	_, err := c.db.ExecContext(ctx, query, qp...)
+	return err
+}
+
+// UpdateEmailAndPhoneNumber replaces the email and phone number of a contact, leaving the
+// values as received untouched. Empty values are stored as NULL.
+func (c *contactStorage) UpdateEmailAndPhoneNumber(ctx context.Context, id int64, email string, phoneNumber string) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE contact SET email = NULLIF($1, ''), phone_number = NULLIF($2, ''), updated_at = clock_timestamp() WHERE id = $3", email, phoneNumber, id)
+	return err
+}
+
+func (c *contactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx context.Context, olderContactLinkedID, newerContactLinkedID int64) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE contact SET linked_id = $1, updated_at = clock_timestamp() WHERE linked_id = $2", olderContactLinkedID, newerContactLinkedID)
 	return err
 }
 
-func (c *contactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(olderContactLinkedID, newerContactLinkedID int64) error {
-	_, err := c.db.Exec("UPDATE contact SET linked_id = $1 WHERE linked_id = $2", olderContactLinkedID, newerContactLinkedID)
+// PromoteContact turns a secondary contact into a primary one.
+func (c *contactStorage) PromoteContact(ctx context.Context, id int64) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE contact SET linked_id = NULL, link_precedence = 'primary', updated_at = clock_timestamp() WHERE id = $1", id)
 	return err
 }
+
+// DeleteContact soft deletes a contact, hiding it from every read.
+func (c *contactStorage) DeleteContact(ctx context.Context, id int64) error {
+	_, err := c.db.ExecContext(ctx, "UPDATE contact SET deleted_at = CURRENT_TIMESTAMP, updated_at = clock_timestamp() WHERE id = $1 AND deleted_at IS NULL", id)
+	return err
+}
+
+func (c *contactStorage) AcquireLocks(ctx context.Context, keys ...string) error {
+	// Locks are always taken in the same order so that two transactions
+	// locking overlapping keys cannot deadlock each other.
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		if _, err := c.db.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"database/sql/driver"
 	sqlMock "github.com/DATA-DOG/go-sqlmock"
 	asserts "github.com/stretchr/testify/assert"
@@ -11,6 +12,7 @@ import (
 
 func Test_Storage_ListContactsByEmailAndPhoneNumber(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
@@ -23,26 +25,81 @@ func Test_Storage_ListContactsByEmailAndPhoneNumber(t *testing.T) {
 	n1 := time.Now().UTC()
 	n2 := n1.Add(40 * time.Second)
 
-	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "linked_id", "link_precedence", "created_at"}).
-		AddRow(1, "12345", "a@gmail.com", nil, "primary", &n1).
-		AddRow(2, "56789", "a@gmail.com", 1, "secondary", &n2)
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(1, "12345", "a@gmail.com", "12345", "A@gmail.com", nil, "primary", &n1, &n2, true, "pos", nil).
+		AddRow(2, "56789", "a@gmail.com", nil, nil, 1, "secondary", &n2, &n2, false, nil, `[{"type":"loyaltyId","value":"L-1"}]`)
 
 	mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE email = $1 OR phone_number = $2",
+		"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, (SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) FROM contact WHERE (email = $1 OR phone_number = $2) AND deleted_at IS NULL",
 	)).
 		WithArgs("a@gmail.com", "12345").
 		WillReturnRows(contactRows)
 
-	got, err := s.ListContactsByEmailAndPhoneNumber("a@gmail.com", "12345")
+	got, err := s.ListContactsByEmailAndPhoneNumber(ctx, "a@gmail.com", "12345")
 	assert.Nil(err)
 
 	assert.Equal(2, len(got))
-	assert.Equal(Contact{ID: 1, PhoneNumber: "12345", Email: "a@gmail.com", LinkPrecedence: "primary", CreatedAt: &n1}, got[0])
-	assert.Equal(Contact{ID: 2, PhoneNumber: "56789", Email: "a@gmail.com", LinkedID: 1, LinkPrecedence: "secondary", CreatedAt: &n2}, got[1])
+	assert.Equal(Contact{ID: 1, PhoneNumber: "12345", Email: "a@gmail.com", RawPhoneNumber: "12345", RawEmail: "A@gmail.com", LinkPrecedence: "primary", CreatedAt: &n1, UpdatedAt: &n2,
+		EmailVerified: true, Source: "pos"}, got[0])
+	assert.Equal(Contact{ID: 2, PhoneNumber: "56789", Email: "a@gmail.com", LinkedID: 1, LinkPrecedence: "secondary", CreatedAt: &n2, UpdatedAt: &n2,
+		Identifiers: []Identifier{{Type: "loyaltyId", Value: "L-1"}}}, got[1])
+}
+
+func Test_Storage_ListContactsByIdentifiers(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(1, nil, nil, nil, nil, nil, "primary", &now, &now, false, nil, `[{"type":"deviceId","value":"D-1"},{"type":"loyaltyId","value":"L-1"}]`)
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, "+
+			"(SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) "+
+			"FROM contact WHERE id IN (SELECT contact_id FROM contact_identifier WHERE (type = $1 AND value = $2) OR (type = $3 AND value = $4)) AND deleted_at IS NULL",
+	)).WithArgs("loyaltyId", "L-1", "deviceId", "D-2").WillReturnRows(contactRows)
+
+	s := NewContactStorage(db)
+	got, err := s.ListContactsByIdentifiers(ctx, []Identifier{{Type: "loyaltyId", Value: "L-1"}, {Type: "deviceId", Value: "D-2"}})
+	assert.Nil(err)
+	assert.Equal([]Contact{{ID: 1, LinkPrecedence: "primary", CreatedAt: &now, UpdatedAt: &now,
+		Identifiers: []Identifier{{Type: "deviceId", Value: "D-1"}, {Type: "loyaltyId", Value: "L-1"}}}}, got)
+
+	got, err = s.ListContactsByIdentifiers(ctx, nil)
+	assert.Nil(err)
+	assert.Empty(got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_ListContacts(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(1, "12345", "a@gmail.com", nil, nil, nil, "primary", &now, &now, false, nil, nil)
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, (SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) FROM contact WHERE deleted_at IS NULL ORDER BY id",
+	)).WillReturnRows(contactRows)
+
+	s := NewContactStorage(db)
+	got, err := s.ListContacts(ctx)
+	assert.Nil(err)
+	assert.Equal([]Contact{{ID: 1, PhoneNumber: "12345", Email: "a@gmail.com", LinkPrecedence: "primary", CreatedAt: &now, UpdatedAt: &now}}, got)
 }
 
 func Test_Storage_ListContactsByID(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
@@ -54,37 +111,39 @@ func Test_Storage_ListContactsByID(t *testing.T) {
 
 	now := time.Now().UTC()
 
-	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "linked_id", "link_precedence", "created_at"}).
-		AddRow(2, "56789", "a@gmail.com", 1, "secondary", &now)
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(2, "56789", "a@gmail.com", nil, nil, 1, "secondary", &now, &now, false, nil, nil)
 
 	mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE linked_id = $1 OR id = $2",
-	)).WithArgs(2, 2).WillReturnRows(contactRows)
+		"WITH RECURSIVE cluster(id) AS (SELECT id FROM contact WHERE id = $1 UNION SELECT contact.id FROM contact JOIN cluster ON contact.linked_id = cluster.id) " +
+			"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, (SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) FROM contact WHERE id IN (SELECT id FROM cluster) AND deleted_at IS NULL ORDER BY created_at",
+	)).WithArgs(2).WillReturnRows(contactRows)
 
-	got, err := s.ListContactsByID(2)
+	got, err := s.ListContactsByID(ctx, 2)
 	assert.Nil(err)
 
 	assert.Equal(1, len(got))
-	assert.Equal(Contact{ID: 2, PhoneNumber: "56789", Email: "a@gmail.com", LinkedID: 1, LinkPrecedence: "secondary", CreatedAt: &now}, got[0])
+	assert.Equal(Contact{ID: 2, PhoneNumber: "56789", Email: "a@gmail.com", LinkedID: 1, LinkPrecedence: "secondary", CreatedAt: &now, UpdatedAt: &now}, got[0])
 }
 
 func Test_Storage_GetContact(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
 	defer func() { _ = db.Close() }()
 
 	now := time.Now().UTC()
-	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "linked_id", "link_precedence", "created_at"}).
-		AddRow(2, "56789", "a@gmail.com", 1, "secondary", &now)
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(2, "56789", "a@gmail.com", nil, nil, 1, "secondary", &now, &now, false, nil, nil)
 
 	mock.ExpectQuery(regexp.QuoteMeta(
-		"SELECT id, phone_number, email, linked_id, link_precedence, created_at FROM contact WHERE id = $1",
+		"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, (SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) FROM contact WHERE id = $1 AND deleted_at IS NULL",
 	)).WithArgs(2).WillReturnRows(contactRows)
 
 	s := NewContactStorage(db)
-	got, err := s.GetContact(2)
+	got, err := s.GetContact(ctx, 2)
 	assert.Nil(err)
 	assert.Equal(&Contact{
 		ID:             2,
@@ -93,11 +152,57 @@ func Test_Storage_GetContact(t *testing.T) {
 		LinkedID:       1,
 		LinkPrecedence: "secondary",
 		CreatedAt:      &now,
+		UpdatedAt:      &now,
 	}, got)
 }
 
+func Test_Storage_GetPrimaryContact(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	contactRows := sqlMock.NewRows([]string{"id", "phone_number", "email", "raw_phone_number", "raw_email", "linked_id", "link_precedence", "created_at", "updated_at", "email_verified", "source", "identifiers"}).
+		AddRow(1, "12345", "a@gmail.com", nil, nil, nil, "primary", &now, &now, false, nil, nil)
+
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"WITH RECURSIVE chain(id, linked_id) AS (SELECT id, linked_id FROM contact WHERE id = $1 AND deleted_at IS NULL " +
+			"UNION SELECT contact.id, contact.linked_id FROM contact JOIN chain ON contact.id = chain.linked_id) " +
+			"SELECT id, phone_number, email, raw_phone_number, raw_email, linked_id, link_precedence, created_at, updated_at, email_verified, source, (SELECT json_agg(json_build_object('type', type, 'value', value) ORDER BY type, value) FROM contact_identifier WHERE contact_id = contact.id) FROM contact " +
+			"WHERE id IN (SELECT id FROM chain WHERE linked_id IS NULL) AND deleted_at IS NULL",
+	)).WithArgs(3).WillReturnRows(contactRows)
+
+	s := NewContactStorage(db)
+	got, err := s.GetPrimaryContact(ctx, 3)
+	assert.Nil(err)
+	assert.Equal(&Contact{ID: 1, PhoneNumber: "12345", Email: "a@gmail.com", LinkPrecedence: "primary", CreatedAt: &now, UpdatedAt: &now}, got)
+}
+
+func Test_Storage_FlattenCluster(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	qs := "WITH RECURSIVE cluster(id) AS (SELECT id FROM contact WHERE id = $1 UNION SELECT contact.id FROM contact JOIN cluster ON contact.linked_id = cluster.id) " +
+		"UPDATE contact SET linked_id = $1, link_precedence = 'secondary', updated_at = clock_timestamp() " +
+		"WHERE id IN (SELECT id FROM cluster) AND id <> $1 AND (linked_id <> $1 OR link_precedence <> 'secondary')"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(1).WillReturnResult(sqlMock.NewResult(0, 2))
+
+	s := NewContactStorage(db)
+	got, err := s.FlattenCluster(ctx, 1)
+	assert.Nil(err)
+	assert.Equal(int64(2), got)
+}
+
 func Test_Storage_CreateContact(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
@@ -105,40 +210,148 @@ func Test_Storage_CreateContact(t *testing.T) {
 
 	rows := sqlMock.NewRows([]string{"id"}).AddRow(1)
 
-	qs := "INSERT INTO contact(phone_number, email, linked_id, link_precedence) VALUES($1, $2, $3, $4) RETURNING id"
-	mock.ExpectQuery(regexp.QuoteMeta(qs)).WithArgs("12345", "a@gmail.com", 2, "primary").WillReturnRows(rows)
+	qs := "INSERT INTO contact(phone_number, email, linked_id, link_precedence, raw_phone_number, raw_email, email_verified, source) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	mock.ExpectQuery(regexp.QuoteMeta(qs)).WithArgs("12345", "a@gmail.com", 2, "primary", "123-45", "A@gmail.com", true, "pos").WillReturnRows(rows)
+
+	s := NewContactStorage(db)
+	_, err = s.CreateContact(ctx, Contact{PhoneNumber: "12345", Email: "a@gmail.com", RawPhoneNumber: "123-45", RawEmail: "A@gmail.com", LinkedID: 2, LinkPrecedence: "primary",
+		EmailVerified: true, Source: "pos"})
+	assert.Nil(err)
+}
+
+func Test_Storage_CreateContact_Identifiers(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO contact(link_precedence) VALUES($1) RETURNING id")).
+		WithArgs("primary").WillReturnRows(sqlMock.NewRows([]string{"id"}).AddRow(1))
+	qs := "INSERT INTO contact_identifier(contact_id, type, value) VALUES($1, $2, $3)"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(1, "loyaltyId", "L-1").WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(1, "deviceId", "D-1").WillReturnResult(driver.ResultNoRows)
 
 	s := NewContactStorage(db)
-	_, err = s.CreateContact(Contact{PhoneNumber: "12345", Email: "a@gmail.com", LinkedID: 2, LinkPrecedence: "primary"})
+	id, err := s.CreateContact(ctx, Contact{LinkPrecedence: "primary", Identifiers: []Identifier{{Type: "loyaltyId", Value: "L-1"}, {Type: "deviceId", Value: "D-1"}}})
 	assert.Nil(err)
+	assert.Equal(int64(1), id)
+	assert.Nil(mock.ExpectationsWereMet())
 }
 
 func Test_Storage_UpdateContact(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
 	defer func() { _ = db.Close() }()
 
-	qs := "UPDATE contact SET linked_id = $1, link_precedence = $2 WHERE id = $3"
+	qs := "UPDATE contact SET linked_id = $1, link_precedence = $2, updated_at = clock_timestamp() WHERE id = $3"
 	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(2, "primary", 1).WillReturnResult(driver.ResultNoRows)
 
 	s := NewContactStorage(db)
-	err = s.UpdateContact(1, Contact{LinkedID: 2, LinkPrecedence: "primary"})
+	err = s.UpdateContact(ctx, 1, Contact{LinkedID: 2, LinkPrecedence: "primary"})
+	assert.Nil(err)
+}
+
+func Test_Storage_UpdateEmailAndPhoneNumber(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	qs := "UPDATE contact SET email = NULLIF($1, ''), phone_number = NULLIF($2, ''), updated_at = clock_timestamp() WHERE id = $3"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs("a@gmail.com", "", 1).WillReturnResult(driver.ResultNoRows)
+
+	s := NewContactStorage(db)
+	err = s.UpdateEmailAndPhoneNumber(ctx, 1, "a@gmail.com", "")
 	assert.Nil(err)
+	assert.Nil(mock.ExpectationsWereMet())
 }
 
 func Test_Storage_UpdateContactsWithNewLinkedIDs(t *testing.T) {
 	assert := asserts.New(t)
+	ctx := context.Background()
 	db, mock, err := sqlMock.New()
 	assert.Nil(err)
 
 	defer func() { _ = db.Close() }()
 
-	qs := "UPDATE contact SET linked_id = $1 WHERE linked_id = $2"
+	qs := "UPDATE contact SET linked_id = $1, updated_at = clock_timestamp() WHERE linked_id = $2"
 	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(1, 2).WillReturnResult(driver.ResultNoRows)
 
 	s := NewContactStorage(db)
-	err = s.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(1, 2)
+	err = s.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx, 1, 2)
+	assert.Nil(err)
+}
+
+func Test_Storage_AcquireLocks(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	qs := "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs("contact:1").WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs("email:a@gmail.com").WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs("phone:12345").WillReturnResult(driver.ResultNoRows)
+
+	s := NewContactStorage(db)
+	err = s.AcquireLocks(ctx, "phone:12345", "email:a@gmail.com", "contact:1", "phone:12345")
+	assert.Nil(err)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_PromoteContact(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	qs := "UPDATE contact SET linked_id = NULL, link_precedence = 'primary', updated_at = clock_timestamp() WHERE id = $1"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(2).WillReturnResult(driver.ResultNoRows)
+
+	s := NewContactStorage(db)
+	assert.Nil(s.PromoteContact(ctx, 2))
+}
+
+func Test_Storage_DeleteContact(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	qs := "UPDATE contact SET deleted_at = CURRENT_TIMESTAMP, updated_at = clock_timestamp() WHERE id = $1 AND deleted_at IS NULL"
+	mock.ExpectExec(regexp.QuoteMeta(qs)).WithArgs(2).WillReturnResult(driver.ResultNoRows)
+
+	s := NewContactStorage(db)
+	assert.Nil(s.DeleteContact(ctx, 2))
+}
+
+func Test_Storage_ContextDeadline(t *testing.T) {
+	assert := asserts.New(t)
+	db, mock, err := sqlMock.New()
 	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectQuery("SELECT").WithArgs(2).WillDelayFor(time.Minute).WillReturnRows(sqlMock.NewRows(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	s := NewContactStorage(db)
+	// The driver is told to cancel the query once the deadline passes.
+	_, err = s.GetContact(ctx, 2)
+	assert.Equal(sqlMock.ErrCancelled, err)
 }
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/util"
+	"strings"
+	"time"
+)
+
+// EventStorage is an append-only log of the changes made to the links between contacts.
+type EventStorage interface {
+	CreateEvent(ctx context.Context, event Event) (int64, error)
+	ListEventsByContactIDs(ctx context.Context, ids []int64) ([]Event, error)
+}
+
+type eventStorage struct {
+	db database
+}
+
+// Event is a change to ContactID. PrimaryID is the primary contact of the cluster
+// ContactID joined or, when unmerged, left. Email, PhoneNumber and Identifiers are the
+// identifiers of the request that caused it.
+type Event struct {
+	ID          int64
+	ContactID   int64
+	Type        string
+	PrimaryID   int64
+	PhoneNumber string
+	Email       string
+	Identifiers []Identifier
+	CreatedAt   *time.Time
+}
+
+func NewEventStorage(conn database) EventStorage {
+	return &eventStorage{db: conn}
+}
+
+func (e *eventStorage) CreateEvent(ctx context.Context, event Event) (int64, error) {
+	qp := util.NewQueryParams()
+
+	qp.AddParam("contact_id", event.ContactID)
+	qp.AddParam("event_type", event.Type)
+	if event.PrimaryID != 0 {
+		qp.AddParam("primary_id", event.PrimaryID)
+	}
+	if event.PhoneNumber != "" {
+		qp.AddParam("phone_number", event.PhoneNumber)
+	}
+	if event.Email != "" {
+		qp.AddParam("email", event.Email)
+	}
+	if len(event.Identifiers) > 0 {
+		identifiers, err := identifiersJSON(event.Identifiers)
+		if err != nil {
+			return 0, err
+		}
+		qp.AddParam("identifiers", identifiers)
+	}
+
+	query := fmt.Sprintf("INSERT INTO contact_event(%s) VALUES(%s) RETURNING id",
+		strings.Join(qp.Columns, ", "), strings.Join(qp.PlaceHolders, ", "))
+
+	var id int64
+	if err := e.db.QueryRowContext(ctx, query, qp.Params...).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// ListEventsByContactIDs returns, oldest first, the events of the given contacts and
+// of the clusters they are the primary of.
+func (e *eventStorage) ListEventsByContactIDs(ctx context.Context, ids []int64) ([]Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	placeHolders := make([]string, len(ids))
+	params := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeHolders[i] = fmt.Sprintf("$%d", i+1)
+		params[i] = id
+	}
+	in := strings.Join(placeHolders, ", ")
+
+	query := fmt.Sprintf("SELECT id, contact_id, event_type, primary_id, phone_number, email, identifiers, created_at FROM contact_event "+
+		"WHERE contact_id IN (%s) OR primary_id IN (%s) ORDER BY id", in, in)
+
+	rows, err := e.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var result []Event
+
+	for rows.Next() {
+		var (
+			ev          Event
+			primaryID   sql.NullInt64
+			phoneNumber sql.NullString
+			email       sql.NullString
+			identifiers sql.NullString
+		)
+
+		if err := rows.Scan(&ev.ID, &ev.ContactID, &ev.Type, &primaryID, &phoneNumber, &email, &identifiers, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := scanIdentifiers(identifiers, &ev.Identifiers); err != nil {
+			return nil, err
+		}
+
+		if primaryID.Valid {
+			ev.PrimaryID = primaryID.Int64
+		}
+		if phoneNumber.Valid {
+			ev.PhoneNumber = phoneNumber.String
+		}
+		if email.Valid {
+			ev.Email = email.String
+		}
+		result = append(result, ev)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	asserts "github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_Storage_CreateEvent(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO contact_event(contact_id, event_type, primary_id, email, identifiers) VALUES($1, $2, $3, $4, $5) RETURNING id")).
+		WithArgs(2, "linked", 1, "a@gmail.com", `[{"type":"deviceId","value":"D1"},{"type":"loyaltyId","value":"L1"}]`).
+		WillReturnRows(sqlMock.NewRows([]string{"id"}).AddRow(5))
+
+	s := NewEventStorage(db)
+	id, err := s.CreateEvent(ctx, Event{ContactID: 2, Type: "linked", PrimaryID: 1, Email: "a@gmail.com",
+		Identifiers: []Identifier{{Type: "loyaltyId", Value: "L1"}, {Type: "deviceId", Value: "D1"}}})
+	assert.Nil(err)
+	assert.Equal(int64(5), id)
+}
+
+func Test_Storage_ListEventsByContactIDs(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, contact_id, event_type, primary_id, phone_number, email, identifiers, created_at FROM contact_event "+
+		"WHERE contact_id IN ($1, $2) OR primary_id IN ($1, $2) ORDER BY id")).
+		WithArgs(1, 2).
+		WillReturnRows(sqlMock.NewRows([]string{"id", "contact_id", "event_type", "primary_id", "phone_number", "email", "identifiers", "created_at"}).
+			AddRow(1, 1, "created", 1, "12345", "a@gmail.com", nil, &now).
+			AddRow(2, 2, "linked", 1, nil, "b@gmail.com", `[{"type":"loyaltyId","value":"L1"}]`, &now))
+
+	s := NewEventStorage(db)
+	got, err := s.ListEventsByContactIDs(ctx, []int64{1, 2})
+	assert.Nil(err)
+	assert.Equal([]Event{
+		{ID: 1, ContactID: 1, Type: "created", PrimaryID: 1, PhoneNumber: "12345", Email: "a@gmail.com", CreatedAt: &now},
+		{ID: 2, ContactID: 2, Type: "linked", PrimaryID: 1, Email: "b@gmail.com", Identifiers: []Identifier{{Type: "loyaltyId", Value: "L1"}}, CreatedAt: &now},
+	}, got)
+}
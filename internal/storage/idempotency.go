@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyStorage remembers the response given to the requests sent with an idempotency key,
+// so that a repeat of a request is answered the same instead of being applied again.
+type IdempotencyStorage interface {
+	// GetIdempotencyKey returns the key, unless it was saved more than ttl ago. It returns
+	// sql.ErrNoRows when there is no such key.
+	GetIdempotencyKey(ctx context.Context, key string, ttl time.Duration) (*IdempotencyKey, error)
+	// SaveIdempotencyKey saves the key, replacing the one of the same name if any, and deletes
+	// up to idempotencyKeysPurged of the oldest keys saved more than ttl ago.
+	SaveIdempotencyKey(ctx context.Context, key IdempotencyKey, ttl time.Duration) error
+}
+
+// IdempotencyLockKey is the lock taken with AcquireLocks by a request sent with key, until its
+// transaction ends.
+func IdempotencyLockKey(key string) string {
+	return "idempotency:" + key
+}
+
+// idempotencyKeysPurged bounds the expired keys deleted by a save, so that every request only
+// takes a small share of the cleanup.
+const idempotencyKeysPurged = 100
+
+type idempotencyStorage struct {
+	db database
+}
+
+// IdempotencyKey is the key a request was sent with. RequestHash identifies the request, so that
+// the key is not reused for another one, and Response is the body of the response given to it.
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+	Response    []byte
+	CreatedAt   *time.Time
+}
+
+func NewIdempotencyStorage(conn database) IdempotencyStorage {
+	return &idempotencyStorage{db: conn}
+}
+
+func (s *idempotencyStorage) GetIdempotencyKey(ctx context.Context, key string, ttl time.Duration) (*IdempotencyKey, error) {
+	query := "SELECT key, request_hash, response, created_at FROM idempotency_key " +
+		"WHERE key = $1 AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $2)"
+
+	var result IdempotencyKey
+	err := s.db.QueryRowContext(ctx, query, key, ttl.Seconds()).Scan(&result.Key, &result.RequestHash, &result.Response, &result.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *idempotencyStorage) SaveIdempotencyKey(ctx context.Context, key IdempotencyKey, ttl time.Duration) error {
+	query := "INSERT INTO idempotency_key(key, request_hash, response) VALUES($1, $2, $3) " +
+		"ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, response = EXCLUDED.response, created_at = CURRENT_TIMESTAMP"
+	if _, err := s.db.ExecContext(ctx, query, key.Key, key.RequestHash, string(key.Response)); err != nil {
+		return err
+	}
+
+	// Keys locked by other transactions are skipped rather than waited for: they are being
+	// replaced, or deleted by another save.
+	query = "DELETE FROM idempotency_key WHERE key IN (SELECT key FROM idempotency_key " +
+		"WHERE created_at <= CURRENT_TIMESTAMP - make_interval(secs => $1) ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED)"
+	_, err := s.db.ExecContext(ctx, query, ttl.Seconds(), idempotencyKeysPurged)
+	return err
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	asserts "github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_Storage_GetIdempotencyKey(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT key, request_hash, response, created_at FROM idempotency_key "+
+		"WHERE key = $1 AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $2)")).
+		WithArgs("k-1", 86400.0).
+		WillReturnRows(sqlMock.NewRows([]string{"key", "request_hash", "response", "created_at"}).AddRow("k-1", "abc", `{"contact":{}}`, &now))
+
+	s := NewIdempotencyStorage(db)
+	got, err := s.GetIdempotencyKey(ctx, "k-1", 24*time.Hour)
+	assert.Nil(err)
+	assert.Equal(&IdempotencyKey{Key: "k-1", RequestHash: "abc", Response: []byte(`{"contact":{}}`), CreatedAt: &now}, got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_SaveIdempotencyKey(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO idempotency_key(key, request_hash, response) VALUES($1, $2, $3) "+
+		"ON CONFLICT (key) DO UPDATE SET request_hash = EXCLUDED.request_hash, response = EXCLUDED.response, created_at = CURRENT_TIMESTAMP")).
+		WithArgs("k-1", "abc", `{"contact":{}}`).
+		WillReturnResult(sqlMock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_key WHERE key IN (SELECT key FROM idempotency_key "+
+		"WHERE created_at <= CURRENT_TIMESTAMP - make_interval(secs => $1) ORDER BY created_at LIMIT $2 FOR UPDATE SKIP LOCKED)")).
+		WithArgs(86400.0, 100).
+		WillReturnResult(sqlMock.NewResult(0, 3))
+
+	s := NewIdempotencyStorage(db)
+	assert.Nil(s.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "k-1", RequestHash: "abc", Response: []byte(`{"contact":{}}`)}, 24*time.Hour))
+	assert.Nil(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,956 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryDB is an in-process replacement for the database. Transactions run concurrently, as they
+// do in Postgres: each one keeps its writes to itself until it commits, and reads the committed
+// state along with its own writes, the committed state at its first statement for repeatable
+// read transactions. Ids are taken from the committed state, as sequences are never rolled back.
+// Concurrent writes to the same rows are not detected, the last transaction to commit wins;
+// callers are expected to serialize them with AcquireLocks, as they do with Postgres.
+//
+// mu guards the state and the locks, and is held for the duration of every statement.
+type memoryDB struct {
+	mu    sync.Mutex
+	state *memoryState
+	locks map[string]*memoryLock
+}
+
+type memoryState struct {
+	contacts    map[int64]Contact
+	nextID      int64
+	merges      map[int64]Merge
+	nextMergeID int64
+	events      []Event
+	nextEventID int64
+	keys        map[string]IdempotencyKey
+}
+
+// memoryLock is a lock taken by AcquireLocks, held until the transaction owning it ends.
+type memoryLock struct {
+	owner    *memoryTx
+	released chan struct{}
+}
+
+// errMemoryDeadlock fails a transaction which would wait for a lock held by a transaction
+// waiting, directly or not, for a lock of its own.
+var errMemoryDeadlock = errors.New("storage: deadlock detected")
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		state: &memoryState{
+			contacts:    make(map[int64]Contact),
+			nextID:      1,
+			merges:      make(map[int64]Merge),
+			nextMergeID: 1,
+			nextEventID: 1,
+			keys:        make(map[string]IdempotencyKey),
+		},
+		locks: make(map[string]*memoryLock),
+	}
+}
+
+func (m *memoryDB) begin(ctx context.Context, opts *sql.TxOptions) (*memoryTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tx := &memoryTx{db: m, writes: newMemoryWrites()}
+	if opts != nil && opts.Isolation >= sql.LevelRepeatableRead {
+		m.mu.Lock()
+		tx.snapshot = m.state.clone()
+		m.mu.Unlock()
+	}
+	return tx, nil
+}
+
+// acquire blocks until tx holds the lock on key, or fails with errMemoryDeadlock when waiting
+// would never end.
+func (m *memoryDB) acquire(ctx context.Context, tx *memoryTx, key string) error {
+	for {
+		m.mu.Lock()
+		tx.waiting = ""
+		if tx.done {
+			m.mu.Unlock()
+			return sql.ErrTxDone
+		}
+
+		l, ok := m.locks[key]
+		if !ok {
+			m.locks[key] = &memoryLock{owner: tx, released: make(chan struct{})}
+			tx.held = append(tx.held, key)
+			m.mu.Unlock()
+			return nil
+		}
+		if l.owner == tx {
+			m.mu.Unlock()
+			return nil
+		}
+		if m.waitsFor(l.owner, tx) {
+			m.mu.Unlock()
+			return errMemoryDeadlock
+		}
+		tx.waiting = key
+		m.mu.Unlock()
+
+		select {
+		case <-l.released:
+		case <-ctx.Done():
+			m.mu.Lock()
+			tx.waiting = ""
+			m.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// waitsFor tells whether tx is waiting for a lock held by other, directly or through the
+// transactions holding the locks it waits for.
+func (m *memoryDB) waitsFor(tx, other *memoryTx) bool {
+	seen := make(map[*memoryTx]bool)
+	for tx != nil && !seen[tx] {
+		if tx == other {
+			return true
+		}
+		seen[tx] = true
+
+		l, ok := m.locks[tx.waiting]
+		if !ok {
+			return false
+		}
+		tx = l.owner
+	}
+	return false
+}
+
+// release releases the locks held by tx. It is called with mu held.
+func (m *memoryDB) release(tx *memoryTx) {
+	for _, key := range tx.held {
+		close(m.locks[key].released)
+		delete(m.locks, key)
+	}
+	tx.held = nil
+}
+
+func (s *memoryState) clone() *memoryState {
+	contacts := make(map[int64]Contact, len(s.contacts))
+	for id, c := range s.contacts {
+		contacts[id] = c
+	}
+	merges := make(map[int64]Merge, len(s.merges))
+	for id, m := range s.merges {
+		merges[id] = m
+	}
+	keys := make(map[string]IdempotencyKey, len(s.keys))
+	for key, k := range s.keys {
+		keys[key] = k
+	}
+	return &memoryState{
+		contacts:    contacts,
+		nextID:      s.nextID,
+		merges:      merges,
+		nextMergeID: s.nextMergeID,
+		// Capping the capacity makes the first append in the copy reallocate.
+		events:      s.events[:len(s.events):len(s.events)],
+		nextEventID: s.nextEventID,
+		keys:        keys,
+	}
+}
+
+// memoryWrites are the rows written by a transaction. Contacts and merges are never deleted,
+// while a deleted idempotency key is recorded as nil.
+type memoryWrites struct {
+	contacts map[int64]Contact
+	merges   map[int64]Merge
+	events   []Event
+	keys     map[string]*IdempotencyKey
+}
+
+func newMemoryWrites() *memoryWrites {
+	return &memoryWrites{
+		contacts: make(map[int64]Contact),
+		merges:   make(map[int64]Merge),
+		keys:     make(map[string]*IdempotencyKey),
+	}
+}
+
+// apply writes the rows to s, keeping its events ordered by id.
+func (w *memoryWrites) apply(s *memoryState) {
+	for id, c := range w.contacts {
+		s.contacts[id] = c
+	}
+	for id, m := range w.merges {
+		s.merges[id] = m
+	}
+	if n := len(s.events); len(w.events) > 0 && n > 0 && s.events[n-1].ID > w.events[0].ID {
+		// Events committed meanwhile by other transactions took later ids: the events are merged
+		// into a new array, as clones of s share the current one.
+		s.events = mergeEvents(s.events, w.events)
+	} else {
+		// Clones of s cap their events, so they do not see the ones appended past them.
+		s.events = append(s.events, w.events...)
+	}
+	for key, k := range w.keys {
+		if k == nil {
+			delete(s.keys, key)
+		} else {
+			s.keys[key] = *k
+		}
+	}
+}
+
+// mergeEvents merges two lists of events ordered by id into a new one.
+func mergeEvents(a, b []Event) []Event {
+	result := make([]Event, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0].ID < b[0].ID {
+			result, a = append(result, a[0]), a[1:]
+		} else {
+			result, b = append(result, b[0]), b[1:]
+		}
+	}
+	return append(append(result, a...), b...)
+}
+
+// memoryView is the state a statement sees: the committed state, or the snapshot of a repeatable
+// read transaction, under the writes of its transaction. Writes are recorded in the transaction,
+// or applied to the committed state outside of one. Ids are always taken from the committed state.
+type memoryView struct {
+	base      *memoryState
+	committed *memoryState
+	writes    *memoryWrites
+}
+
+func (v *memoryView) contact(id int64) (Contact, bool) {
+	if v.writes != nil {
+		if c, ok := v.writes.contacts[id]; ok {
+			return c, true
+		}
+	}
+	c, ok := v.base.contacts[id]
+	return c, ok
+}
+
+// contacts calls fn with every contact, in no particular order.
+func (v *memoryView) contacts(fn func(c Contact)) {
+	if v.writes != nil {
+		for _, c := range v.writes.contacts {
+			fn(c)
+		}
+	}
+	for id, c := range v.base.contacts {
+		if v.writes != nil {
+			if _, ok := v.writes.contacts[id]; ok {
+				continue
+			}
+		}
+		fn(c)
+	}
+}
+
+func (v *memoryView) putContact(c Contact) {
+	if v.writes != nil {
+		v.writes.contacts[c.ID] = c
+	} else {
+		v.base.contacts[c.ID] = c
+	}
+}
+
+func (v *memoryView) nextContactID() int64 {
+	id := v.committed.nextID
+	v.committed.nextID++
+	return id
+}
+
+func (v *memoryView) merge(id int64) (Merge, bool) {
+	if v.writes != nil {
+		if m, ok := v.writes.merges[id]; ok {
+			return m, true
+		}
+	}
+	m, ok := v.base.merges[id]
+	return m, ok
+}
+
+// merges calls fn with every merge, in no particular order.
+func (v *memoryView) merges(fn func(m Merge)) {
+	if v.writes != nil {
+		for _, m := range v.writes.merges {
+			fn(m)
+		}
+	}
+	for id, m := range v.base.merges {
+		if v.writes != nil {
+			if _, ok := v.writes.merges[id]; ok {
+				continue
+			}
+		}
+		fn(m)
+	}
+}
+
+func (v *memoryView) putMerge(m Merge) {
+	if v.writes != nil {
+		v.writes.merges[m.ID] = m
+	} else {
+		v.base.merges[m.ID] = m
+	}
+}
+
+func (v *memoryView) nextMergeID() int64 {
+	id := v.committed.nextMergeID
+	v.committed.nextMergeID++
+	return id
+}
+
+// events returns the events ordered by id.
+func (v *memoryView) events() []Event {
+	if v.writes == nil || len(v.writes.events) == 0 {
+		return v.base.events
+	}
+	return mergeEvents(v.base.events, v.writes.events)
+}
+
+func (v *memoryView) addEvent(e Event) {
+	if v.writes != nil {
+		v.writes.events = append(v.writes.events, e)
+	} else {
+		v.base.events = append(v.base.events, e)
+	}
+}
+
+func (v *memoryView) nextEventID() int64 {
+	id := v.committed.nextEventID
+	v.committed.nextEventID++
+	return id
+}
+
+func (v *memoryView) key(name string) (IdempotencyKey, bool) {
+	if v.writes != nil {
+		if k, ok := v.writes.keys[name]; ok {
+			if k == nil {
+				return IdempotencyKey{}, false
+			}
+			return *k, true
+		}
+	}
+	k, ok := v.base.keys[name]
+	return k, ok
+}
+
+// keys calls fn with every idempotency key, in no particular order.
+func (v *memoryView) keys(fn func(k IdempotencyKey)) {
+	if v.writes != nil {
+		for _, k := range v.writes.keys {
+			if k != nil {
+				fn(*k)
+			}
+		}
+	}
+	for name, k := range v.base.keys {
+		if v.writes != nil {
+			if _, ok := v.writes.keys[name]; ok {
+				continue
+			}
+		}
+		fn(k)
+	}
+}
+
+func (v *memoryView) putKey(k IdempotencyKey) {
+	if v.writes != nil {
+		v.writes.keys[k.Key] = &k
+	} else {
+		v.base.keys[k.Key] = k
+	}
+}
+
+func (v *memoryView) deleteKey(name string) {
+	if v.writes != nil {
+		v.writes.keys[name] = nil
+	} else {
+		delete(v.base.keys, name)
+	}
+}
+
+// memoryTx collects the writes of a transaction, applied to the shared state on Commit and
+// discarded on Rollback. Its fields but db are guarded by db.mu.
+type memoryTx struct {
+	db       *memoryDB
+	writes   *memoryWrites
+	snapshot *memoryState
+	held     []string
+	waiting  string
+	done     bool
+}
+
+// run runs fn against the state the transaction sees, recording the rows fn writes. It is
+// called with db.mu held. As fn writes rows as it goes, it must not fail once it wrote one.
+func (t *memoryTx) run(fn func(view *memoryView) error) error {
+	base := t.snapshot
+	if base == nil {
+		base = t.db.state
+	}
+	return fn(&memoryView{base: base, committed: t.db.state, writes: t.writes})
+}
+
+func (t *memoryTx) Commit() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.writes.apply(t.db.state)
+	t.db.release(t)
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.db.release(t)
+	return nil
+}
+
+// memoryConn plays the role of the database connection for the memory storages.
+type memoryConn struct {
+	db *memoryDB
+	tx *memoryTx
+}
+
+type memoryContactStorage struct {
+	memoryConn
+}
+
+func newMemoryContactStorage(db *memoryDB, tx *memoryTx) ContactStorage {
+	return &memoryContactStorage{memoryConn{db: db, tx: tx}}
+}
+
+// run executes fn against the transaction's state when one is in progress,
+// otherwise against the shared state as a single autocommitted statement.
+// Like a query, it fails once ctx is done.
+func (m memoryConn) run(ctx context.Context, fn func(view *memoryView) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if m.tx != nil {
+		if m.tx.done {
+			return sql.ErrTxDone
+		}
+		return m.tx.run(fn)
+	}
+	return fn(&memoryView{base: m.db.state, committed: m.db.state})
+}
+
+func (m *memoryContactStorage) ListContacts(ctx context.Context) ([]Contact, error) {
+	var result []Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		result = view.filter(func(c Contact) bool {
+			return true
+		})
+		return nil
+	})
+	return result, err
+}
+
+func (m *memoryContactStorage) ListContactsByEmailAndPhoneNumber(ctx context.Context, email string, phoneNumber string) ([]Contact, error) {
+	var result []Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		result = view.filter(func(c Contact) bool {
+			return (email != "" && c.Email == email) || (phoneNumber != "" && c.PhoneNumber == phoneNumber)
+		})
+		return nil
+	})
+	return result, err
+}
+
+func (m *memoryContactStorage) ListContactsByIdentifiers(ctx context.Context, identifiers []Identifier) ([]Contact, error) {
+	wanted := make(map[Identifier]bool, len(identifiers))
+	for _, id := range identifiers {
+		wanted[id] = true
+	}
+
+	var result []Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		result = view.filter(func(c Contact) bool {
+			for _, id := range c.Identifiers {
+				if wanted[id] {
+					return true
+				}
+			}
+			return false
+		})
+		return nil
+	})
+	return result, err
+}
+
+func (m *memoryContactStorage) ListContactsByID(ctx context.Context, id int64) ([]Contact, error) {
+	var result []Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		members := view.cluster(id)
+		result = view.filter(func(c Contact) bool {
+			return members[c.ID]
+		})
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].CreatedAt.Before(*result[j].CreatedAt)
+		})
+		return nil
+	})
+	return result, err
+}
+
+func (m *memoryContactStorage) GetContact(ctx context.Context, id int64) (*Contact, error) {
+	var result Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok || c.DeletedAt != nil {
+			return sql.ErrNoRows
+		}
+		result = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (m *memoryContactStorage) GetPrimaryContact(ctx context.Context, id int64) (*Contact, error) {
+	var result Contact
+	err := m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok || c.DeletedAt != nil {
+			return sql.ErrNoRows
+		}
+
+		visited := map[int64]bool{id: true}
+		for c.LinkedID != 0 {
+			if visited[c.LinkedID] {
+				return sql.ErrNoRows
+			}
+			visited[c.LinkedID] = true
+
+			if c, ok = view.contact(c.LinkedID); !ok {
+				return sql.ErrNoRows
+			}
+		}
+		if c.DeletedAt != nil {
+			return sql.ErrNoRows
+		}
+		result = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (m *memoryContactStorage) FlattenCluster(ctx context.Context, primaryID int64) (int64, error) {
+	var n int64
+	err := m.run(ctx, func(view *memoryView) error {
+		for id := range view.cluster(primaryID) {
+			c, _ := view.contact(id)
+			if id == primaryID || (c.LinkedID == primaryID && c.LinkPrecedence == "secondary") {
+				continue
+			}
+			c.LinkedID = primaryID
+			c.LinkPrecedence = "secondary"
+			c.touch()
+			view.putContact(c)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (m *memoryContactStorage) CreateContact(ctx context.Context, contact Contact) (int64, error) {
+	var id int64
+	err := m.run(ctx, func(view *memoryView) error {
+		now := time.Now().UTC()
+
+		id = view.nextContactID()
+		view.putContact(Contact{
+			ID:             id,
+			PhoneNumber:    contact.PhoneNumber,
+			Email:          contact.Email,
+			RawPhoneNumber: contact.RawPhoneNumber,
+			RawEmail:       contact.RawEmail,
+			LinkedID:       contact.LinkedID,
+			LinkPrecedence: contact.LinkPrecedence,
+			CreatedAt:      &now,
+			UpdatedAt:      &now,
+			EmailVerified:  contact.EmailVerified,
+			Source:         contact.Source,
+			Identifiers:    sortedIdentifiers(contact.Identifiers),
+		})
+		return nil
+	})
+	return id, err
+}
+
+func (m *memoryContactStorage) UpdateContact(ctx context.Context, id int64, contact Contact) error {
+	return m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok {
+			return nil
+		}
+		if contact.LinkedID != 0 {
+			c.LinkedID = contact.LinkedID
+		}
+		if contact.LinkPrecedence != "" {
+			c.LinkPrecedence = contact.LinkPrecedence
+		}
+		c.touch()
+		view.putContact(c)
+		return nil
+	})
+}
+
+func (m *memoryContactStorage) UpdateEmailAndPhoneNumber(ctx context.Context, id int64, email string, phoneNumber string) error {
+	return m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok {
+			return nil
+		}
+		c.Email = email
+		c.PhoneNumber = phoneNumber
+		c.touch()
+		view.putContact(c)
+		return nil
+	})
+}
+
+func (m *memoryContactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx context.Context, olderContactLinkedID, newerContactLinkedID int64) error {
+	return m.run(ctx, func(view *memoryView) error {
+		var relinked []Contact
+		view.contacts(func(c Contact) {
+			if c.LinkedID == newerContactLinkedID {
+				relinked = append(relinked, c)
+			}
+		})
+		for _, c := range relinked {
+			c.LinkedID = olderContactLinkedID
+			c.touch()
+			view.putContact(c)
+		}
+		return nil
+	})
+}
+
+func (m *memoryContactStorage) PromoteContact(ctx context.Context, id int64) error {
+	return m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok {
+			return nil
+		}
+		c.LinkedID = 0
+		c.LinkPrecedence = "primary"
+		c.touch()
+		view.putContact(c)
+		return nil
+	})
+}
+
+func (m *memoryContactStorage) DeleteContact(ctx context.Context, id int64) error {
+	return m.run(ctx, func(view *memoryView) error {
+		c, ok := view.contact(id)
+		if !ok || c.DeletedAt != nil {
+			return nil
+		}
+		c.touch()
+		c.DeletedAt = c.UpdatedAt
+		view.putContact(c)
+		return nil
+	})
+}
+
+// touch moves UpdatedAt forward, as every write to the contact table does.
+func (c *Contact) touch() {
+	now := time.Now().UTC()
+	c.UpdatedAt = &now
+}
+
+// AcquireLocks takes the locks in the same order as the Postgres storage does. Outside of a
+// transaction, it only waits for the transactions holding them.
+func (m *memoryContactStorage) AcquireLocks(ctx context.Context, keys ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := m.tx
+	if tx == nil {
+		tx = &memoryTx{db: m.db}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if err := m.db.acquire(ctx, tx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cluster returns the ids of the contacts whose chain of LinkedID leads to id, and id itself.
+// Deleted contacts are followed, so that a chain broken by a deletion is still found.
+func (v *memoryView) cluster(id int64) map[int64]bool {
+	result := make(map[int64]bool)
+	if _, ok := v.contact(id); !ok {
+		return result
+	}
+	result[id] = true
+
+	for grown := true; grown; {
+		grown = false
+		v.contacts(func(c Contact) {
+			if c.LinkedID != 0 && result[c.LinkedID] && !result[c.ID] {
+				result[c.ID] = true
+				grown = true
+			}
+		})
+	}
+	return result
+}
+
+// filter returns the contacts that are not deleted and match fn ordered by id,
+// the order in which they were inserted.
+func (v *memoryView) filter(fn func(c Contact) bool) []Contact {
+	var result []Contact
+	v.contacts(func(c Contact) {
+		if c.DeletedAt == nil && fn(c) {
+			result = append(result, c)
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+type memoryMergeStorage struct {
+	memoryConn
+}
+
+func newMemoryMergeStorage(db *memoryDB, tx *memoryTx) MergeStorage {
+	return &memoryMergeStorage{memoryConn{db: db, tx: tx}}
+}
+
+func (m *memoryMergeStorage) CreateMerge(ctx context.Context, merge Merge) (int64, error) {
+	var id int64
+	err := m.run(ctx, func(view *memoryView) error {
+		now := time.Now().UTC()
+
+		id = view.nextMergeID()
+
+		merge.ID = id
+		merge.MemberIDs = append([]int64(nil), merge.MemberIDs...)
+		sort.Slice(merge.MemberIDs, func(i, j int) bool {
+			return merge.MemberIDs[i] < merge.MemberIDs[j]
+		})
+		merge.Identifiers = sortedIdentifiers(merge.Identifiers)
+		merge.CreatedAt = &now
+		merge.RevertedAt = nil
+		view.putMerge(merge)
+		return nil
+	})
+	return id, err
+}
+
+func (m *memoryMergeStorage) GetLatestMergeByMember(ctx context.Context, contactID int64) (*Merge, error) {
+	return m.latest(ctx, func(merge Merge) bool {
+		for _, id := range merge.MemberIDs {
+			if id == contactID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *memoryMergeStorage) GetLatestMergeByIdentifiers(ctx context.Context, email string, phoneNumber string, identifiers []Identifier) (*Merge, error) {
+	identifiers = sortedIdentifiers(identifiers)
+	return m.latest(ctx, func(merge Merge) bool {
+		return merge.Email == email && merge.PhoneNumber == phoneNumber && reflect.DeepEqual(merge.Identifiers, identifiers)
+	})
+}
+
+// latest returns the most recent merge that is not reverted and matches fn.
+func (m *memoryMergeStorage) latest(ctx context.Context, fn func(merge Merge) bool) (*Merge, error) {
+	var result *Merge
+	err := m.run(ctx, func(view *memoryView) error {
+		view.merges(func(merge Merge) {
+			if merge.RevertedAt != nil || !fn(merge) {
+				return
+			}
+			if result == nil || merge.ID > result.ID {
+				found := merge
+				found.MemberIDs = append([]int64(nil), merge.MemberIDs...)
+				found.Identifiers = append([]Identifier(nil), merge.Identifiers...)
+				result = &found
+			}
+		})
+		if result == nil {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *memoryMergeStorage) ListRevertedMerges(ctx context.Context) ([]Merge, error) {
+	var result []Merge
+	err := m.run(ctx, func(view *memoryView) error {
+		view.merges(func(merge Merge) {
+			if merge.RevertedAt != nil {
+				merge.MemberIDs = nil
+				result = append(result, merge)
+			}
+		})
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].ID < result[j].ID
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *memoryMergeStorage) RevertMerge(ctx context.Context, id int64) error {
+	return m.run(ctx, func(view *memoryView) error {
+		merge, ok := view.merge(id)
+		if !ok {
+			return nil
+		}
+		now := time.Now().UTC()
+		merge.RevertedAt = &now
+		view.putMerge(merge)
+		return nil
+	})
+}
+
+type memoryEventStorage struct {
+	memoryConn
+}
+
+func newMemoryEventStorage(db *memoryDB, tx *memoryTx) EventStorage {
+	return &memoryEventStorage{memoryConn{db: db, tx: tx}}
+}
+
+func (m *memoryEventStorage) CreateEvent(ctx context.Context, event Event) (int64, error) {
+	var id int64
+	err := m.run(ctx, func(view *memoryView) error {
+		now := time.Now().UTC()
+
+		id = view.nextEventID()
+
+		event.ID = id
+		event.Identifiers = sortedIdentifiers(event.Identifiers)
+		event.CreatedAt = &now
+		view.addEvent(event)
+		return nil
+	})
+	return id, err
+}
+
+func (m *memoryEventStorage) ListEventsByContactIDs(ctx context.Context, ids []int64) ([]Event, error) {
+	wanted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var result []Event
+	err := m.run(ctx, func(view *memoryView) error {
+		for _, ev := range view.events() {
+			if wanted[ev.ContactID] || (ev.PrimaryID != 0 && wanted[ev.PrimaryID]) {
+				result = append(result, ev)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+type memoryIdempotencyStorage struct {
+	memoryConn
+}
+
+func newMemoryIdempotencyStorage(db *memoryDB, tx *memoryTx) IdempotencyStorage {
+	return &memoryIdempotencyStorage{memoryConn{db: db, tx: tx}}
+}
+
+func (m *memoryIdempotencyStorage) GetIdempotencyKey(ctx context.Context, key string, ttl time.Duration) (*IdempotencyKey, error) {
+	var result *IdempotencyKey
+	err := m.run(ctx, func(view *memoryView) error {
+		k, ok := view.key(key)
+		if !ok || time.Now().UTC().Sub(*k.CreatedAt) >= ttl {
+			return sql.ErrNoRows
+		}
+		k.Response = append([]byte(nil), k.Response...)
+		result = &k
+		return nil
+	})
+	return result, err
+}
+
+func (m *memoryIdempotencyStorage) SaveIdempotencyKey(ctx context.Context, key IdempotencyKey, ttl time.Duration) error {
+	return m.run(ctx, func(view *memoryView) error {
+		now := time.Now().UTC()
+		key.Response = append([]byte(nil), key.Response...)
+		key.CreatedAt = &now
+		view.putKey(key)
+
+		// As Postgres skips the rows locked by other transactions, keys whose request is in
+		// progress in another transaction are left to it.
+		var expired []IdempotencyKey
+		view.keys(func(k IdempotencyKey) {
+			if k.Key == key.Key || now.Sub(*k.CreatedAt) < ttl {
+				return
+			}
+			if l, ok := m.db.locks[IdempotencyLockKey(k.Key)]; ok && l.owner != m.tx {
+				return
+			}
+			expired = append(expired, k)
+		})
+		sort.Slice(expired, func(i, j int) bool {
+			if !expired[i].CreatedAt.Equal(*expired[j].CreatedAt) {
+				return expired[i].CreatedAt.Before(*expired[j].CreatedAt)
+			}
+			return expired[i].Key < expired[j].Key
+		})
+		if len(expired) > idempotencyKeysPurged {
+			expired = expired[:idempotencyKeysPurged]
+		}
+		for _, k := range expired {
+			view.deleteKey(k.Key)
+		}
+		return nil
+	})
+}
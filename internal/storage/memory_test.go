@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	asserts "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_Memory_ContactStorage(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	id1, err := s.Contact.CreateContact(ctx, Contact{PhoneNumber: "12345", Email: "a@gmail.com", LinkPrecedence: "primary"})
+	assert.Nil(err)
+	id2, err := s.Contact.CreateContact(ctx, Contact{PhoneNumber: "56789", Email: "b@gmail.com", LinkPrecedence: "primary"})
+	assert.Nil(err)
+	id3, err := s.Contact.CreateContact(ctx, Contact{PhoneNumber: "56789", LinkedID: id2, LinkPrecedence: "secondary"})
+	assert.Nil(err)
+
+	got, err := s.Contact.ListContactsByEmailAndPhoneNumber(ctx, "a@gmail.com", "56789")
+	assert.Nil(err)
+	assert.Equal([]int64{id1, id2, id3}, contactIDs(got))
+
+	got, err = s.Contact.ListContactsByEmailAndPhoneNumber(ctx, "", "12345")
+	assert.Nil(err)
+	assert.Equal([]int64{id1}, contactIDs(got))
+
+	got, err = s.Contact.ListContactsByID(ctx, id2)
+	assert.Nil(err)
+	assert.Equal([]int64{id2, id3}, contactIDs(got))
+
+	c, err := s.Contact.GetContact(ctx, id3)
+	assert.Nil(err)
+	assert.Equal(Contact{ID: id3, PhoneNumber: "56789", LinkedID: id2, LinkPrecedence: "secondary", CreatedAt: c.CreatedAt, UpdatedAt: c.CreatedAt}, *c)
+
+	_, err = s.Contact.GetContact(ctx, 100)
+	assert.Equal(sql.ErrNoRows, err)
+
+	assert.Nil(s.Contact.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx, id1, id2))
+	assert.Nil(s.Contact.UpdateContact(ctx, id2, Contact{LinkedID: id1, LinkPrecedence: "secondary"}))
+
+	got, err = s.Contact.ListContactsByID(ctx, id1)
+	assert.Nil(err)
+	assert.Equal([]int64{id1, id2, id3}, contactIDs(got))
+	assert.Equal("secondary", got[1].LinkPrecedence)
+	assert.Equal(id1, got[1].LinkedID)
+	assert.True(got[1].UpdatedAt.After(*got[1].CreatedAt))
+	assert.True(got[2].UpdatedAt.After(*got[2].CreatedAt))
+	assert.Equal(got[0].CreatedAt, got[0].UpdatedAt)
+}
+
+func Test_Memory_Transactions(t *testing.T) {
+	ctx := context.Background()
+	t.Run("commit makes changes visible", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx, err := s.BeginTx(context.Background(), &sql.TxOptions{})
+		assert.Nil(err)
+		id, err := tx.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+		assert.Nil(err)
+		assert.Nil(tx.Commit())
+		assert.Equal(sql.ErrTxDone, tx.Commit())
+
+		_, err = tx.Contact.GetContact(ctx, id)
+		assert.Equal(sql.ErrTxDone, err)
+
+		c, err := s.Contact.GetContact(ctx, id)
+		assert.Nil(err)
+		assert.Equal("a@gmail.com", c.Email)
+	})
+
+	t.Run("rollback discards changes", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx, err := s.BeginTx(context.Background(), &sql.TxOptions{})
+		assert.Nil(err)
+		id, err := tx.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+		assert.Nil(err)
+		assert.Nil(tx.Rollback())
+
+		_, err = s.Contact.GetContact(ctx, id)
+		assert.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("transactions run concurrently", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx1, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		tx2, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		readOnly, err := s.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		assert.Nil(err)
+
+		id1, err := tx1.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+		assert.Nil(err)
+		id2, err := tx2.Contact.CreateContact(ctx, Contact{Email: "b@gmail.com", LinkPrecedence: "primary"})
+		assert.Nil(err)
+		assert.NotEqual(id1, id2)
+
+		// Uncommitted writes are only seen by their own transaction.
+		got, err := tx2.Contact.ListContacts(ctx)
+		assert.Nil(err)
+		assert.Equal([]int64{id2}, contactIDs(got))
+
+		assert.Nil(tx1.Commit())
+
+		// Read committed transactions see the commit at their next statement, repeatable read
+		// ones keep reading the state at their first statement.
+		got, err = tx2.Contact.ListContacts(ctx)
+		assert.Nil(err)
+		assert.Equal([]int64{id1, id2}, contactIDs(got))
+		got, err = readOnly.Contact.ListContacts(ctx)
+		assert.Nil(err)
+		assert.Empty(got)
+
+		assert.Nil(tx2.Commit())
+		assert.Nil(readOnly.Rollback())
+
+		got, err = s.Contact.ListContacts(ctx)
+		assert.Nil(err)
+		assert.Equal([]int64{id1, id2}, contactIDs(got))
+	})
+
+	t.Run("events are listed by id whatever the order of commits", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx1, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		tx2, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+
+		id1, err := tx1.Event.CreateEvent(ctx, Event{ContactID: 1, Type: "created"})
+		assert.Nil(err)
+		id2, err := tx2.Event.CreateEvent(ctx, Event{ContactID: 1, Type: "linked"})
+		assert.Nil(err)
+		id3, err := tx1.Event.CreateEvent(ctx, Event{ContactID: 1, Type: "merged"})
+		assert.Nil(err)
+
+		got, err := tx1.Event.ListEventsByContactIDs(ctx, []int64{1})
+		assert.Nil(err)
+		assert.Equal([]int64{id1, id3}, eventIDs(got))
+
+		assert.Nil(tx2.Commit())
+		got, err = tx1.Event.ListEventsByContactIDs(ctx, []int64{1})
+		assert.Nil(err)
+		assert.Equal([]int64{id1, id2, id3}, eventIDs(got))
+
+		assert.Nil(tx1.Commit())
+		got, err = s.Event.ListEventsByContactIDs(ctx, []int64{1})
+		assert.Nil(err)
+		assert.Equal([]int64{id1, id2, id3}, eventIDs(got))
+	})
+
+	t.Run("locks are held until the transaction ends", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx1, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		assert.Nil(tx1.Contact.AcquireLocks(ctx, "b", "a", "a"))
+
+		tx2, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(context.DeadlineExceeded, tx2.Contact.AcquireLocks(timeout, "a"))
+		assert.Nil(tx2.Contact.AcquireLocks(ctx, "c"))
+
+		locked := make(chan error)
+		go func() {
+			locked <- tx2.Contact.AcquireLocks(ctx, "a")
+		}()
+		select {
+		case err := <-locked:
+			assert.Fail("lock taken while held", "error: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		assert.Nil(tx1.Commit())
+		assert.Nil(<-locked)
+
+		// Outside of a transaction, locks are only waited for.
+		assert.Equal(context.DeadlineExceeded, s.Contact.AcquireLocks(timeout, "c"))
+		assert.Nil(s.Contact.AcquireLocks(ctx, "b"))
+		assert.Nil(tx2.Rollback())
+		assert.Nil(s.Contact.AcquireLocks(ctx, "a", "c"))
+	})
+
+	t.Run("deadlocks fail the transaction closing the cycle", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		tx1, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		tx2, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		assert.Nil(tx1.Contact.AcquireLocks(ctx, "a"))
+		assert.Nil(tx2.Contact.AcquireLocks(ctx, "b"))
+
+		locked := make(chan error)
+		go func() {
+			locked <- tx1.Contact.AcquireLocks(ctx, "b")
+		}()
+		assert.Eventually(func() bool {
+			s.memory.mu.Lock()
+			defer s.memory.mu.Unlock()
+			return tx1.tx.(*memoryTx).waiting == "b"
+		}, time.Second, time.Millisecond)
+		assert.Equal(errMemoryDeadlock, tx2.Contact.AcquireLocks(ctx, "a"))
+
+		assert.Nil(tx2.Rollback())
+		assert.Nil(<-locked)
+		assert.Nil(tx1.Commit())
+	})
+
+	t.Run("statements fail once the context is done", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := s.Contact.CreateContact(canceled, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+		assert.Equal(context.Canceled, err)
+
+		tx, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		_, err = tx.Contact.ListContacts(canceled)
+		assert.Equal(context.Canceled, err)
+		assert.Nil(tx.Rollback())
+	})
+
+	t.Run("transactions do not change the store", func(t *testing.T) {
+		assert := asserts.New(t)
+		s := NewMemory()
+		contacts := s.Contact
+
+		tx, err := s.BeginTx(ctx, &sql.TxOptions{})
+		assert.Nil(err)
+		assert.True(contacts == s.Contact)
+		_, err = tx.BeginTx(ctx, &sql.TxOptions{})
+		assert.Equal(errInTx, err)
+		assert.Nil(tx.Rollback())
+
+		assert.Equal(errNotInTx, s.Commit())
+		assert.Equal(errNotInTx, s.Rollback())
+	})
+}
+
+func Test_Memory_IdempotencyKeys(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	_, err := s.Idempotency.GetIdempotencyKey(ctx, "k-1", time.Hour)
+	assert.Equal(sql.ErrNoRows, err)
+
+	assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "k-1", RequestHash: "abc", Response: []byte("1")}, time.Hour))
+	got, err := s.Idempotency.GetIdempotencyKey(ctx, "k-1", time.Hour)
+	assert.Nil(err)
+	assert.Equal("abc", got.RequestHash)
+	assert.Equal([]byte("1"), got.Response)
+
+	// Keys saved longer than ttl ago are expired.
+	_, err = s.Idempotency.GetIdempotencyKey(ctx, "k-1", 0)
+	assert.Equal(sql.ErrNoRows, err)
+
+	// Saving a key again replaces it.
+	assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "k-1", RequestHash: "def", Response: []byte("2")}, time.Hour))
+	got, err = s.Idempotency.GetIdempotencyKey(ctx, "k-1", time.Hour)
+	assert.Nil(err)
+	assert.Equal("def", got.RequestHash)
+	assert.Equal([]byte("2"), got.Response)
+
+	// Saving a key deletes the expired ones.
+	assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "k-2", RequestHash: "ghi", Response: []byte("3")}, 0))
+	_, err = s.Idempotency.GetIdempotencyKey(ctx, "k-1", 24*time.Hour)
+	assert.Equal(sql.ErrNoRows, err)
+	got, err = s.Idempotency.GetIdempotencyKey(ctx, "k-2", time.Hour)
+	assert.Nil(err)
+	assert.Equal("ghi", got.RequestHash)
+
+	// Unless another transaction holds their lock.
+	tx, err := s.BeginTx(ctx, &sql.TxOptions{})
+	assert.Nil(err)
+	assert.Nil(tx.Contact.AcquireLocks(ctx, IdempotencyLockKey("k-2")))
+	assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "k-3", RequestHash: "jkl", Response: []byte("4")}, 0))
+	_, err = s.Idempotency.GetIdempotencyKey(ctx, "k-2", time.Hour)
+	assert.Nil(err)
+	assert.Nil(tx.Rollback())
+
+	// A save deletes at most idempotencyKeysPurged keys, the oldest first.
+	s = NewMemory()
+	for i := 0; i <= idempotencyKeysPurged; i++ {
+		assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: fmt.Sprintf("old-%03d", i)}, time.Hour))
+	}
+	assert.Nil(s.Idempotency.SaveIdempotencyKey(ctx, IdempotencyKey{Key: "new"}, 0))
+	_, err = s.Idempotency.GetIdempotencyKey(ctx, fmt.Sprintf("old-%03d", idempotencyKeysPurged-1), time.Hour)
+	assert.Equal(sql.ErrNoRows, err)
+	got, err = s.Idempotency.GetIdempotencyKey(ctx, fmt.Sprintf("old-%03d", idempotencyKeysPurged), time.Hour)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("old-%03d", idempotencyKeysPurged), got.Key)
+}
+
+func eventIDs(events []Event) []int64 {
+	ids := make([]int64, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func contactIDs(contacts []Contact) []int64 {
+	ids := make([]int64, 0, len(contacts))
+	for _, c := range contacts {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+func Test_Memory_MergeStorage(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	id1, err := s.Merge.CreateMerge(ctx, Merge{PrimaryID: 1, MergedID: 2, MemberIDs: []int64{3, 2}, Email: "a@gmail.com", PhoneNumber: "12345"})
+	assert.Nil(err)
+	id2, err := s.Merge.CreateMerge(ctx, Merge{PrimaryID: 4, MergedID: 1, MemberIDs: []int64{1, 2, 3}})
+	assert.Nil(err)
+
+	got, err := s.Merge.GetLatestMergeByMember(ctx, 2)
+	assert.Nil(err)
+	assert.Equal(id2, got.ID)
+
+	got, err = s.Merge.GetLatestMergeByIdentifiers(ctx, "a@gmail.com", "12345", nil)
+	assert.Nil(err)
+	assert.Equal(id1, got.ID)
+	assert.Equal([]int64{2, 3}, got.MemberIDs)
+
+	id3, err := s.Merge.CreateMerge(ctx, Merge{PrimaryID: 5, MergedID: 6, MemberIDs: []int64{6}, Email: "b@gmail.com",
+		Identifiers: []Identifier{{Type: "loyaltyId", Value: "L1"}, {Type: "deviceId", Value: "D1"}}})
+	assert.Nil(err)
+
+	got, err = s.Merge.GetLatestMergeByIdentifiers(ctx, "b@gmail.com", "", []Identifier{{Type: "deviceId", Value: "D1"}, {Type: "loyaltyId", Value: "L1"}})
+	assert.Nil(err)
+	assert.Equal(id3, got.ID)
+	assert.Equal([]Identifier{{Type: "deviceId", Value: "D1"}, {Type: "loyaltyId", Value: "L1"}}, got.Identifiers)
+
+	_, err = s.Merge.GetLatestMergeByIdentifiers(ctx, "b@gmail.com", "", []Identifier{{Type: "loyaltyId", Value: "L1"}})
+	assert.Equal(sql.ErrNoRows, err)
+
+	assert.Nil(s.Merge.RevertMerge(ctx, id2))
+
+	got, err = s.Merge.GetLatestMergeByMember(ctx, 2)
+	assert.Nil(err)
+	assert.Equal(id1, got.ID)
+
+	_, err = s.Merge.GetLatestMergeByMember(ctx, 4)
+	assert.Equal(sql.ErrNoRows, err)
+}
+
+func Test_Memory_DeleteContact(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	id1, err := s.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+	assert.Nil(err)
+	id2, err := s.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", PhoneNumber: "12345", LinkedID: id1, LinkPrecedence: "secondary"})
+	assert.Nil(err)
+
+	assert.Nil(s.Contact.DeleteContact(ctx, id1))
+
+	_, err = s.Contact.GetContact(ctx, id1)
+	assert.Equal(sql.ErrNoRows, err)
+
+	got, err := s.Contact.ListContactsByEmailAndPhoneNumber(ctx, "a@gmail.com", "")
+	assert.Nil(err)
+	assert.Equal([]int64{id2}, contactIDs(got))
+
+	got, err = s.Contact.ListContactsByID(ctx, id1)
+	assert.Nil(err)
+	assert.Equal([]int64{id2}, contactIDs(got))
+}
+
+func Test_Memory_Chains(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	// 3 -> 2 -> 1, as left by legacy data.
+	id1, err := s.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+	assert.Nil(err)
+	id2, err := s.Contact.CreateContact(ctx, Contact{Email: "b@gmail.com", LinkedID: id1, LinkPrecedence: "secondary"})
+	assert.Nil(err)
+	id3, err := s.Contact.CreateContact(ctx, Contact{Email: "c@gmail.com", LinkedID: id2, LinkPrecedence: "secondary"})
+	assert.Nil(err)
+
+	p, err := s.Contact.GetPrimaryContact(ctx, id3)
+	assert.Nil(err)
+	assert.Equal(id1, p.ID)
+
+	got, err := s.Contact.ListContactsByID(ctx, id1)
+	assert.Nil(err)
+	assert.Equal([]int64{id1, id2, id3}, contactIDs(got))
+
+	n, err := s.Contact.FlattenCluster(ctx, id1)
+	assert.Nil(err)
+	assert.Equal(int64(1), n)
+
+	c, err := s.Contact.GetContact(ctx, id3)
+	assert.Nil(err)
+	assert.Equal(id1, c.LinkedID)
+
+	// A cycle has no primary contact.
+	assert.Nil(s.Contact.UpdateContact(ctx, id1, Contact{LinkedID: id3, LinkPrecedence: "secondary"}))
+	_, err = s.Contact.GetPrimaryContact(ctx, id2)
+	assert.Equal(sql.ErrNoRows, err)
+}
+
+func Test_Memory_Identifiers(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	s := NewMemory()
+
+	id1, err := s.Contact.CreateContact(ctx, Contact{LinkPrecedence: "primary", Identifiers: []Identifier{{Type: "loyaltyId", Value: "L-1"}, {Type: "deviceId", Value: "D-1"}}})
+	assert.Nil(err)
+	_, err = s.Contact.CreateContact(ctx, Contact{LinkPrecedence: "primary", Identifiers: []Identifier{{Type: "deviceId", Value: "L-1"}}})
+	assert.Nil(err)
+
+	got, err := s.Contact.ListContactsByIdentifiers(ctx, []Identifier{{Type: "loyaltyId", Value: "L-1"}})
+	assert.Nil(err)
+	assert.Equal([]int64{id1}, contactIDs(got))
+	assert.Equal([]Identifier{{Type: "deviceId", Value: "D-1"}, {Type: "loyaltyId", Value: "L-1"}}, got[0].Identifiers)
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/harshabangi/bitespeed/internal/util"
+	"strings"
+	"time"
+)
+
+// MergeStorage records every merge of two clusters, so that it can be reverted.
+type MergeStorage interface {
+	CreateMerge(ctx context.Context, merge Merge) (int64, error)
+	GetLatestMergeByMember(ctx context.Context, contactID int64) (*Merge, error)
+	GetLatestMergeByIdentifiers(ctx context.Context, email string, phoneNumber string, identifiers []Identifier) (*Merge, error)
+	ListRevertedMerges(ctx context.Context) ([]Merge, error)
+	RevertMerge(ctx context.Context, id int64) error
+}
+
+type mergeStorage struct {
+	db database
+}
+
+// Merge is the merge of the cluster of MergedID into the cluster of PrimaryID.
+// MemberIDs are the contacts that belonged to the cluster of MergedID, including
+// itself, right before the merge. Email, PhoneNumber and Identifiers are the
+// identifiers of the request that caused it.
+type Merge struct {
+	ID          int64
+	PrimaryID   int64
+	MergedID    int64
+	MemberIDs   []int64
+	PhoneNumber string
+	Email       string
+	Identifiers []Identifier
+	CreatedAt   *time.Time
+	RevertedAt  *time.Time
+}
+
+const mergeColumns = "id, primary_id, merged_id, phone_number, email, identifiers, created_at"
+
+func NewMergeStorage(conn database) MergeStorage {
+	return &mergeStorage{db: conn}
+}
+
+func (m *mergeStorage) CreateMerge(ctx context.Context, merge Merge) (int64, error) {
+	qp := util.NewQueryParams()
+
+	qp.AddParam("primary_id", merge.PrimaryID)
+	qp.AddParam("merged_id", merge.MergedID)
+	if merge.PhoneNumber != "" {
+		qp.AddParam("phone_number", merge.PhoneNumber)
+	}
+	if merge.Email != "" {
+		qp.AddParam("email", merge.Email)
+	}
+	if len(merge.Identifiers) > 0 {
+		identifiers, err := identifiersJSON(merge.Identifiers)
+		if err != nil {
+			return 0, err
+		}
+		qp.AddParam("identifiers", identifiers)
+	}
+
+	query := fmt.Sprintf("INSERT INTO contact_merge(%s) VALUES(%s) RETURNING id",
+		strings.Join(qp.Columns, ", "), strings.Join(qp.PlaceHolders, ", "))
+
+	var id int64
+	if err := m.db.QueryRowContext(ctx, query, qp.Params...).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	for _, memberID := range merge.MemberIDs {
+		if _, err := m.db.ExecContext(ctx, "INSERT INTO contact_merge_member(merge_id, contact_id) VALUES($1, $2)", id, memberID); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+func (m *mergeStorage) GetLatestMergeByMember(ctx context.Context, contactID int64) (*Merge, error) {
+	query := "SELECT " + mergeColumns + " FROM contact_merge WHERE reverted_at IS NULL AND id IN " +
+		"(SELECT merge_id FROM contact_merge_member WHERE contact_id = $1) ORDER BY id DESC LIMIT 1"
+	return m.getMerge(ctx, query, contactID)
+}
+
+// GetLatestMergeByIdentifiers returns the latest merge not reverted caused by a request with
+// exactly the given identifiers, in any order.
+func (m *mergeStorage) GetLatestMergeByIdentifiers(ctx context.Context, email string, phoneNumber string, identifiers []Identifier) (*Merge, error) {
+	var (
+		where = []string{"reverted_at IS NULL"}
+		args  []interface{}
+	)
+	match := func(column string, value interface{}, present bool) {
+		if !present {
+			where = append(where, column+" IS NULL")
+			return
+		}
+		args = append(args, value)
+		where = append(where, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	match("email", email, email != "")
+	match("phone_number", phoneNumber, phoneNumber != "")
+	if len(identifiers) > 0 {
+		encoded, err := identifiersJSON(identifiers)
+		if err != nil {
+			return nil, err
+		}
+		match("identifiers", encoded, true)
+	} else {
+		match("identifiers", nil, false)
+	}
+
+	query := "SELECT " + mergeColumns + " FROM contact_merge WHERE " + strings.Join(where, " AND ") + " ORDER BY id DESC LIMIT 1"
+	return m.getMerge(ctx, query, args...)
+}
+
+func (m *mergeStorage) getMerge(ctx context.Context, query string, args ...interface{}) (*Merge, error) {
+	var (
+		result      Merge
+		phoneNumber sql.NullString
+		email       sql.NullString
+		identifiers sql.NullString
+	)
+
+	err := m.db.QueryRowContext(ctx, query, args...).Scan(&result.ID, &result.PrimaryID, &result.MergedID, &phoneNumber, &email, &identifiers, &result.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := scanIdentifiers(identifiers, &result.Identifiers); err != nil {
+		return nil, err
+	}
+
+	if phoneNumber.Valid {
+		result.PhoneNumber = phoneNumber.String
+	}
+	if email.Valid {
+		result.Email = email.String
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT contact_id FROM contact_merge_member WHERE merge_id = $1 ORDER BY contact_id", result.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result.MemberIDs = append(result.MemberIDs, id)
+	}
+	return &result, rows.Err()
+}
+
+// ListRevertedMerges returns every reverted merge ordered by id, without its members.
+func (m *mergeStorage) ListRevertedMerges(ctx context.Context) ([]Merge, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT "+mergeColumns+", reverted_at FROM contact_merge WHERE reverted_at IS NOT NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var result []Merge
+	for rows.Next() {
+		var (
+			merge       Merge
+			phoneNumber sql.NullString
+			email       sql.NullString
+			identifiers sql.NullString
+		)
+		if err := rows.Scan(&merge.ID, &merge.PrimaryID, &merge.MergedID, &phoneNumber, &email, &identifiers, &merge.CreatedAt, &merge.RevertedAt); err != nil {
+			return nil, err
+		}
+		if err := scanIdentifiers(identifiers, &merge.Identifiers); err != nil {
+			return nil, err
+		}
+		merge.PhoneNumber = phoneNumber.String
+		merge.Email = email.String
+		result = append(result, merge)
+	}
+	return result, rows.Err()
+}
+
+func (m *mergeStorage) RevertMerge(ctx context.Context, id int64) error {
+	_, err := m.db.ExecContext(ctx, "UPDATE contact_merge SET reverted_at = CURRENT_TIMESTAMP WHERE id = $1", id)
+	return err
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	asserts "github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_Storage_CreateMerge(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO contact_merge(primary_id, merged_id, phone_number, email) VALUES($1, $2, $3, $4) RETURNING id")).
+		WithArgs(1, 2, "12345", "a@gmail.com").WillReturnRows(sqlMock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_merge_member(merge_id, contact_id) VALUES($1, $2)")).
+		WithArgs(7, 2).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_merge_member(merge_id, contact_id) VALUES($1, $2)")).
+		WithArgs(7, 3).WillReturnResult(driver.ResultNoRows)
+
+	s := NewMergeStorage(db)
+	id, err := s.CreateMerge(ctx, Merge{PrimaryID: 1, MergedID: 2, MemberIDs: []int64{2, 3}, PhoneNumber: "12345", Email: "a@gmail.com"})
+	assert.Nil(err)
+	assert.Equal(int64(7), id)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_GetLatestMergeByMember(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, primary_id, merged_id, phone_number, email, identifiers, created_at FROM contact_merge WHERE reverted_at IS NULL AND id IN " +
+		"(SELECT merge_id FROM contact_merge_member WHERE contact_id = $1) ORDER BY id DESC LIMIT 1")).
+		WithArgs(3).
+		WillReturnRows(sqlMock.NewRows([]string{"id", "primary_id", "merged_id", "phone_number", "email", "identifiers", "created_at"}).
+			AddRow(7, 1, 2, "12345", nil, nil, &now))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id FROM contact_merge_member WHERE merge_id = $1 ORDER BY contact_id")).
+		WithArgs(7).
+		WillReturnRows(sqlMock.NewRows([]string{"contact_id"}).AddRow(2).AddRow(3))
+
+	s := NewMergeStorage(db)
+	got, err := s.GetLatestMergeByMember(ctx, 3)
+	assert.Nil(err)
+	assert.Equal(&Merge{ID: 7, PrimaryID: 1, MergedID: 2, MemberIDs: []int64{2, 3}, PhoneNumber: "12345", CreatedAt: &now}, got)
+}
+
+func Test_Storage_GetLatestMergeByIdentifiers(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, primary_id, merged_id, phone_number, email, identifiers, created_at FROM contact_merge "+
+		"WHERE reverted_at IS NULL AND email = $1 AND phone_number IS NULL AND identifiers = $2 ORDER BY id DESC LIMIT 1")).
+		WithArgs("a@gmail.com", `[{"type":"deviceId","value":"D1"},{"type":"loyaltyId","value":"L1"}]`).
+		WillReturnRows(sqlMock.NewRows([]string{"id", "primary_id", "merged_id", "phone_number", "email", "identifiers", "created_at"}).
+			AddRow(7, 1, 2, nil, "a@gmail.com", `[{"type":"deviceId","value":"D1"},{"type":"loyaltyId","value":"L1"}]`, &now))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id FROM contact_merge_member WHERE merge_id = $1 ORDER BY contact_id")).
+		WithArgs(7).
+		WillReturnRows(sqlMock.NewRows([]string{"contact_id"}).AddRow(2))
+
+	s := NewMergeStorage(db)
+	got, err := s.GetLatestMergeByIdentifiers(ctx, "a@gmail.com", "", []Identifier{{Type: "loyaltyId", Value: "L1"}, {Type: "deviceId", Value: "D1"}})
+	assert.Nil(err)
+	assert.Equal(&Merge{ID: 7, PrimaryID: 1, MergedID: 2, MemberIDs: []int64{2}, Email: "a@gmail.com",
+		Identifiers: []Identifier{{Type: "deviceId", Value: "D1"}, {Type: "loyaltyId", Value: "L1"}}, CreatedAt: &now}, got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_ListRevertedMerges(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, primary_id, merged_id, phone_number, email, identifiers, created_at, reverted_at FROM contact_merge WHERE reverted_at IS NOT NULL ORDER BY id")).
+		WillReturnRows(sqlMock.NewRows([]string{"id", "primary_id", "merged_id", "phone_number", "email", "identifiers", "created_at", "reverted_at"}).
+			AddRow(7, 1, 2, "12345", "a@gmail.com", nil, &now, &now).
+			AddRow(9, 1, 4, nil, nil, nil, &now, &now))
+
+	s := NewMergeStorage(db)
+	got, err := s.ListRevertedMerges(ctx)
+	assert.Nil(err)
+	assert.Equal([]Merge{
+		{ID: 7, PrimaryID: 1, MergedID: 2, PhoneNumber: "12345", Email: "a@gmail.com", CreatedAt: &now, RevertedAt: &now},
+		{ID: 9, PrimaryID: 1, MergedID: 4, CreatedAt: &now, RevertedAt: &now},
+	}, got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Storage_RevertMerge(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	db, mock, err := sqlMock.New()
+	assert.Nil(err)
+
+	defer func() { _ = db.Close() }()
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE contact_merge SET reverted_at = CURRENT_TIMESTAMP WHERE id = $1")).
+		WithArgs(7).WillReturnResult(driver.ResultNoRows)
+
+	s := NewMergeStorage(db)
+	assert.Nil(s.RevertMerge(ctx, 7))
+}
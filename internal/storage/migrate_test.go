@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	sqlMock "github.com/DATA-DOG/go-sqlmock"
+	asserts "github.com/stretchr/testify/assert"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func Test_LoadMigrations(t *testing.T) {
+	t.Run("embedded migrations", func(t *testing.T) {
+		assert := asserts.New(t)
+		got, err := loadMigrations(migrationFiles)
+		assert.Nil(err)
+		assert.NotEmpty(got)
+
+		for i, m := range got {
+			assert.Equal(i+1, m.Version)
+			assert.NotEmpty(m.Up)
+			assert.NotEmpty(m.Down)
+		}
+	})
+
+	t.Run("contact updated_at defaults to the statement time", func(t *testing.T) {
+		assert := asserts.New(t)
+		got, err := loadMigrations(migrationFiles)
+		assert.Nil(err)
+
+		var up string
+		for _, m := range got {
+			if strings.Contains(m.Up, "ALTER COLUMN updated_at SET DEFAULT") {
+				up = m.Up
+			}
+		}
+		assert.Contains(up, "SET DEFAULT clock_timestamp()")
+	})
+
+	t.Run("missing down file", func(t *testing.T) {
+		assert := asserts.New(t)
+		_, err := loadMigrations(fstest.MapFS{
+			"migrations/0001_a.up.sql": {Data: []byte("SELECT 1")},
+		})
+		assert.EqualError(err, "migration 1_a requires both an up and a down file")
+	})
+
+	t.Run("invalid file name", func(t *testing.T) {
+		assert := asserts.New(t)
+		_, err := loadMigrations(fstest.MapFS{
+			"migrations/a.sql": {Data: []byte("SELECT 1")},
+		})
+		assert.EqualError(err, "invalid migration file name: migrations/a.sql")
+	})
+}
+
+func testMigrator(t *testing.T) (*Migrator, sqlMock.Sqlmock) {
+	db, mock, err := sqlMock.New()
+	asserts.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+
+	return &Migrator{
+		db: db,
+		migrations: []Migration{
+			{Version: 1, Name: "create_a", Up: "CREATE TABLE a (id INT)", Down: "DROP TABLE a"},
+			{Version: 2, Name: "create_b", Up: "CREATE TABLE b (id INT)", Down: "DROP TABLE b"},
+		},
+	}, mock
+}
+
+func Test_Migrator_Up(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE b (id INT)")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations(version, name) VALUES($1, $2)")).
+		WithArgs(2, "create_b").WillReturnResult(driver.ResultNoRows)
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+
+	got, err := m.Up(ctx)
+	assert.Nil(err)
+	assert.Equal(1, len(got))
+	assert.Equal(2, got[0].Version)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Migrator_Up_RollsBackFailedMigration(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE a (id INT)")).WillReturnError(driver.ErrBadConn)
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+
+	got, err := m.Up(ctx)
+	assert.NotNil(err)
+	assert.Empty(got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Migrator_Up_WaitsForTheLock(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	// Another migrator applied every migration while this one was waiting for the lock.
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockID).
+		WillDelayFor(50 * time.Millisecond).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+
+	got, err := m.Up(ctx)
+	assert.Nil(err)
+	assert.Empty(got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Migrator_Up_LockFailure(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockID).WillReturnError(context.DeadlineExceeded)
+
+	got, err := m.Up(ctx)
+	assert.NotNil(err)
+	assert.Empty(got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Migrator_Down(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE b")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations WHERE version = $1")).
+		WithArgs(2).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(migrationLockID).WillReturnResult(driver.ResultNoRows)
+
+	got, err := m.Down(ctx)
+	assert.Nil(err)
+	assert.Equal(2, got.Version)
+	assert.Nil(mock.ExpectationsWereMet())
+}
+
+func Test_Migrator_Status(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	now := time.Now().UTC()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(driver.ResultNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}).AddRow(1, now))
+
+	got, err := m.Status(ctx)
+	assert.Nil(err)
+	assert.Equal(2, len(got))
+	assert.Equal(&now, got[0].AppliedAt)
+	assert.Nil(got[1].AppliedAt)
+}
+
+func Test_Migrator_Pending(t *testing.T) {
+	assert := asserts.New(t)
+	ctx := context.Background()
+	m, mock := testMigrator(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, applied_at FROM schema_migrations")).
+		WillReturnRows(sqlMock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+
+	got, err := m.Pending(ctx)
+	assert.Nil(err)
+	assert.Equal([]Migration{m.migrations[1]}, got)
+	assert.Nil(mock.ExpectationsWereMet())
+}
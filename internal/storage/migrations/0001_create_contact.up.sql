@@ -1,12 +1,3 @@
--- -----------------------------------------------------
--- Schema bitespeed
--- -----------------------------------------------------
-CREATE SCHEMA IF NOT EXISTS `bitespeed` ;
-USE `bitespeed` ;
-
--- -----------------------------------------------------
--- Table `bitespeed`.`contact`
--- -----------------------------------------------------
 CREATE TABLE IF NOT EXISTS contact (
   id SERIAL PRIMARY KEY,
   phone_number VARCHAR(100),
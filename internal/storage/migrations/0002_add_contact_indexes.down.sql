@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS contact_linked_id_idx;
+DROP INDEX IF EXISTS contact_phone_number_idx;
+DROP INDEX IF EXISTS contact_email_idx;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS contact_email_idx ON contact (email);
+CREATE INDEX IF NOT EXISTS contact_phone_number_idx ON contact (phone_number);
+CREATE INDEX IF NOT EXISTS contact_linked_id_idx ON contact (linked_id);
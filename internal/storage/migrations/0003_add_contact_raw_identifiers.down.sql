@@ -0,0 +1,4 @@
+UPDATE contact SET phone_number = raw_phone_number, email = raw_email;
+
+ALTER TABLE contact DROP COLUMN raw_email;
+ALTER TABLE contact DROP COLUMN raw_phone_number;
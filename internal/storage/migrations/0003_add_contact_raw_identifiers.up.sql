@@ -0,0 +1,8 @@
+ALTER TABLE contact ADD COLUMN raw_phone_number VARCHAR(100);
+ALTER TABLE contact ADD COLUMN raw_email VARCHAR(100);
+
+UPDATE contact SET raw_phone_number = phone_number, raw_email = email;
+
+UPDATE contact SET
+  email = NULLIF(lower(trim(email)), ''),
+  phone_number = NULLIF(regexp_replace(phone_number, '[\s().-]', '', 'g'), '');
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS contact_merge_member;
+DROP TABLE IF EXISTS contact_merge;
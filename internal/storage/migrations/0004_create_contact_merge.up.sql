@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS contact_merge (
+  id SERIAL PRIMARY KEY,
+  primary_id INT NOT NULL,
+  merged_id INT NOT NULL,
+  phone_number VARCHAR(100),
+  email VARCHAR(100),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  reverted_at TIMESTAMP NULL
+);
+
+CREATE TABLE IF NOT EXISTS contact_merge_member (
+  merge_id INT NOT NULL REFERENCES contact_merge (id) ON DELETE CASCADE,
+  contact_id INT NOT NULL,
+  PRIMARY KEY (merge_id, contact_id)
+);
+
+CREATE INDEX IF NOT EXISTS contact_merge_member_contact_id_idx ON contact_merge_member (contact_id);
+CREATE INDEX IF NOT EXISTS contact_merge_identifiers_idx ON contact_merge (email, phone_number);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS contact_event (
+  id SERIAL PRIMARY KEY,
+  contact_id INT NOT NULL,
+  event_type VARCHAR(20) NOT NULL CHECK (event_type IN ('created', 'linked', 'merged', 'unmerged', 'deleted')),
+  primary_id INT,
+  phone_number VARCHAR(100),
+  email VARCHAR(100),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS contact_event_contact_id_idx ON contact_event (contact_id);
+CREATE INDEX IF NOT EXISTS contact_event_primary_id_idx ON contact_event (primary_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS contact_updated_at_idx;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS contact_updated_at_idx ON contact (updated_at);
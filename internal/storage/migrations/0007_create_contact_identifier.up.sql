@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS contact_identifier (
+  contact_id INT NOT NULL REFERENCES contact (id),
+  type VARCHAR(50) NOT NULL,
+  value VARCHAR(255) NOT NULL,
+  PRIMARY KEY (contact_id, type, value)
+);
+
+CREATE INDEX IF NOT EXISTS contact_identifier_type_value_idx ON contact_identifier (type, value);
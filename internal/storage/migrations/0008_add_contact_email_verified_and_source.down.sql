@@ -0,0 +1,2 @@
+ALTER TABLE contact DROP COLUMN source;
+ALTER TABLE contact DROP COLUMN email_verified;
@@ -0,0 +1,2 @@
+ALTER TABLE contact ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE contact ADD COLUMN source VARCHAR(50);
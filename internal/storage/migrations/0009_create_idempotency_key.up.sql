@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS idempotency_key (
+  key VARCHAR(255) PRIMARY KEY,
+  request_hash CHAR(64) NOT NULL,
+  response TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
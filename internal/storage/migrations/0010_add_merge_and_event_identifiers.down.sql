@@ -0,0 +1,2 @@
+ALTER TABLE contact_event DROP COLUMN identifiers;
+ALTER TABLE contact_merge DROP COLUMN identifiers;
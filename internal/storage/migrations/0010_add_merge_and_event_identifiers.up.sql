@@ -0,0 +1,2 @@
+ALTER TABLE contact_merge ADD COLUMN identifiers JSONB;
+ALTER TABLE contact_event ADD COLUMN identifiers JSONB;
@@ -0,0 +1 @@
+ALTER TABLE contact ALTER COLUMN updated_at SET DEFAULT clock_timestamp();
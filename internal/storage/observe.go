@@ -0,0 +1,133 @@
+package storage
+
+import "context"
+
+// Observer is told about every ContactStorage call as it starts, with the context and the method
+// of the call. The function it returns is told about the end of the call: the number of contacts
+// it returned, 0 for methods writing contacts, and its error.
+type Observer func(ctx context.Context, method string) (done func(contacts int, err error))
+
+// SetObserver reports every ContactStorage call of the store, including those made in the
+// transactions it begins later, to o.
+func (s *Store) SetObserver(o Observer) {
+	s.observer = o
+	s.Contact = observeContactStorage(s.Contact, o)
+}
+
+func observeContactStorage(c ContactStorage, o Observer) ContactStorage {
+	if o == nil {
+		return c
+	}
+	return &observedContactStorage{next: c, observe: o}
+}
+
+type observedContactStorage struct {
+	next    ContactStorage
+	observe Observer
+}
+
+func (s *observedContactStorage) ListContacts(ctx context.Context) ([]Contact, error) {
+	done := s.observe(ctx, "ListContacts")
+	contacts, err := s.next.ListContacts(ctx)
+	done(len(contacts), err)
+	return contacts, err
+}
+
+func (s *observedContactStorage) ListContactsByEmailAndPhoneNumber(ctx context.Context, email string, phoneNumber string) ([]Contact, error) {
+	done := s.observe(ctx, "ListContactsByEmailAndPhoneNumber")
+	contacts, err := s.next.ListContactsByEmailAndPhoneNumber(ctx, email, phoneNumber)
+	done(len(contacts), err)
+	return contacts, err
+}
+
+func (s *observedContactStorage) ListContactsByIdentifiers(ctx context.Context, identifiers []Identifier) ([]Contact, error) {
+	done := s.observe(ctx, "ListContactsByIdentifiers")
+	contacts, err := s.next.ListContactsByIdentifiers(ctx, identifiers)
+	done(len(contacts), err)
+	return contacts, err
+}
+
+func (s *observedContactStorage) ListContactsByID(ctx context.Context, id int64) ([]Contact, error) {
+	done := s.observe(ctx, "ListContactsByID")
+	contacts, err := s.next.ListContactsByID(ctx, id)
+	done(len(contacts), err)
+	return contacts, err
+}
+
+func (s *observedContactStorage) GetContact(ctx context.Context, id int64) (*Contact, error) {
+	done := s.observe(ctx, "GetContact")
+	contact, err := s.next.GetContact(ctx, id)
+	if contact != nil {
+		done(1, err)
+	} else {
+		done(0, err)
+	}
+	return contact, err
+}
+
+func (s *observedContactStorage) GetPrimaryContact(ctx context.Context, id int64) (*Contact, error) {
+	done := s.observe(ctx, "GetPrimaryContact")
+	contact, err := s.next.GetPrimaryContact(ctx, id)
+	if contact != nil {
+		done(1, err)
+	} else {
+		done(0, err)
+	}
+	return contact, err
+}
+
+func (s *observedContactStorage) FlattenCluster(ctx context.Context, primaryID int64) (int64, error) {
+	done := s.observe(ctx, "FlattenCluster")
+	n, err := s.next.FlattenCluster(ctx, primaryID)
+	done(0, err)
+	return n, err
+}
+
+func (s *observedContactStorage) CreateContact(ctx context.Context, contact Contact) (int64, error) {
+	done := s.observe(ctx, "CreateContact")
+	n, err := s.next.CreateContact(ctx, contact)
+	done(0, err)
+	return n, err
+}
+
+func (s *observedContactStorage) UpdateContact(ctx context.Context, id int64, contact Contact) error {
+	done := s.observe(ctx, "UpdateContact")
+	err := s.next.UpdateContact(ctx, id, contact)
+	done(0, err)
+	return err
+}
+
+func (s *observedContactStorage) UpdateEmailAndPhoneNumber(ctx context.Context, id int64, email string, phoneNumber string) error {
+	done := s.observe(ctx, "UpdateEmailAndPhoneNumber")
+	err := s.next.UpdateEmailAndPhoneNumber(ctx, id, email, phoneNumber)
+	done(0, err)
+	return err
+}
+
+func (s *observedContactStorage) UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx context.Context, olderContactLinkedID, newerContactLinkedID int64) error {
+	done := s.observe(ctx, "UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs")
+	err := s.next.UpdateNewerContactsLinkedIDsWithOlderContactsLinkedIDs(ctx, olderContactLinkedID, newerContactLinkedID)
+	done(0, err)
+	return err
+}
+
+func (s *observedContactStorage) PromoteContact(ctx context.Context, id int64) error {
+	done := s.observe(ctx, "PromoteContact")
+	err := s.next.PromoteContact(ctx, id)
+	done(0, err)
+	return err
+}
+
+func (s *observedContactStorage) DeleteContact(ctx context.Context, id int64) error {
+	done := s.observe(ctx, "DeleteContact")
+	err := s.next.DeleteContact(ctx, id)
+	done(0, err)
+	return err
+}
+
+func (s *observedContactStorage) AcquireLocks(ctx context.Context, keys ...string) error {
+	done := s.observe(ctx, "AcquireLocks")
+	err := s.next.AcquireLocks(ctx, keys...)
+	done(0, err)
+	return err
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	asserts "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_Store_SetObserver(t *testing.T) {
+	assert := asserts.New(t)
+	s := NewMemory()
+
+	type ctxKey struct{}
+	type call struct {
+		method   string
+		request  interface{}
+		contacts int
+		err      error
+	}
+	var calls []call
+	s.SetObserver(func(ctx context.Context, method string) func(int, error) {
+		return func(contacts int, err error) {
+			calls = append(calls, call{method, ctx.Value(ctxKey{}), contacts, err})
+		}
+	})
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	_, err := s.Contact.CreateContact(ctx, Contact{Email: "a@gmail.com", LinkPrecedence: "primary"})
+	assert.Nil(err)
+
+	// Transactions begun after the observer is set are observed too.
+	tx, err := s.BeginTx(ctx, nil)
+	assert.Nil(err)
+	_, err = tx.Contact.ListContactsByEmailAndPhoneNumber(ctx, "a@gmail.com", "")
+	assert.Nil(err)
+	_, err = tx.Contact.GetContact(context.Background(), 100)
+	assert.Equal(sql.ErrNoRows, err)
+	assert.Nil(tx.Rollback())
+
+	assert.Equal([]call{
+		{"CreateContact", "request", 0, nil},
+		{"ListContactsByEmailAndPhoneNumber", "request", 1, nil},
+		{"GetContact", nil, 0, sql.ErrNoRows},
+	}, calls)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"errors"
+	"github.com/lib/pq"
+)
+
+// Reasons for a transaction to fail only because of concurrent transactions. Such a transaction
+// may succeed when run again from the start.
+const (
+	RetrySerializationFailure = "serialization_failure"
+	RetryDeadlock             = "deadlock"
+)
+
+// Postgres error codes of the retry reasons.
+var retryReasons = map[pq.ErrorCode]string{
+	"40001": RetrySerializationFailure,
+	"40P01": RetryDeadlock,
+}
+
+// Retryable tells whether err, returned by a statement or the commit of a transaction, failed
+// the transaction because of concurrent transactions, and why: one of the Retry* constants.
+func Retryable(err error) (reason string, ok bool) {
+	if errors.Is(err, errMemoryDeadlock) {
+		return RetryDeadlock, true
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return "", false
+	}
+	reason, ok = retryReasons[pqErr.Code]
+	return reason, ok
+}
@@ -3,40 +3,189 @@ package storage
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	_ "github.com/lib/pq"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 type database interface {
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	Exec(query string, args ...interface{}) (sql.Result, error)
-	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
+// Store gives access to the contacts, merges and events of the database. The store returned by
+// New or NewMemory runs every statement on its own, while the one returned by its BeginTx runs
+// them in a transaction; a store never changes after being set up, so it may be shared by
+// concurrent requests.
 type Store struct {
-	Sql     *sql.DB
-	Tx      database
-	Contact ContactStorage
+	Sql         *sql.DB
+	Contact     ContactStorage
+	Merge       MergeStorage
+	Event       EventStorage
+	Idempotency IdempotencyStorage
+
+	tx       tx
+	memory   *memoryDB
+	observer Observer
+}
+
+type tx interface {
+	Commit() error
+	Rollback() error
 }
 
-func New(username, password, host, dbname string) (*Store, error) {
-	connectString := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable", host, username, password, dbname)
-	db, err := sql.Open("postgres", connectString)
-	if err == nil {
+var (
+	// errNotInTx is returned by Commit and Rollback of a store not returned by BeginTx.
+	errNotInTx = errors.New("storage: store is not in a transaction")
+	// errInTx is returned by BeginTx of a store returned by BeginTx.
+	errInTx = errors.New("storage: store is already in a transaction")
+)
+
+// PostgresConfig holds the connection settings of a Postgres database. Zero pool sizes and
+// durations leave the database/sql defaults in place: no limit and no timeout.
+type PostgresConfig struct {
+	User            string
+	Password        string
+	Host            string
+	Port            int
+	Database        string
+	SSLMode         string
+	ConnectTimeout  time.Duration
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DSN returns the connection URL of the database.
+func (c PostgresConfig) DSN() string {
+	query := url.Values{}
+	if c.SSLMode != "" {
+		query.Set("sslmode", c.SSLMode)
+	}
+	if c.ConnectTimeout > 0 {
+		// Postgres counts the timeout in whole seconds, rounded up so that it is never zero.
+		query.Set("connect_timeout", strconv.FormatInt(int64((c.ConnectTimeout+time.Second-1)/time.Second), 10))
+	}
+
+	host := c.Host
+	if c.Port != 0 {
+		host = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     host,
+		Path:     "/" + c.Database,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+func New(cfg PostgresConfig) (*Store, error) {
+	db, err := sql.Open("postgres", cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	return &Store{
+		Sql:         db,
+		Contact:     NewContactStorage(db),
+		Merge:       NewMergeStorage(db),
+		Event:       NewEventStorage(db),
+		Idempotency: NewIdempotencyStorage(db),
+	}, nil
+}
+
+// NewMemory returns a Store that keeps contacts in process memory. It needs
+// no database and loses all data when the process exits.
+func NewMemory() *Store {
+	m := newMemoryDB()
+	return &Store{
+		Contact:     newMemoryContactStorage(m, nil),
+		Merge:       newMemoryMergeStorage(m, nil),
+		Event:       newMemoryEventStorage(m, nil),
+		Idempotency: newMemoryIdempotencyStorage(m, nil),
+		memory:      m,
+	}
+}
+
+// Ping checks that the database is reachable. The memory store is always reachable.
+func (s *Store) Ping(ctx context.Context) error {
+	if s.Sql == nil {
+		return nil
+	}
+	return s.Sql.PingContext(ctx)
+}
+
+// Close releases the database connections of the store, waiting for queries in progress.
+func (s *Store) Close() error {
+	if s.Sql == nil {
+		return nil
+	}
+	return s.Sql.Close()
+}
+
+// BeginTx begins a transaction and returns a store running every statement in it, until its
+// Commit or Rollback. The transaction is rolled back once ctx is done. s itself is left untouched.
+func (s *Store) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Store, error) {
+	if s.tx != nil {
+		return nil, errInTx
+	}
+
+	if s.memory != nil {
+		tx, err := s.memory.begin(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
 		return &Store{
-			Sql:     db,
-			Contact: NewContactStorage(db),
+			Contact:     observeContactStorage(newMemoryContactStorage(s.memory, tx), s.observer),
+			Merge:       newMemoryMergeStorage(s.memory, tx),
+			Event:       newMemoryEventStorage(s.memory, tx),
+			Idempotency: newMemoryIdempotencyStorage(s.memory, tx),
+			tx:          tx,
+			memory:      s.memory,
+			observer:    s.observer,
 		}, nil
 	}
-	return nil, err
-}
 
-func (s *Store) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
 	tx, err := s.Sql.BeginTx(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	s.Tx = tx
-	s.Contact = NewContactStorage(tx)
-	return tx, nil
+	return &Store{
+		Sql:         s.Sql,
+		Contact:     observeContactStorage(NewContactStorage(tx), s.observer),
+		Merge:       NewMergeStorage(tx),
+		Event:       NewEventStorage(tx),
+		Idempotency: NewIdempotencyStorage(tx),
+		tx:          tx,
+		observer:    s.observer,
+	}, nil
+}
+
+// Commit commits the transaction of a store returned by BeginTx.
+func (s *Store) Commit() error {
+	if s.tx == nil {
+		return errNotInTx
+	}
+	return s.tx.Commit()
+}
+
+// Rollback rolls back the transaction of a store returned by BeginTx.
+func (s *Store) Rollback() error {
+	if s.tx == nil {
+		return errNotInTx
+	}
+	return s.tx.Rollback()
 }
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	asserts "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_PostgresConfig_DSN(t *testing.T) {
+	assert := asserts.New(t)
+
+	cfg := PostgresConfig{User: "app", Password: "p@ss word", Host: "db", Port: 5432, Database: "contacts", SSLMode: "require", ConnectTimeout: 1500 * time.Millisecond}
+	assert.Equal("postgres://app:p%40ss%20word@db:5432/contacts?connect_timeout=2&sslmode=require", cfg.DSN())
+
+	cfg = PostgresConfig{User: "app", Host: "db", Database: "contacts"}
+	assert.Equal("postgres://app:@db/contacts", cfg.DSN())
+}
+
+func Test_Retryable(t *testing.T) {
+	tcc := []struct {
+		name   string
+		err    error
+		reason string
+		ok     bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, RetrySerializationFailure, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, RetryDeadlock, true},
+		{"wrapped", fmt.Errorf("commit: %w", &pq.Error{Code: "40P01"}), RetryDeadlock, true},
+		{"memory deadlock", errMemoryDeadlock, RetryDeadlock, true},
+		{"other postgres error", &pq.Error{Code: "23505"}, "", false},
+		{"other error", sql.ErrNoRows, "", false},
+		{"no error", nil, "", false},
+	}
+
+	for _, tc := range tcc {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := asserts.New(t)
+			reason, ok := Retryable(tc.err)
+			assert.Equal(tc.reason, reason)
+			assert.Equal(tc.ok, ok)
+		})
+	}
+}
@@ -11,6 +11,15 @@ func KeyExists(k string, m map[string]Void) bool {
 	return exists
 }
 
+func Contains[T comparable](s []T, v T) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
 type QueryParams struct {
 	ColumnNumber int
 	Columns      []string
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/harshabangi/bitespeed/internal/service"
 	"log"
+	"os"
 )
 
 // @title BiteSpeed API
@@ -17,9 +18,41 @@ import (
 // @license.name Apache 2.0
 // @license.url http://www.apache.org/licenses/LICENSE-2.0.html
 func main() {
-	app, err := service.NewService()
+	cfg, args, err := service.LoadConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	app.Run()
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := service.Migrate(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "renormalize" {
+		if err := service.Renormalize(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(args) > 0 && args[0] == "fsck" {
+		if err := service.Fsck(cfg, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(args) > 0 {
+		log.Fatalf("unknown command: %s", args[0])
+	}
+
+	app, err := service.NewService(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
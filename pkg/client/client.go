@@ -0,0 +1,197 @@
+// Package client is a Go client for the identify API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/harshabangi/bitespeed/pkg"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultMaxRetries = 2
+	defaultBackoff    = 100 * time.Millisecond
+)
+
+// Client calls the identify API of a service at a base URL such as "http://localhost:8080".
+//
+// Requests failing with a network error or a 5xx status are retried, waiting a backoff that
+// doubles after every attempt. Every attempt of an Identify call carries the same
+// Idempotency-Key header, so that the service answers a retry of a request it already applied
+// with the response it stored rather than applying it again. Batches are sent without a key:
+// a batch retried after the service applied it is applied again, which links the same contacts
+// unless other requests changed them in between. Lookups change nothing.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	maxRetries int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client requests are sent with. It defaults to http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout sets how long a single attempt may take. Zero disables the timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried, and the wait before the first retry.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    defaultTimeout,
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Identify links the request to the stored contacts and returns the consolidated contact. The
+// request is sent with a new idempotency key, reused by its retries.
+func (c *Client) Identify(ctx context.Context, req pkg.ContactRequest) (*pkg.ContactResponse, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var res pkg.ContactResponse
+	if err := c.post(ctx, "/identify", key, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// IdentifyBatch identifies every request in order. Requests failing on their own are reported
+// in their result rather than failing the batch.
+func (c *Client) IdentifyBatch(ctx context.Context, reqs []pkg.ContactRequest) (*pkg.BatchContactResponse, error) {
+	var res pkg.BatchContactResponse
+	if err := c.post(ctx, "/identify/batch", "", reqs, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Lookup returns the contact Identify would return for the request, and the change it would
+// make, without changing anything.
+func (c *Client) Lookup(ctx context.Context, req pkg.ContactRequest) (*pkg.LookupResponse, error) {
+	var res pkg.LookupResponse
+	if err := c.post(ctx, "/identify/lookup", "", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// post sends body to path until it succeeds or fails for good, with the Idempotency-Key header
+// set to idempotencyKey on every attempt unless it is empty.
+func (c *Client) post(ctx context.Context, path string, idempotencyKey string, body interface{}, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err = c.do(ctx, path, idempotencyKey, payload, result)
+		if err == nil || attempt >= c.maxRetries || !retryable(ctx, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) do(ctx context.Context, path string, idempotencyKey string, payload []byte, result interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// newIdempotencyKey returns a random key, unique to a call.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// retryable reports whether a request failing with err may succeed if sent again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	return true
+}
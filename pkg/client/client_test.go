@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/harshabangi/bitespeed/internal/service"
+	"github.com/harshabangi/bitespeed/pkg"
+	asserts "github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the real handlers of the service, backed by the memory storage. The
+// first failures requests are answered with 503 instead.
+func newTestServer(t *testing.T, failures int32) (*httptest.Server, *int32) {
+	cfg := service.NewConfig()
+	cfg.Storage = "memory"
+	svc, err := service.NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := svc.Router()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func Test_Client_Identify(t *testing.T) {
+	assert := asserts.New(t)
+	srv, _ := newTestServer(t, 0)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	res, err := c.Identify(ctx, pkg.ContactRequest{Email: "a@example.com", PhoneNumber: "111"})
+	assert.Nil(err)
+	assert.Equal(int64(1), res.Contact.PrimaryContactID)
+
+	res, err = c.Identify(ctx, pkg.ContactRequest{Email: "b@example.com", PhoneNumber: "111"})
+	assert.Nil(err)
+	assert.Equal(pkg.Contact{
+		PrimaryContactID:    1,
+		Emails:              []string{"a@example.com", "b@example.com"},
+		PhoneNumbers:        []string{"111"},
+		SecondaryContactIDs: []int64{2},
+	}, res.Contact)
+}
+
+func Test_Client_Lookup(t *testing.T) {
+	assert := asserts.New(t)
+	srv, _ := newTestServer(t, 0)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.Identify(ctx, pkg.ContactRequest{Email: "a@example.com"})
+	assert.Nil(err)
+
+	res, err := c.Lookup(ctx, pkg.ContactRequest{Email: "a@example.com", PhoneNumber: "111"})
+	assert.Nil(err)
+	assert.Equal(pkg.OutcomeNewSecondary, res.Outcome)
+	assert.Equal([]string{"111"}, res.Contact.PhoneNumbers)
+}
+
+func Test_Client_IdentifyBatch(t *testing.T) {
+	assert := asserts.New(t)
+	srv, _ := newTestServer(t, 0)
+	c := New(srv.URL)
+
+	res, err := c.IdentifyBatch(context.Background(), []pkg.ContactRequest{
+		{Email: "a@example.com"},
+		{Email: "abc"},
+	})
+	assert.Nil(err)
+	assert.Equal(2, len(res.Results))
+	assert.Equal(http.StatusOK, res.Results[0].Status)
+	assert.Equal(int64(1), res.Results[0].Contact.PrimaryContactID)
+	assert.Equal(http.StatusBadRequest, res.Results[1].Status)
+	assert.Equal("incorrect email address: abc", res.Results[1].Error)
+}
+
+func Test_Client_Errors(t *testing.T) {
+	t.Run("bad request", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv, requests := newTestServer(t, 0)
+
+		_, err := New(srv.URL).Identify(context.Background(), pkg.ContactRequest{Email: "abc"})
+		assert.True(errors.Is(err, ErrBadRequest))
+		assert.False(errors.Is(err, ErrServer))
+
+		var apiErr *Error
+		assert.True(errors.As(err, &apiErr))
+		assert.Equal(&Error{StatusCode: http.StatusBadRequest, Message: "incorrect email address: abc"}, apiErr)
+
+		// Bad requests are not retried.
+		assert.Equal(int32(1), atomic.LoadInt32(requests))
+	})
+
+	t.Run("server errors are retried", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv, requests := newTestServer(t, 2)
+
+		res, err := New(srv.URL, WithRetries(2, time.Millisecond)).Identify(context.Background(), pkg.ContactRequest{Email: "a@example.com"})
+		assert.Nil(err)
+		assert.Equal(int64(1), res.Contact.PrimaryContactID)
+		assert.Equal(int32(3), atomic.LoadInt32(requests))
+	})
+
+	t.Run("retries reuse the idempotency key", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv, _ := newTestServer(t, 2)
+		target, err := url.Parse(srv.URL)
+		assert.Nil(err)
+
+		var (
+			mu   sync.Mutex
+			keys []string
+		)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			mu.Unlock()
+			proxy.ServeHTTP(w, r)
+		}))
+		defer front.Close()
+
+		c := New(front.URL, WithRetries(2, time.Millisecond))
+		_, err = c.Identify(context.Background(), pkg.ContactRequest{Email: "a@example.com"})
+		assert.Nil(err)
+		_, err = c.Identify(context.Background(), pkg.ContactRequest{Email: "a@example.com"})
+		assert.Nil(err)
+
+		// Three attempts of the first call, then the second call with a key of its own.
+		if assert.Equal(4, len(keys)) {
+			assert.NotEmpty(keys[0])
+			assert.Equal(keys[0], keys[1])
+			assert.Equal(keys[0], keys[2])
+			assert.NotEqual(keys[0], keys[3])
+		}
+	})
+
+	t.Run("server error once retries are exhausted", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv, requests := newTestServer(t, 2)
+
+		_, err := New(srv.URL, WithRetries(1, time.Millisecond)).Identify(context.Background(), pkg.ContactRequest{Email: "a@example.com"})
+		assert.True(errors.Is(err, ErrServer))
+		assert.EqualError(err, "bitespeed: status 503: unavailable")
+		assert.Equal(int32(2), atomic.LoadInt32(requests))
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		assert := asserts.New(t)
+		srv, requests := newTestServer(t, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := New(srv.URL).Identify(ctx, pkg.ContactRequest{Email: "a@example.com"})
+		assert.True(errors.Is(err, context.Canceled))
+		assert.Equal(int32(0), atomic.LoadInt32(requests))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert := asserts.New(t)
+		done := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-done
+		}))
+		defer srv.Close()
+		defer close(done)
+
+		_, err := New(srv.URL, WithTimeout(10*time.Millisecond), WithRetries(0, 0)).Identify(context.Background(), pkg.ContactRequest{Email: "a@example.com"})
+		assert.True(errors.Is(err, context.DeadlineExceeded))
+	})
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrBadRequest matches the errors of requests the service rejected as invalid.
+	ErrBadRequest = errors.New("bad request")
+
+	// ErrServer matches the errors of requests the service failed to handle.
+	ErrServer = errors.New("server error")
+)
+
+// Error is a response of the service with an error status. Use errors.Is with ErrBadRequest or
+// ErrServer to tell the kind of error apart.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func newError(statusCode int, body []byte) *Error {
+	var res struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &res); err == nil && res.Message != "" {
+		message = res.Message
+	}
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	return &Error{StatusCode: statusCode, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("bitespeed: status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
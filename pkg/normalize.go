@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/nyaruka/phonenumbers"
+	"net/mail"
+	"strings"
+)
+
+// EmailRule rewrites the local part of an already lowercased email address.
+// Rules are used for providers that deliver differently spelled addresses to
+// the same mailbox.
+type EmailRule interface {
+	Apply(local, domain string) string
+}
+
+// GmailRule ignores dots and "+tag" suffixes in Gmail addresses, so that
+// "John.Doe+shop@gmail.com" and "johndoe@gmail.com" are the same contact.
+type GmailRule struct{}
+
+func (GmailRule) Apply(local, domain string) string {
+	if domain != "gmail.com" && domain != "googlemail.com" {
+		return local
+	}
+	if i := strings.IndexByte(local, '+'); i >= 0 {
+		local = local[:i]
+	}
+	return strings.ReplaceAll(local, ".", "")
+}
+
+// EmailRules maps the names accepted in configuration to their rules.
+var EmailRules = map[string]EmailRule{
+	"gmail": GmailRule{},
+}
+
+// Normalizer turns emails and phone numbers into a canonical form before
+// they are stored or looked up.
+//
+// Emails are trimmed and lowercased, then rewritten by EmailRules. Phone
+// numbers are stripped of spaces and punctuation; if DefaultRegion is set
+// (an ISO 3166-1 region such as "IN") they are formatted as E.164 instead,
+// with numbers lacking a country code assumed to belong to that region.
+type Normalizer struct {
+	EmailRules    []EmailRule
+	DefaultRegion string
+}
+
+func NewNormalizer() *Normalizer {
+	return &Normalizer{}
+}
+
+// SupportedRegion reports whether region can be used as a DefaultRegion.
+func SupportedRegion(region string) bool {
+	_, ok := phonenumbers.GetSupportedRegions()[strings.ToUpper(region)]
+	return ok
+}
+
+func (n *Normalizer) WithEmailRules(rules ...EmailRule) *Normalizer {
+	n.EmailRules = append(n.EmailRules, rules...)
+	return n
+}
+
+func (n *Normalizer) WithDefaultRegion(region string) *Normalizer {
+	n.DefaultRegion = strings.ToUpper(region)
+	return n
+}
+
+// Normalize replaces the request's email and phone number with their
+// canonical form, keeping the values as received in RawEmail and
+// RawPhoneNumber.
+func (n *Normalizer) Normalize(c *ContactRequest) error {
+	c.RawEmail = c.Email
+	c.RawPhoneNumber = c.PhoneNumber
+
+	c.Email = n.NormalizeEmail(c.Email)
+
+	phoneNumber, err := n.NormalizePhoneNumber(c.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	c.PhoneNumber = phoneNumber
+
+	c.Identifiers = n.NormalizeIdentifiers(c.Identifiers)
+	c.Source = strings.TrimSpace(c.Source)
+	return nil
+}
+
+// NormalizeIdentifiers trims identifier types and values and drops duplicates. Values are
+// otherwise kept as received, since their format is up to the system that issued them.
+func (n *Normalizer) NormalizeIdentifiers(identifiers []Identifier) []Identifier {
+	var result []Identifier
+	seen := make(map[Identifier]bool, len(identifiers))
+	for _, id := range identifiers {
+		id = Identifier{Type: strings.TrimSpace(id.Type), Value: strings.TrimSpace(id.Value)}
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func (n *Normalizer) NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return ""
+	}
+
+	// Drop display names such as "John <john@example.com>".
+	if addr, err := mail.ParseAddress(email); err == nil {
+		email = addr.Address
+	}
+
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	for _, rule := range n.EmailRules {
+		local = rule.Apply(local, domain)
+	}
+	return local + "@" + domain
+}
+
+func (n *Normalizer) NormalizePhoneNumber(phoneNumber string) (string, error) {
+	phoneNumber = strings.TrimSpace(phoneNumber)
+	if phoneNumber == "" {
+		return "", nil
+	}
+
+	if n.DefaultRegion == "" {
+		return strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '-', '.', '(', ')':
+				return -1
+			}
+			return r
+		}, phoneNumber), nil
+	}
+
+	num, err := phonenumbers.Parse(phoneNumber, n.DefaultRegion)
+	if err != nil || !phonenumbers.IsPossibleNumber(num) {
+		return "", fmt.Errorf("incorrect phone number: %s", phoneNumber)
+	}
+	return phonenumbers.Format(num, phonenumbers.E164), nil
+}
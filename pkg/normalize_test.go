@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	asserts "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_NormalizeEmail(t *testing.T) {
+	tcc := []struct {
+		name       string
+		normalizer *Normalizer
+		input      string
+		want       string
+	}{
+		{"empty", NewNormalizer(), "", ""},
+		{"lowercase and trim", NewNormalizer(), "  John.Doe@Example.COM ", "john.doe@example.com"},
+		{"display name", NewNormalizer(), "John <John@example.com>", "john@example.com"},
+		{"gmail rule disabled", NewNormalizer(), "John.Doe+shop@gmail.com", "john.doe+shop@gmail.com"},
+		{"gmail rule", NewNormalizer().WithEmailRules(GmailRule{}), "John.Doe+shop@gmail.com", "johndoe@gmail.com"},
+		{"gmail rule on googlemail", NewNormalizer().WithEmailRules(GmailRule{}), "john.doe@googlemail.com", "johndoe@googlemail.com"},
+		{"gmail rule on other domain", NewNormalizer().WithEmailRules(GmailRule{}), "john.doe+shop@example.com", "john.doe+shop@example.com"},
+	}
+	for _, tc := range tcc {
+		t.Run(tc.name, func(t *testing.T) {
+			asserts.Equal(t, tc.want, tc.normalizer.NormalizeEmail(tc.input))
+		})
+	}
+}
+
+func Test_NormalizePhoneNumber(t *testing.T) {
+	tcc := []struct {
+		name       string
+		normalizer *Normalizer
+		input      string
+		want       string
+		wantError  bool
+	}{
+		{"empty", NewNormalizer(), "", "", false},
+		{"strip punctuation", NewNormalizer(), " (987) 654-3210 ", "9876543210", false},
+		{"keep country code", NewNormalizer(), "+91 98765 43210", "+919876543210", false},
+		{"e164 with default region", NewNormalizer().WithDefaultRegion("in"), "98765 43210", "+919876543210", false},
+		{"e164 with country code", NewNormalizer().WithDefaultRegion("IN"), "+91 98765-43210", "+919876543210", false},
+		{"e164 with other country code", NewNormalizer().WithDefaultRegion("IN"), "+1 (415) 555-2671", "+14155552671", false},
+		{"e164 invalid", NewNormalizer().WithDefaultRegion("IN"), "abc", "", true},
+	}
+	for _, tc := range tcc {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := asserts.New(t)
+			got, err := tc.normalizer.NormalizePhoneNumber(tc.input)
+			if tc.wantError {
+				assert.NotNil(err)
+				return
+			}
+			assert.Nil(err)
+			assert.Equal(tc.want, got)
+		})
+	}
+}
+
+func Test_Normalize(t *testing.T) {
+	assert := asserts.New(t)
+
+	req := ContactRequest{Email: " A@X.com", PhoneNumber: "98765 43210"}
+	assert.Nil(NewNormalizer().WithDefaultRegion("IN").Normalize(&req))
+	assert.Equal(ContactRequest{
+		Email:          "a@x.com",
+		PhoneNumber:    "+919876543210",
+		RawEmail:       " A@X.com",
+		RawPhoneNumber: "98765 43210",
+	}, req)
+}
+
+func Test_NormalizeIdentifiers(t *testing.T) {
+	assert := asserts.New(t)
+
+	got := NewNormalizer().NormalizeIdentifiers([]Identifier{
+		{Type: "loyaltyId", Value: " L-1"},
+		{Type: " deviceId ", Value: "D-1"},
+		{Type: "loyaltyId", Value: "L-1 "},
+	})
+	assert.Equal([]Identifier{{Type: "loyaltyId", Value: "L-1"}, {Type: "deviceId", Value: "D-1"}}, got)
+}
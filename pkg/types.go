@@ -3,22 +3,90 @@ package pkg
 import (
 	"fmt"
 	"net/mail"
+	"regexp"
 	"strconv"
+	"time"
 )
 
 type ContactRequest struct {
-	Email       string `json:"email" example:"contact@example.com"`
-	PhoneNumber string `json:"phoneNumber" example:"1234567890"`
+	Email       string       `json:"email" example:"contact@example.com"`
+	PhoneNumber string       `json:"phoneNumber" example:"1234567890"`
+	Identifiers []Identifier `json:"identifiers,omitempty"`
+
+	// EmailVerified and Source tell whether the caller verified the email, and which system the
+	// contact comes from. They are kept on contacts the request creates, for primary policies.
+	EmailVerified bool   `json:"emailVerified,omitempty" example:"true"`
+	Source        string `json:"source,omitempty" example:"pos"`
+
+	// RawEmail and RawPhoneNumber hold the values as received, before Normalizer.Normalize.
+	RawEmail       string `json:"-"`
+	RawPhoneNumber string `json:"-"`
 }
 
 func (c *ContactRequest) Validate() error {
-	if c.Email == "" && c.PhoneNumber == "" {
-		return fmt.Errorf("inadequate input parameters. Required either email or phone number or both")
+	if c.Email == "" && c.PhoneNumber == "" && len(c.Identifiers) == 0 {
+		return fmt.Errorf("inadequate input parameters. Required at least one of email, phone number or identifiers")
 	}
 	if err := validateEmail(c.Email); err != nil {
 		return err
 	}
-	return validatePhoneNumber(c.PhoneNumber)
+	if err := validatePhoneNumber(c.PhoneNumber); err != nil {
+		return err
+	}
+	if c.EmailVerified && c.Email == "" {
+		return fmt.Errorf("emailVerified requires an email")
+	}
+	if len(c.Source) > 50 {
+		return fmt.Errorf("incorrect source: %q", c.Source)
+	}
+	for _, id := range c.Identifiers {
+		if err := id.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllIdentifiers returns every identifier of the request, its email and phone number included.
+func (c *ContactRequest) AllIdentifiers() []Identifier {
+	var result []Identifier
+	if c.Email != "" {
+		result = append(result, Identifier{Type: IdentifierEmail, Value: c.Email})
+	}
+	if c.PhoneNumber != "" {
+		result = append(result, Identifier{Type: IdentifierPhoneNumber, Value: c.PhoneNumber})
+	}
+	return append(result, c.Identifiers...)
+}
+
+// Types of the identifiers held by the email and phone number fields, which can't be used in
+// the identifiers of a request.
+const (
+	IdentifierEmail       = "email"
+	IdentifierPhoneNumber = "phoneNumber"
+)
+
+// Identifier is a value of some type, such as a loyalty id, a device id or a social login
+// subject, by which a customer is known. Contacts sharing an identifier of the same type
+// belong to the same customer, just as contacts sharing an email or a phone number do.
+type Identifier struct {
+	Type  string `json:"type" example:"loyaltyId"`
+	Value string `json:"value" example:"L-1234"`
+}
+
+var identifierTypePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,49}$`)
+
+func (i Identifier) Validate() error {
+	if !identifierTypePattern.MatchString(i.Type) {
+		return fmt.Errorf("incorrect identifier type: %q", i.Type)
+	}
+	if i.Type == IdentifierEmail || i.Type == IdentifierPhoneNumber {
+		return fmt.Errorf("identifier type %s is reserved, use the %s field instead", i.Type, i.Type)
+	}
+	if i.Value == "" || len(i.Value) > 255 {
+		return fmt.Errorf("incorrect %s identifier: %q", i.Type, i.Value)
+	}
+	return nil
 }
 
 func validateEmail(email string) error {
@@ -44,6 +112,14 @@ func validatePhoneNumber(phoneNumber string) error {
 	return fmt.Errorf("incorrect phone number: %s", phoneNumber)
 }
 
+// Outcomes of an identify request.
+const (
+	OutcomeNewPrimary   = "newPrimary"   // a new primary contact is created
+	OutcomeNewSecondary = "newSecondary" // a new secondary contact is added to an existing cluster
+	OutcomeExisting     = "existing"     // an existing cluster is returned unchanged
+	OutcomeMerge        = "merge"        // two clusters are merged into one
+)
+
 type ContactResponse struct {
 	Contact Contact `json:"contact"`
 }
@@ -68,4 +144,137 @@ type Contact struct {
 	Emails              []string `json:"emails" example:"contact@example.com"`
 	PhoneNumbers        []string `json:"phoneNumbers" example:"1234567890"`
 	SecondaryContactIDs []int64  `json:"secondaryContactIds" example:"456"`
+
+	// Identifiers holds the values of every other identifier type, primary contact first.
+	Identifiers map[string][]string `json:"identifiers,omitempty"`
+
+	// UpdatedAt and Contacts are only set in expanded responses. UpdatedAt is
+	// the latest change to any contact of the cluster.
+	UpdatedAt *time.Time      `json:"updatedAt,omitempty"`
+	Contacts  []ContactDetail `json:"contacts,omitempty"`
+}
+
+// ContactDetail is a single stored contact of a cluster, oldest first.
+type ContactDetail struct {
+	ID             int64     `json:"id" example:"456"`
+	Email          string    `json:"email,omitempty" example:"contact@example.com"`
+	PhoneNumber    string    `json:"phoneNumber,omitempty" example:"1234567890"`
+	LinkedID       int64     `json:"linkedId,omitempty" example:"123"`
+	LinkPrecedence string    `json:"linkPrecedence" example:"secondary" enums:"primary,secondary"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// LookupResponse is the contact an identify request would return, along with the
+// change it would make.
+type LookupResponse struct {
+	Contact Contact `json:"contact"`
+	Outcome string  `json:"outcome" example:"newSecondary" enums:"newPrimary,newSecondary,existing,merge"`
+}
+
+// BatchContactResponse holds the result of every request of a batch, in request order.
+type BatchContactResponse struct {
+	Results []BatchContactResult `json:"results"`
+}
+
+func NewBatchContactResponse() *BatchContactResponse {
+	return &BatchContactResponse{
+		Results: make([]BatchContactResult, 0),
+	}
+}
+
+// BatchContactResult is either the contact a request of a batch resolved to,
+// or the error it failed with. Status is the HTTP status the request would
+// have received on its own.
+type BatchContactResult struct {
+	Status  int      `json:"status" example:"200"`
+	Contact *Contact `json:"contact,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// UnmergeRequest identifies the merge to revert, either by a contact that belonged
+// to the merged cluster or by the email, phone number and identifiers of the request
+// that caused it.
+type UnmergeRequest struct {
+	ContactID   int64        `json:"contactId" example:"456"`
+	Email       string       `json:"email" example:"contact@example.com"`
+	PhoneNumber string       `json:"phoneNumber" example:"1234567890"`
+	Identifiers []Identifier `json:"identifiers,omitempty"`
+}
+
+func (u *UnmergeRequest) Validate() error {
+	identifiers := len(u.Identifiers)
+	if u.Email != "" {
+		identifiers++
+	}
+	if u.PhoneNumber != "" {
+		identifiers++
+	}
+
+	if u.ContactID == 0 && identifiers < 2 {
+		return fmt.Errorf("inadequate input parameters. Required either contact id or at least two of email, phone number and identifiers")
+	}
+	if u.ContactID != 0 && identifiers > 0 {
+		return fmt.Errorf("too many input parameters. Required either contact id or at least two of email, phone number and identifiers")
+	}
+	for _, id := range u.Identifiers {
+		if err := id.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmergeResponse holds the consolidated contacts of the two clusters split by an unmerge.
+type UnmergeResponse struct {
+	Contacts []Contact `json:"contacts"`
+}
+
+// Types of the events in a contact's history.
+const (
+	EventCreated  = "created"  // a new primary contact is created
+	EventLinked   = "linked"   // a new secondary contact is added to a cluster
+	EventMerged   = "merged"   // a primary contact and its cluster are merged into another cluster
+	EventUnmerged = "unmerged" // a merged contact and its cluster are split off again
+	EventDeleted  = "deleted"  // a contact is deleted
+)
+
+// HistoryResponse lists the events of a cluster, oldest first.
+type HistoryResponse struct {
+	Events []ContactEvent `json:"events"`
+}
+
+func NewHistoryResponse() *HistoryResponse {
+	return &HistoryResponse{
+		Events: make([]ContactEvent, 0),
+	}
+}
+
+type ContactEvent struct {
+	ID               int64        `json:"id" example:"1"`
+	ContactID        int64        `json:"contactId" example:"456"`
+	Type             string       `json:"type" example:"linked" enums:"created,linked,merged,unmerged,deleted"`
+	PrimaryContactID int64        `json:"primaryContactId,omitempty" example:"123"`
+	Email            string       `json:"email,omitempty" example:"contact@example.com"`
+	PhoneNumber      string       `json:"phoneNumber,omitempty" example:"1234567890"`
+	Identifiers      []Identifier `json:"identifiers,omitempty"`
+	CreatedAt        time.Time    `json:"createdAt"`
+}
+
+// Statuses of a health check.
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthResponse is the status of the service along with the checks it is based on. The service
+// is unavailable as soon as any check is.
+type HealthResponse struct {
+	Status string                 `json:"status" example:"ok" enums:"ok,unavailable"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string `json:"status" example:"ok" enums:"ok,unavailable"`
+	Detail string `json:"detail,omitempty" example:"1 pending migration: 0008_add_contact_email_verified_and_source"`
 }
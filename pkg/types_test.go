@@ -31,6 +31,36 @@ func Test_ValidateContactRequest(t *testing.T) {
 			ContactRequest{Email: "a@gmail.com", PhoneNumber: "12345"},
 			"",
 		},
+		{
+			"identifiers only",
+			ContactRequest{Identifiers: []Identifier{{Type: "loyaltyId", Value: "L-1"}}},
+			"",
+		},
+		{
+			"incorrect identifier type",
+			ContactRequest{Identifiers: []Identifier{{Type: "loyalty id", Value: "L-1"}}},
+			`incorrect identifier type: "loyalty id"`,
+		},
+		{
+			"reserved identifier type",
+			ContactRequest{Identifiers: []Identifier{{Type: IdentifierEmail, Value: "a@gmail.com"}}},
+			"identifier type email is reserved, use the email field instead",
+		},
+		{
+			"empty identifier value",
+			ContactRequest{Identifiers: []Identifier{{Type: "loyaltyId"}}},
+			`incorrect loyaltyId identifier: ""`,
+		},
+		{
+			"verified email without email",
+			ContactRequest{PhoneNumber: "12345", EmailVerified: true},
+			"emailVerified requires an email",
+		},
+		{
+			"verified email with source",
+			ContactRequest{Email: "a@gmail.com", EmailVerified: true, Source: "pos"},
+			"",
+		},
 	}
 	for _, tc := range tcc {
 		t.Run(tc.name, func(t *testing.T) {